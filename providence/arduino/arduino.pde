@@ -18,6 +18,7 @@
 #define ID_FRONT_DOOR 1
 #define ID_GARAGE_DOOR 2
 #define ID_FOYER_MOTION 3
+#define ID_BACK_DOOR 4
 uint8_t PIN_ID[] = { // up to 255 sensors
   ID_UNUSED, // Arduino pins start at 2
   ID_UNUSED, // Arduino pins start at 2
@@ -76,6 +77,147 @@ uint8_t DEBOUNCE_TIMEOUT[] = {
   0, // unused
 };
 
+// Analog inputs wired as supervised loops: a 4.7k pull-up to 5V, then the
+// loop, which has a 4.7k end-of-line resistor in series with the contact and
+// another 4.7k across it. So a closed contact reads about 1/2 of full scale
+// and an open one about 2/3, while a cut wire reads full scale and a shorted
+// one zero -- which a plain switch input can't tell from open and closed.
+#define NUM_ANALOG 6
+uint8_t ANALOG_ID[] = { // A0 - A5
+  ID_BACK_DOOR,
+  ID_UNUSED,
+  ID_UNUSED,
+  ID_UNUSED,
+  ID_UNUSED,
+  ID_UNUSED,
+};
+
+#define LOOP_SHORTED 0
+#define LOOP_CLOSED 1
+#define LOOP_OPEN 2
+#define LOOP_CUT 3
+#define LOOP_UNKNOWN 255
+
+// Last reported state of each loop, and the state it's settling into
+uint8_t LOOP_REPORTED[] = {
+  LOOP_UNKNOWN, LOOP_UNKNOWN, LOOP_UNKNOWN, LOOP_UNKNOWN, LOOP_UNKNOWN, LOOP_UNKNOWN,
+};
+uint8_t LOOP_SETTLING[] = {
+  LOOP_UNKNOWN, LOOP_UNKNOWN, LOOP_UNKNOWN, LOOP_UNKNOWN, LOOP_UNKNOWN, LOOP_UNKNOWN,
+};
+unsigned long LOOP_CHANGED[] = {
+  0, 0, 0, 0, 0, 0,
+};
+
+// the contacts are mechanical, so debounce like a switch
+#define LOOP_DEBOUNCE_TIMEOUT 75
+
+// Thresholds are halfway between the nominal readings: 0, 512, 682 and 1023
+uint8_t classify(int reading) {
+  if (reading < 256) {
+    return LOOP_SHORTED;
+  }
+  if (reading < 597) {
+    return LOOP_CLOSED;
+  }
+  if (reading < 852) {
+    return LOOP_OPEN;
+  }
+  return LOOP_CUT;
+}
+
+// Sequence number of the next message, so the reader can tell if any were lost
+uint8_t next_seq = 0;
+
+// CRC-32 (IEEE), as computed by Go's hash/crc32.ChecksumIEEE
+uint32_t crc32(const char *buf, int len) {
+  uint32_t crc = 0xFFFFFFFF;
+  while (len--) {
+    crc ^= (uint8_t)*buf++;
+    for (uint8_t k = 0; k < 8; ++k) {
+      crc = (crc >> 1) ^ (0xEDB88320UL & -(crc & 1));
+    }
+  }
+  return ~crc;
+}
+
+// Sends a JSON message, framed as
+//   $<seq>,<JSON>*<CRC>\r\n
+// with the CRC taken over everything between '$' and '*', so the reader can
+// detect corruption and resynchronize after garbage at the next '$'.
+void send(const char *json) {
+  char body[96];
+  char crc[9];
+  int len = snprintf(body, sizeof(body), "%u,%s", next_seq++, json);
+  snprintf(crc, sizeof(crc), "%08lx", (unsigned long)crc32(body, len));
+  Serial.print('$');
+  Serial.print(body);
+  Serial.print('*');
+  Serial.println(crc);
+}
+
+// Reports a pin's new state (0 = TRIP, 1 = RESET)
+void report(uint8_t id, uint8_t action) {
+  char json[40];
+  snprintf(json, sizeof(json), "{\"Which\":\"%u\",\"Action\":%u}", id, action);
+  send(json);
+}
+
+// Reports that a sensor was tampered with ("cut" or "shorted"), or that it's
+// back to normal ("none")
+void report_tamper(uint8_t id, const char *kind) {
+  char json[48];
+  snprintf(json, sizeof(json), "{\"Which\":\"%u\",\"Tamper\":\"%s\"}", id, kind);
+  send(json);
+}
+
+// Reports a supervised loop's new state: tampering if it's cut or shorted,
+// else open or closed like a switch, clearing any tampering first
+void report_loop(uint8_t id, uint8_t from, uint8_t to) {
+  switch (to) {
+  case LOOP_SHORTED:
+    report_tamper(id, "shorted");
+    break;
+  case LOOP_CUT:
+    report_tamper(id, "cut");
+    break;
+  default:
+    if (from == LOOP_SHORTED || from == LOOP_CUT) {
+      report_tamper(id, "none");
+    }
+    report(id, to == LOOP_CLOSED ? 1 : 0);
+  }
+}
+
+// How often to tell the server we're still alive; it assumes we're dead if
+// it doesn't hear from us for a while, so keep this well under its timeout
+#define HEARTBEAT_INTERVAL 5000 // ms
+unsigned long last_heartbeat = 0;
+
+// Sends a heartbeat, listing the IDs of the sensors that are responding.
+// Only a supervised loop can tell us that: it reads full scale when cut or
+// unplugged, while a plain switch input that's been disconnected can't be
+// told from one that's simply closed, so those aren't listed at all. Loops
+// that haven't settled since startup aren't listed yet either.
+void heartbeat() {
+  char json[80];
+  int len = snprintf(json, sizeof(json), "{\"Heartbeat\":[");
+  bool first = true;
+  for (int i = 0; i < NUM_ANALOG; ++i) {
+    if (ANALOG_ID[i] == ID_UNUSED) {
+      continue;
+    }
+    if (LOOP_REPORTED[i] == LOOP_UNKNOWN || LOOP_REPORTED[i] == LOOP_CUT) {
+      continue;
+    }
+    len += snprintf(json + len, sizeof(json) - len, "%s\"%u\"", first ? "" : ",", ANALOG_ID[i]);
+    first = false;
+  }
+  snprintf(json + len, sizeof(json) - len, "]}");
+  send(json);
+  last_heartbeat = millis();
+}
+
 void setup() {
   for (int i = 2; i < 9; ++i) {
     if (PIN_TYPE[i] != PIN_TYPE_UNUSED) {
@@ -89,11 +231,15 @@ void setup() {
     }
   }
   Serial.begin(9600);
+  heartbeat();
 }
 
 void loop() {
   static uint8_t reading;
   static uint64_t current_millis;
+  if (millis() - last_heartbeat >= HEARTBEAT_INTERVAL) {
+    heartbeat();
+  }
   for (int i = 2; i < 9; ++i) {
     if (PIN_TYPE[i] == PIN_TYPE_UNUSED) {
       continue;
@@ -114,11 +260,7 @@ void loop() {
       if (DEBOUNCE_LAST_CHANGED[i] != 0) {
         if ((current_millis - DEBOUNCE_LAST_CHANGED[i]) >= DEBOUNCE_TIMEOUT[i]) {
           DEBOUNCE_LAST_CHANGED[i] = 0;
-          Serial.print("{\"Which\":\"");
-          Serial.print(PIN_ID[i]);
-          Serial.print("\",\"Action\":");
-          Serial.print(reading);
-          Serial.println("}");
+          report(PIN_ID[i], reading);
         }
       }
       break;
@@ -139,9 +281,7 @@ void loop() {
       // state of the pin, and immediately report the TRIP event
       if ((reading == 0) && (PIN_STATE[i] == 1)) {
           PIN_STATE[i] = 0;
-          Serial.print("{\"Which\":\"");
-          Serial.print(PIN_ID[i]);
-          Serial.println("\",\"Action\": 0}");
+          report(PIN_ID[i], 0);
       }
       if (PIN_STATE[i] == 0) {
         if (reading == 0) {
@@ -153,9 +293,7 @@ void loop() {
           // it's not still ringing
           if (current_millis - DEBOUNCE_LAST_CHANGED[i] > DEBOUNCE_TIMEOUT[i]) {
             // Ringing is over; report a RESET and take us out of the TRIP state
-            Serial.print("{\"Which\":\"");
-            Serial.print(PIN_ID[i]);
-            Serial.println("\",\"Action\": 1}");
+            report(PIN_ID[i], 1);
             PIN_STATE[i] = 1;
             DEBOUNCE_LAST_CHANGED[i] = 0;
           }
@@ -168,6 +306,23 @@ void loop() {
       break;
     }
   }
+
+  for (int i = 0; i < NUM_ANALOG; ++i) {
+    if (ANALOG_ID[i] == ID_UNUSED) {
+      continue;
+    }
+    uint8_t state = classify(analogRead(A0 + i));
+    current_millis = millis();
+    if (state != LOOP_SETTLING[i]) {
+      LOOP_SETTLING[i] = state;
+      LOOP_CHANGED[i] = current_millis;
+      continue;
+    }
+    if (state != LOOP_REPORTED[i] && current_millis - LOOP_CHANGED[i] >= LOOP_DEBOUNCE_TIMEOUT) {
+      report_loop(ANALOG_ID[i], LOOP_REPORTED[i], state);
+      LOOP_REPORTED[i] = state;
+    }
+  }
 }
 
 extern "C" void __cxa_pure_virtual(void) {
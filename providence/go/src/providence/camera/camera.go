@@ -26,6 +26,7 @@ import (
 
   "providence/common"
   "providence/config"
+  "providence/db"
   "providence/log"
   "providence/types"
 )
@@ -75,6 +76,7 @@ func startPhotoPurger() {
           }
         }
         log.Status("camera.purger", "removed "+strconv.Itoa(count)+" images")
+        db.PurgePhotos(cutoff)
 
         imageDir.Close()
       }
@@ -106,7 +108,9 @@ func captureImage(url string, ids []string) {
   r := time.Now().UnixNano()
 
   for _, id := range ids {
-    fname := filepath.Join(config.Photo.Directory, id+"-"+time.Now().Format("20060102150405.00")+".jpg")
+    taken := time.Now()
+    name := id + "-" + taken.Format("20060102150405.00") + ".jpg"
+    fname := filepath.Join(config.Photo.Directory, name)
     file, err := os.Create(fname)
     if err != nil {
       log.Warn("camera.capture", "failed writing image contents for "+id)
@@ -114,8 +118,19 @@ func captureImage(url string, ids []string) {
       log.Warn("camera.capture", "reason was ", err)
       return
     }
-    defer file.Close()
-    file.Write(body)
+    _, err = file.Write(body)
+    if cerr := file.Close(); err == nil {
+      err = cerr
+    }
+    if err != nil {
+      // don't leave a truncated image lying around, or record it as a photo
+      os.Remove(fname)
+      log.Warn("camera.capture", "failed writing image contents for "+id)
+      log.Warn("camera.capture", "url was "+url)
+      log.Warn("camera.capture", "reason was ", err)
+      return
+    }
+    db.AddPhoto(db.Photo{EventID: id, Name: name, Taken: taken})
 
     log.Debug("camera.capture", "wrote photo for "+id+" HTTP time:"+strconv.FormatInt(r-s, 10))
   }
@@ -0,0 +1,307 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+/*
+ * Administrative subcommands, e.g. `providence -config=... adduser alice`.
+ * These run against the configured database and exit, instead of starting
+ * the server.
+ */
+
+import (
+  "bufio"
+  "flag"
+  "fmt"
+  "os"
+  "os/user"
+  "path/filepath"
+  "sort"
+  "strings"
+  "time"
+
+  "golang.org/x/term"
+
+  "providence/config"
+  "providence/db"
+  "providence/export"
+  "providence/server"
+)
+
+type command struct {
+  usage string
+  nargs int // minimum
+  run   func(args []string) error
+}
+
+var commands = map[string]command{
+  "adduser": {"adduser <username>", 1, func(args []string) error {
+    password, err := readPassword("Password for " + args[0] + ": ")
+    if err != nil {
+      return err
+    }
+    return db.AddUser(args[0], password)
+  }},
+  "passwd": {"passwd <username>", 1, func(args []string) error {
+    password, err := readPassword("New password for " + args[0] + ": ")
+    if err != nil {
+      return err
+    }
+    return db.SetPassword(args[0], password)
+  }},
+  "deluser": {"deluser <username>", 1, func(args []string) error {
+    return db.DeleteUser(args[0])
+  }},
+  "users": {"users", 0, func(args []string) error {
+    users, err := db.GetUsers()
+    for _, u := range users {
+      fmt.Println(u)
+    }
+    return err
+  }},
+  "setrole": {"setrole <username or email> <viewer|operator|admin|none>", 2, func(args []string) error {
+    role := args[1]
+    if role == "none" {
+      role = ""
+    } else if !config.ValidRole(role) {
+      return fmt.Errorf("unknown role '%s'", role)
+    }
+    return db.SetRole(args[0], role)
+  }},
+  "roles": {"roles", 0, func(args []string) error {
+    roles, err := db.GetRoles()
+    for user, role := range roles {
+      fmt.Printf("%-30s %s\n", user, role)
+    }
+    return err
+  }},
+  "mktoken": {"mktoken <username> <name> [view|arm|admin]...", 2, func(args []string) error {
+    scopes := args[2:]
+    if len(scopes) == 0 {
+      scopes = []string{server.PERM_VIEW}
+    }
+    if !server.ValidPermissions(scopes) {
+      return fmt.Errorf("unknown scope in %v", scopes)
+    }
+    token, err := db.CreateAPIToken(args[0], args[1], scopes)
+    if err != nil {
+      return err
+    }
+    fmt.Println(token)
+    return nil
+  }},
+  "tokens": {"tokens", 0, func(args []string) error {
+    tokens, err := db.GetAPITokens()
+    for _, t := range tokens {
+      used := "never"
+      if t.LastUsed != nil {
+        used = t.LastUsed.Format("2006-01-02 15:04")
+      }
+      fmt.Printf("%s  %-12s %-20s %-12s last used %s\n", t.ID, t.Username, t.Name, strings.Join(t.Scopes, ","), used)
+    }
+    return err
+  }},
+  "rmtoken": {"rmtoken <token ID>", 1, func(args []string) error {
+    return db.RevokeAPIToken(args[0])
+  }},
+  "audit": {"audit [principal] [action prefix]", 0, func(args []string) error {
+    filter := db.AuditFilter{}
+    if len(args) > 0 {
+      filter.Principal = args[0]
+    }
+    if len(args) > 1 {
+      filter.Action = args[1]
+    }
+    entries, err := db.QueryAudit(filter)
+    for i := len(entries) - 1; i >= 0; i-- {
+      e := entries[i]
+      fmt.Printf("%s  %-24s %-15s %-14s %-8s %s %s\n", e.Timestamp.Format("2006-01-02 15:04:05"),
+        e.Principal, e.SourceIP, e.Action, e.Outcome, e.Target, e.Detail)
+    }
+    return err
+  }},
+  "export": {"export [-format csv|jsonl|ical] [-since T] [-until T] [-sensor a,b] [-zone Z] [-anomalous] [-photos] [-out file]", 0, runExport},
+  "import": {"import [-format csv|jsonl] <file>", 1, runImport},
+  "backup": {"backup", 0, func(args []string) error {
+    path, err := db.Backup()
+    if err == nil {
+      fmt.Println(path)
+    }
+    return err
+  }},
+  "restore": {"restore [backup file]", 0, func(args []string) error {
+    file := ""
+    if len(args) > 0 {
+      file = args[0]
+    }
+    path, err := db.RestoreBackup(file)
+    if err == nil {
+      fmt.Println("staged " + path + "; it will replace the database when the server next starts")
+    }
+    return err
+  }},
+}
+
+/* Commands that change state, and the audit log action each is recorded as. */
+var auditedCommands = map[string]string{
+  "adduser": "user.add",
+  "passwd":  "user.passwd",
+  "deluser": "user.delete",
+  "setrole": "user.role",
+  "mktoken": "token.create",
+  "rmtoken": "token.revoke",
+  "import":  "events.import",
+  "backup":  "db.backup",
+  "restore": "db.restore.stage", // the server records db.restore once applied
+}
+
+/* Writes the event history matching the flags to a file, or stdout. Times
+ * are RFC 3339. */
+func runExport(args []string) error {
+  flags := flag.NewFlagSet("export", flag.ContinueOnError)
+  format := flags.String("format", export.FORMAT_CSV, "csv, jsonl or ical")
+  since := flags.String("since", "", "earliest event time")
+  until := flags.String("until", "", "latest event time")
+  sensors := flags.String("sensor", "", "comma-separated sensor IDs")
+  zone := flags.String("zone", "", "zone name")
+  anomalous := flags.Bool("anomalous", false, "only anomalous events")
+  photos := flags.Bool("photos", false, "include photo references")
+  outFile := flags.String("out", "", "output file; default stdout")
+  if err := flags.Parse(args); err != nil {
+    return err
+  }
+
+  filter := db.EventFilter{Zone: *zone}
+  if *sensors != "" {
+    filter.SensorIDs = strings.Split(*sensors, ",")
+  }
+  var err error
+  if *since != "" {
+    if filter.Since, err = time.Parse(time.RFC3339, *since); err != nil {
+      return err
+    }
+  }
+  if *until != "" {
+    if filter.Until, err = time.Parse(time.RFC3339, *until); err != nil {
+      return err
+    }
+  }
+  if *anomalous {
+    filter.Anomalous = anomalous
+  }
+
+  out := os.Stdout
+  if *outFile != "" {
+    if out, err = os.Create(*outFile); err != nil {
+      return err
+    }
+    defer out.Close()
+  }
+  n, err := export.Write(out, *format, filter, *photos)
+  fmt.Fprintf(os.Stderr, "exported %d events\n", n)
+  return err
+}
+
+/* Loads events from a file written by export, merging any that are already
+ * present. The format defaults to the file's extension. */
+func runImport(args []string) error {
+  flags := flag.NewFlagSet("import", flag.ContinueOnError)
+  format := flags.String("format", "", "csv or jsonl")
+  if err := flags.Parse(args); err != nil {
+    return err
+  }
+  if flags.NArg() != 1 {
+    return fmt.Errorf("expected one file, got %d", flags.NArg())
+  }
+  name := flags.Arg(0)
+  if *format == "" {
+    *format = strings.TrimPrefix(filepath.Ext(name), ".")
+  }
+  in, err := os.Open(name)
+  if err != nil {
+    return err
+  }
+  defer in.Close()
+  added, merged, err := export.Read(in, *format)
+  fmt.Fprintf(os.Stderr, "imported %d new events, merged %d\n", added, merged)
+  return err
+}
+
+/* Identifies whoever is running a command, for the audit log. */
+func cliPrincipal() string {
+  if u, err := user.Current(); err == nil {
+    return "cli:" + u.Username
+  }
+  return "cli"
+}
+
+/* Prompts for a password, without echoing it if stdin is a terminal. */
+func readPassword(prompt string) (string, error) {
+  fd := int(os.Stdin.Fd())
+  if term.IsTerminal(fd) {
+    fmt.Print(prompt)
+    password, err := term.ReadPassword(fd)
+    fmt.Println()
+    return string(password), err
+  }
+  line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+  return strings.TrimRight(line, "\r\n"), err
+}
+
+func usage() {
+  names := make([]string, 0, len(commands))
+  for name := range commands {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  fmt.Fprintln(os.Stderr, "commands:")
+  for _, name := range names {
+    fmt.Fprintln(os.Stderr, "  "+commands[name].usage)
+  }
+}
+
+/* Runs the subcommand named by args[0], and returns the process exit code. */
+func runCommand(args []string) int {
+  cmd, ok := commands[args[0]]
+  if !ok {
+    fmt.Fprintln(os.Stderr, "unknown command '"+args[0]+"'")
+    usage()
+    return 2
+  }
+  if len(args)-1 < cmd.nargs {
+    fmt.Fprintln(os.Stderr, "usage: "+cmd.usage)
+    return 2
+  }
+  err := cmd.run(args[1:])
+  if action, ok := auditedCommands[args[0]]; ok {
+    entry := db.AuditEntry{
+      Principal: cliPrincipal(),
+      Action:    action,
+      Target:    strings.Join(args[1:], " "),
+      SourceIP:  "local",
+      Outcome:   db.AUDIT_OK,
+    }
+    if err != nil {
+      entry.Outcome = db.AUDIT_FAILED
+      entry.Detail = err.Error()
+    }
+    db.Audit(entry)
+  }
+  if err != nil {
+    fmt.Fprintln(os.Stderr, args[0]+": "+err.Error())
+    return 1
+  }
+  return 0
+}
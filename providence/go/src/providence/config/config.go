@@ -41,9 +41,15 @@ import (
   "providence/types"
 )
 
+/* DatabasePath is the local SQLite database, which is always used. Events,
+ * registration IDs and photo metadata go there too unless StoreDriver is
+ * "postgres", in which case they go to the PostgreSQL database at StoreURL,
+ * which several monitors may share. */
 type GeneralConfig struct {
   Debug        bool
   DatabasePath string
+  StoreDriver  string
+  StoreURL     string
   LogFile      string
   QRGenURL     string
 }
@@ -51,10 +57,16 @@ type GeneralConfig struct {
 var General = GeneralConfig{
   Debug:        false,
   DatabasePath: "./providence.sqlite3",
+  StoreDriver:  "sqlite3",
+  StoreURL:     "",
   LogFile:      "./providence.log",
   QRGenURL:     "http://qrfree.kaywa.com/?l=1&s=8&d=",
 }
 
+/* Set by the -migrate-dry-run flag; the db package checks pending schema
+ * migrations and exits instead of applying them. */
+var DryRunMigrations = false
+
 type ServerConfig struct {
   Port              int
   URLRoot           string
@@ -73,12 +85,104 @@ var Server = ServerConfig{
   ClientBKSPassword: "password",
 }
 
+/* The fields of a Google service account key file that we need in order to
+ * mint OAuth2 access tokens for FCM. */
+type ServiceAccount struct {
+  ProjectID    string `json:"project_id"`
+  PrivateKeyID string `json:"private_key_id"`
+  PrivateKey   string `json:"private_key"`
+  ClientEmail  string `json:"client_email"`
+  TokenURI     string `json:"token_uri"`
+}
+
+/* FCMBaseURL and TokenURL can be pointed at a local fake for testing; an
+ * empty TokenURL means use the token_uri from the service account file.
+ * Failed sends are retried with exponential backoff starting at RetryBase
+ * and capped at RetryMax, up to MaxAttempts tries in total. */
 type GCMConfig struct {
-  OAuthToken string
+  ServiceAccountFile string
+  FCMBaseURL         string
+  TokenURL           string
+  MaxAttempts        int
+  RetryBase          time.Duration  // seconds
+  RetryMax           time.Duration  // seconds
+  Account            ServiceAccount `json:"-"`
 }
 
 var GCM = GCMConfig{
-  OAuthToken: "",
+  ServiceAccountFile: "./service-account.json",
+  FCMBaseURL:         "https://fcm.googleapis.com",
+  TokenURL:           "",
+  MaxAttempts:        12,
+  RetryBase:          5,
+  RetryMax:           3600,
+}
+
+/* Notification backends in addition to GCM. Name identifies a backend in
+ * logs. Push Kind is one of "ntfy" or "gotify"; for ntfy, Topic is appended
+ * to URL and Token (if any) is sent as a bearer token, while for gotify,
+ * Token is the application token.
+ *
+ * Event notifications arriving within CoalesceWindow seconds of the first
+ * are sent as one summary. At most SensorRateLimit notifications per sensor,
+ * and GlobalRateLimit overall, are sent per RateLimitPeriod seconds; the
+ * rest are counted and reported at the end of the period. Zero disables. */
+type WebhookConfig struct {
+  Name    string
+  URL     string
+  Headers map[string]string
+}
+type EmailConfig struct {
+  Name     string
+  Host     string
+  Port     int
+  Username string
+  Password string
+  From     string
+  To       []string
+}
+type PushConfig struct {
+  Name     string
+  Kind     string
+  URL      string
+  Topic    string
+  Token    string
+  Priority int
+}
+type NotifyConfig struct {
+  Webhooks        []WebhookConfig
+  Email           []EmailConfig
+  Push            []PushConfig
+  CoalesceWindow  time.Duration // seconds
+  RateLimitPeriod time.Duration // seconds
+  SensorRateLimit int
+  GlobalRateLimit int
+}
+
+var Notify = NotifyConfig{
+  Webhooks:        make([]WebhookConfig, 0),
+  Email:           make([]EmailConfig, 0),
+  Push:            make([]PushConfig, 0),
+  CoalesceWindow:  0,
+  RateLimitPeriod: 600,
+  SensorRateLimit: 0,
+  GlobalRateLimit: 0,
+}
+
+/* Escalation chain for alerts. Each tier names the notifiers (by Name, or
+ * "gcm") to use once an alert has gone unacknowledged for After seconds;
+ * the first tier usually has an After of 0. With no tiers configured, every
+ * notifier is used immediately. */
+type EscalationTierConfig struct {
+  After     time.Duration // seconds
+  Notifiers []string
+}
+type EscalationConfig struct {
+  Tiers []EscalationTierConfig
+}
+
+var Escalation = EscalationConfig{
+  Tiers: make([]EscalationTierConfig, 0),
 }
 
 type ExclusionIntervalConfig struct {
@@ -86,11 +190,83 @@ type ExclusionIntervalConfig struct {
   Duration   string
   DaysOfWeek []time.Weekday // int, 0 - 6, 0 = Sunday
 }
+
+/* How a sensor is wired to a GPIO character device, for Mode "GPIOD".
+ * - Chip: the device, e.g. "/dev/gpiochip0" or just "gpiochip0"
+ * - Line: the line's offset on the chip
+ * - Bias: "pull-up", "pull-down", "disabled", or "" to leave it as is
+ * - ActiveLow: the sensor is tripped when the line is low rather than high
+ * - Debounce: filters edges shorter than this, in hardware where the chip
+ *   supports it; 0 uses a default suited to the sensor's modality
+ * - TamperLine, TamperActiveLow: an optional second line on the same chip,
+ *   wired to the sensor's tamper switch; it's active while tampered with
+ */
+type GPIODLineConfig struct {
+  Chip      string
+  Line      uint32
+  Bias      string
+  ActiveLow bool
+  Debounce  time.Duration // milliseconds
+
+  TamperLine      *uint32
+  TamperActiveLow bool
+}
+
+const (
+  BIAS_PULL_UP   = "pull-up"
+  BIAS_PULL_DOWN = "pull-down"
+  BIAS_DISABLED  = "disabled"
+)
+
+/* A source of sensor events, run alongside any others.
+ * - Name: identifies the source in logs; defaults to Mode
+ * - Mode: "GPIO" (sysfs), "GPIOD", "TTY" or "Mock"
+ * - Sensors: IDs of the sensors this source reports; no two sources may
+ *   claim the same sensor
+ * - TTYPath: the serial device, for "TTY"
+ * - Baud: the serial device's speed, for "TTY"; 9600 if unset
+ * - Unframed: for "TTY", also accept the bare JSON lines sent by Arduino
+ *   firmware from before messages were framed. Such firmware must otherwise
+ *   be reflashed, since its messages are all discarded as garbage. Bare
+ *   lines carry no checksum, so line noise can pass for a message
+ * - HeartbeatTimeout: for "TTY", how long the hub may go without a heartbeat
+ *   (or a supervised sensor without being reported) before it is considered
+ *   offline; for "GPIO" and "GPIOD", how long a sensor's line may be
+ *   unreadable. In seconds; 30 if unset
+ * - Lines: maps each of the source's sensor IDs to its GPIO line, for "GPIOD"
+ */
+type SensorSourceConfig struct {
+  Name     string
+  Mode     string
+  Sensors  []string
+  TTYPath  string
+  Baud     int
+  Unframed bool
+  Lines    map[string]GPIODLineConfig
+
+  HeartbeatTimeout time.Duration // seconds
+}
+
+const (
+  SOURCE_GPIO  = "GPIO"
+  SOURCE_GPIOD = "GPIOD"
+  SOURCE_TTY   = "TTY"
+  SOURCE_MOCK  = "Mock"
+)
+
+/* Sources lists the sensor sources to run. If it's empty, Mode, TTYPath and
+ * Lines instead describe a single source reporting every sensor, as in
+ * configs from before there could be more than one. */
 type SensorConfig struct {
   Mode               string
   MockTTY            bool
   TTYPath            string
-  AjarThreshold      time.Duration
+  Lines              map[string]GPIODLineConfig
+  Sources            []SensorSourceConfig
+  AjarThreshold      time.Duration // seconds
+  ResendFrequency    time.Duration // seconds
+  EntryDelay         time.Duration // seconds
+  ExitDelay          time.Duration // seconds
   ExclusionIntervals []ExclusionIntervalConfig
 }
 
@@ -98,12 +274,53 @@ var Sensor = SensorConfig{
   Mode:               "TTY",
   MockTTY:            false,
   TTYPath:            "/dev/ttyUSB0",
-  AjarThreshold:      30 * time.Second,
+  Lines:              make(map[string]GPIODLineConfig),
+  Sources:            make([]SensorSourceConfig, 0),
+  AjarThreshold:      30,
+  ResendFrequency:    60,
+  EntryDelay:         0,
+  ExitDelay:          0,
   ExclusionIntervals: make([]ExclusionIntervalConfig, 0),
 }
 
 var Sensors = types.Sensors
 
+/* Policy settings that can be attached to a zone (by name) or to an
+ * individual sensor (by ID), overriding the global values in Sensor. Zero
+ * values and a missing ExclusionIntervals list inherit from the next less
+ * specific level, i.e. sensor, then zone, then global. An empty (but
+ * present) ExclusionIntervals list means "no exclusions" for that level.
+ *
+ * EntryDelay is how long a trip while armed stays pending before it is
+ * flagged anomalous, giving the user time to disarm; ExitDelay is how long
+ * after arming that trips are ignored, giving the user time to leave. */
+type PolicyRuleConfig struct {
+  AjarThreshold      time.Duration // seconds
+  ResendFrequency    time.Duration // seconds
+  EntryDelay         time.Duration // seconds
+  ExitDelay          time.Duration // seconds
+  ExclusionIntervals []ExclusionIntervalConfig
+}
+
+// Keyed by zone name, as set in types.Sensor.Zone.
+var Zones = make(map[string]PolicyRuleConfig)
+
+// Keyed by sensor ID.
+var Rules = make(map[string]PolicyRuleConfig)
+
+/* Lists the sensor IDs or zone names that are armed in the partial modes.
+ * In Away mode every sensor is armed, and in Disarmed mode the exclusion
+ * intervals apply as usual. */
+type ModeConfig struct {
+  Home  []string
+  Night []string
+}
+
+var Mode = ModeConfig{
+  Home:  make([]string, 0),
+  Night: make([]string, 0),
+}
+
 type CameraSpecConfig struct {
   Url      string
   Interval int
@@ -121,18 +338,172 @@ var Photo = PhotoConfig{
   CameraSpec: make(map[string][]CameraSpecConfig),
 }
 
+/* How long to keep events, as Go durations; "", the default, keeps them
+ * forever, so nothing is purged unless configured. AnomalousEvents applies
+ * to all security events: anomalous ones, and sensors going offline or
+ * being tampered with. Purged events are first appended to a gzipped JSONL
+ * file in ArchiveDirectory, if set. The local database is vacuumed every
+ * VacuumInterval, to give freed space back to the filesystem; "" never
+ * vacuums. */
+type RetentionConfig struct {
+  MundaneEvents    string
+  AnomalousEvents  string
+  ArchiveDirectory string
+  VacuumInterval   string
+}
+
+var Retention = RetentionConfig{
+  MundaneEvents:    "",
+  AnomalousEvents:  "",
+  ArchiveDirectory: "",
+  VacuumInterval:   "168h",
+}
+
+/* Online backups of the local database, taken every Interval (a Go
+ * duration) into Directory, keeping the newest Keep of them. Backups are
+ * disabled if Directory is "". A PostgreSQL store is not included; back that
+ * up with the usual PostgreSQL tools. */
+type BackupConfig struct {
+  Directory string
+  Interval  string
+  Keep      int
+}
+
+var Backup = BackupConfig{
+  Directory: "",
+  Interval:  "24h",
+  Keep:      7,
+}
+
+/* An OpenID Connect identity provider whose ID tokens we accept.
+ * - Issuer: must match the token's 'iss' claim; also locates the discovery
+ *   document, unless DiscoveryURL is set
+ * - IssuerAliases: other values of 'iss' to accept, for providers that
+ *   don't always spell their issuer the same way
+ * - JWKSURL: overrides the discovery document's jwks_uri, e.g. for a local
+ *   stand-in key set
+ * - Audience: must appear in the token's 'aud' claim
+ * - RequiredClaims: additional claims that must have exactly these values
+ * - UserClaim: the claim that names the user; "email" if unset, in which
+ *   case tokens are rejected unless 'email_verified' is true
+ * - AllowedUsers: users let in regardless of groups; their role comes from
+ *   UserAuth.Roles or the database, as for local users
+ * - GroupsClaim, GroupRoles: grants roles to users by membership in the
+ *   groups listed in that claim; the most powerful one wins, unless the user
+ *   has a role set in the database
+ * Users who are neither allowed outright nor granted a role via groups are
+ * rejected. */
+type OIDCConfig struct {
+  Issuer         string
+  IssuerAliases  []string
+  DiscoveryURL   string
+  JWKSURL        string
+  Audience       string
+  RequiredClaims map[string]string
+  UserClaim      string
+  AllowedUsers   []string
+  GroupsClaim    string
+  GroupRoles     map[string]string
+}
+
+/* Roles, from least to most powerful. Viewers may look at sensor state,
+ * events and photos; operators may also arm, disarm and acknowledge alerts;
+ * admins may also manage devices and the notification queue. */
+const (
+  ROLE_VIEWER   = "viewer"
+  ROLE_OPERATOR = "operator"
+  ROLE_ADMIN    = "admin"
+)
+
+var roleRanks = map[string]int{ROLE_VIEWER: 1, ROLE_OPERATOR: 2, ROLE_ADMIN: 3}
+
+func ValidRole(role string) bool {
+  _, ok := roleRanks[role]
+  return ok
+}
+
+/* Returns whichever of the two roles is more powerful. */
+func HigherRole(a, b string) string {
+  if roleRanks[b] > roleRanks[a] {
+    return b
+  }
+  return a
+}
+
+/* Providers lists the ways users may authenticate: "google" for Google
+ * sign-in JWTs, "oidc" for ID tokens from the providers in OIDC, and "local"
+ * for accounts stored in the database, which work without any network
+ * access. The "google" provider is shorthand for an OIDC provider built from
+ * the OAuth* and GoogleAccountWhitelist settings.
+ *
+ * Roles assigns roles to users by email or local username. Roles set in the
+ * database (see the setrole command) take precedence over both these and
+ * OIDC group roles. Users with no role assigned anywhere get DefaultRole,
+ * which is viewer unless set; set it to admin to trust everyone who can sign
+ * in, as before roles existed. */
 type UserAuthConfig struct {
+  Providers              []string
   OAuthAudience          string
   OAuthClientID          string
-  GoogleOAuthCertsURL    string
   GoogleAccountWhitelist []string
+  OIDC                   []OIDCConfig
+  KeyRefreshInterval     time.Duration // seconds
+  Roles                  map[string]string
+  DefaultRole            string
+  SessionCookie          string
+  SessionLifetime        time.Duration // seconds
 }
 
 var UserAuth = UserAuthConfig{
+  Providers:              []string{AUTH_GOOGLE},
   OAuthAudience:          "",
   OAuthClientID:          "",
-  GoogleOAuthCertsURL:    "https://www.googleapis.com/oauth2/v1/certs",
   GoogleAccountWhitelist: make([]string, 0),
+  OIDC:                   make([]OIDCConfig, 0),
+  KeyRefreshInterval:     60 * 60,
+  Roles:                  make(map[string]string),
+  DefaultRole:            ROLE_VIEWER,
+  SessionCookie:          "providence_session",
+  SessionLifetime:        30 * 24 * 60 * 60,
+}
+
+const (
+  AUTH_GOOGLE = "google"
+  AUTH_OIDC   = "oidc"
+  AUTH_LOCAL  = "local"
+
+  // Google's ID tokens name their issuer either way
+  GOOGLE_ISSUER       = "https://accounts.google.com"
+  GOOGLE_ISSUER_ALIAS = "accounts.google.com"
+)
+
+/* Returns the OIDC providers in effect, including Google's if enabled. */
+func OIDCProviders() []OIDCConfig {
+  providers := make([]OIDCConfig, 0)
+  if AuthEnabled(AUTH_GOOGLE) {
+    providers = append(providers, OIDCConfig{
+      Issuer:         GOOGLE_ISSUER,
+      IssuerAliases:  []string{GOOGLE_ISSUER_ALIAS},
+      Audience:       UserAuth.OAuthAudience,
+      RequiredClaims: map[string]string{"azp": UserAuth.OAuthClientID},
+      UserClaim:      "email",
+      AllowedUsers:   UserAuth.GoogleAccountWhitelist,
+    })
+  }
+  if AuthEnabled(AUTH_OIDC) {
+    providers = append(providers, UserAuth.OIDC...)
+  }
+  return providers
+}
+
+/* Indicates whether the named auth provider is enabled. */
+func AuthEnabled(provider string) bool {
+  for _, p := range UserAuth.Providers {
+    if p == provider {
+      return true
+    }
+  }
+  return false
 }
 
 type PathType int
@@ -143,30 +514,68 @@ const (
   PATH_RECENT
   PATH_PHOTO_LIST
   PATH_PHOTO
+  PATH_MODE
+  PATH_EVENTS
+  PATH_STREAM
+  PATH_SENSORS
+  PATH_DASHBOARD
+  PATH_LOGIN
+  PATH_LOGOUT
+  PATH_AUDIT
+  PATH_EXPORT
 )
 
 type URLPathConfig struct {
-  RegID      string
-  Heartbeat  string
-  Recent     string
-  PhotoList  string
-  PhotoFetch string
-  QRConfig   string
+  RegID       string
+  Heartbeat   string
+  Recent      string
+  PhotoList   string
+  PhotoFetch  string
+  QRConfig    string
+  Mode        string
+  DeadLetters string
+  Ack         string
+  Events      string
+  Stream      string
+  Sensors     string
+  Dashboard   string
+  Login       string
+  Logout      string
+  Audit       string
+  Export      string
 }
 
 var URLPath = URLPathConfig{
-  Heartbeat:  "/heartbeat",
-  PhotoFetch: "/photo/",
-  PhotoList:  "/photos/",
-  QRConfig:   "/qrconfig",
-  Recent:     "/recent",
-  RegID:      "/regid",
+  Ack:         "/ack/",
+  Audit:       "/audit",
+  Dashboard:   "/dashboard",
+  DeadLetters: "/deadletters",
+  Events:      "/events",
+  Export:      "/export",
+  Heartbeat:   "/heartbeat",
+  Login:       "/login",
+  Logout:      "/logout",
+  Mode:        "/mode",
+  PhotoFetch:  "/photo/",
+  PhotoList:   "/photos/",
+  QRConfig:    "/qrconfig",
+  Recent:      "/recent",
+  RegID:       "/regid",
+  Sensors:     "/sensors",
+  Stream:      "/stream",
 }
 
 func init() {
+  // test binaries have flags of their own and no config file; their tests
+  // get the defaults above, and set whatever else they need
+  if strings.HasSuffix(os.Args[0], ".test") {
+    return
+  }
+
   // locate a config file
   var configFile string
   flag.StringVar(&configFile, "config", "./config.json", "fully qualified path to the JSON config file")
+  flag.BoolVar(&DryRunMigrations, "migrate-dry-run", false, "check pending database migrations, then exit without applying them")
   flag.Parse()
 
   // load the contents of that config file
@@ -181,28 +590,42 @@ func init() {
 
   // parse the JSON config contents into memory
   type jsonConfig struct {
-    General  *GeneralConfig
-    Server   *ServerConfig
-    GCM      *GCMConfig
-    Sensor   *SensorConfig
-    Sensors  map[string]types.Sensor
-    Photo    *PhotoConfig
-    UserAuth *UserAuthConfig
-    URLPath  *URLPathConfig
+    General    *GeneralConfig
+    Server     *ServerConfig
+    GCM        *GCMConfig
+    Notify     *NotifyConfig
+    Escalation *EscalationConfig
+    Sensor     *SensorConfig
+    Sensors    map[string]types.Sensor
+    Zones      *map[string]PolicyRuleConfig
+    Rules      *map[string]PolicyRuleConfig
+    Mode       *ModeConfig
+    Photo      *PhotoConfig
+    Retention  *RetentionConfig
+    Backup     *BackupConfig
+    UserAuth   *UserAuthConfig
+    URLPath    *URLPathConfig
   }
   // this block assigns the top-level package objects as the destination of
   // the JSON parse operation. Since these instances are populated with
   // defaults above, JSON will overwrite the defaults if and only if present
   // in the file.
   jsonTarget := jsonConfig{
-    General:  &General,
-    Server:   &Server,
-    GCM:      &GCM,
-    Sensor:   &Sensor,
-    Sensors:  &Sensors,
-    Photo:    &Photo,
-    UserAuth: &UserAuth,
-    URLPath:  &URLPath,
+    General:    &General,
+    Server:     &Server,
+    GCM:        &GCM,
+    Notify:     &Notify,
+    Escalation: &Escalation,
+    Sensor:     &Sensor,
+    Sensors:    &Sensors,
+    Zones:      &Zones,
+    Rules:      &Rules,
+    Mode:       &Mode,
+    Photo:      &Photo,
+    Retention:  &Retention,
+    Backup:     &Backup,
+    UserAuth:   &UserAuth,
+    URLPath:    &URLPath,
   }
   err = json.Unmarshal([]byte(jsonText), &jsonTarget)
   if err != nil {
@@ -221,6 +644,19 @@ func init() {
     log.Fatal("loading config failed on unmarshal ", err)
   }
 
+  // load the FCM service account key; a missing file just means no push
+  // notifications, since other notifiers may be configured
+  if saText, err := ioutil.ReadFile(GCM.ServiceAccountFile); err == nil {
+    if err = json.Unmarshal(saText, &GCM.Account); err != nil {
+      log.Fatal("failed parsing service account file '"+GCM.ServiceAccountFile+"'", err)
+    }
+    if GCM.TokenURL != "" {
+      GCM.Account.TokenURI = GCM.TokenURL
+    }
+  } else {
+    fmt.Println("No FCM service account at '" + GCM.ServiceAccountFile + "'; push notifications disabled.")
+  }
+
   // set up logging based on config
   if General.Debug {
     plog.SetLogLevel(plog.LEVEL_DEBUG)
@@ -229,6 +665,85 @@ func init() {
     plog.SetLogFile(General.LogFile)
   }
 
+  for _, d := range []string{Retention.MundaneEvents, Retention.AnomalousEvents, Retention.VacuumInterval} {
+    if _, err := time.ParseDuration(d); d != "" && err != nil {
+      log.Fatal("bogus retention duration '"+d+"'", err)
+    }
+  }
+
+  if d, err := time.ParseDuration(Backup.Interval); Backup.Directory != "" && (err != nil || d <= 0) {
+    log.Fatal("bogus backup interval '"+Backup.Interval+"'", err)
+  }
+  if Backup.Keep < 1 {
+    log.Fatal("Backup.Keep must be at least 1")
+  }
+
+  if General.StoreDriver != "sqlite3" && General.StoreDriver != "postgres" {
+    log.Fatal("unknown StoreDriver '" + General.StoreDriver + "'")
+  }
+  if General.StoreDriver == "postgres" && General.StoreURL == "" {
+    log.Fatal("postgres StoreDriver requires a StoreURL")
+  }
+
+  for _, p := range UserAuth.Providers {
+    if p != AUTH_GOOGLE && p != AUTH_OIDC && p != AUTH_LOCAL {
+      log.Fatal("unknown auth provider '" + p + "'")
+    }
+  }
+  if len(UserAuth.Providers) == 0 {
+    log.Fatal("no auth providers configured")
+  }
+  if AuthEnabled(AUTH_OIDC) && len(UserAuth.OIDC) == 0 {
+    log.Fatal("oidc auth enabled, but no OIDC providers configured")
+  }
+  for i := range UserAuth.OIDC {
+    p := &UserAuth.OIDC[i]
+    if p.Issuer == "" || p.Audience == "" {
+      log.Fatal("OIDC providers require an Issuer and Audience")
+    }
+    if p.UserClaim == "" {
+      p.UserClaim = "email"
+    }
+    for group, role := range p.GroupRoles {
+      if !ValidRole(role) {
+        log.Fatal("unknown role '" + role + "' for group '" + group + "'")
+      }
+    }
+  }
+  for user, role := range UserAuth.Roles {
+    if !ValidRole(role) {
+      log.Fatal("unknown role '" + role + "' for user '" + user + "'")
+    }
+  }
+  if !ValidRole(UserAuth.DefaultRole) {
+    log.Fatal("unknown DefaultRole '" + UserAuth.DefaultRole + "'")
+  }
+
+  // policy rules must refer to real sensors & zones, or they'd silently
+  // never apply
+  for id := range Rules {
+    if _, ok := Sensors[id]; !ok {
+      log.Fatal("policy rule configured for unknown sensor '" + id + "'")
+    }
+  }
+  for id, sensor := range Sensors {
+    if sensor.Zone == "" {
+      continue
+    }
+    if _, ok := Zones[sensor.Zone]; !ok {
+      plog.Debug("config.init", "sensor '"+id+"' is in zone '"+sensor.Zone+"' which has no policy rules")
+    }
+  }
+
+  if len(Sensor.Sources) == 0 {
+    legacy := SensorSourceConfig{Mode: Sensor.Mode, TTYPath: Sensor.TTYPath, Lines: Sensor.Lines}
+    for id := range Sensors {
+      legacy.Sensors = append(legacy.Sensors, id)
+    }
+    Sensor.Sources = append(Sensor.Sources, legacy)
+  }
+  validateSources()
+
   common.SensorState = make(map[string]types.Sensor)
   cnt := 0
   for id, name := range Sensor.Names {
@@ -244,6 +759,96 @@ func init() {
   }
 }
 
+/* Checks that every sensor source is usable, and that each sensor is
+ * reported by exactly one of them. */
+func validateSources() {
+  owners := make(map[string]string)
+  names := make(map[string]bool)
+  mocks := 0
+  for i := range Sensor.Sources {
+    src := &Sensor.Sources[i]
+    if src.Name == "" {
+      src.Name = src.Mode
+    }
+    if names[src.Name] {
+      log.Fatal("more than one sensor source is named '" + src.Name + "'")
+    }
+    names[src.Name] = true
+    if src.HeartbeatTimeout == 0 {
+      src.HeartbeatTimeout = 30
+    }
+    switch src.Mode {
+    case SOURCE_GPIO, SOURCE_GPIOD:
+    case SOURCE_TTY:
+      if src.TTYPath == "" {
+        log.Fatal("no TTYPath configured for sensor source '" + src.Name + "'")
+      }
+      if src.Baud == 0 {
+        src.Baud = 9600
+      }
+      switch src.Baud {
+      case 1200, 2400, 4800, 9600, 19200, 38400, 57600, 115200:
+      default:
+        log.Fatal("unsupported baud rate " + strconv.Itoa(src.Baud) + " for sensor source '" + src.Name + "'")
+      }
+    case SOURCE_MOCK:
+      // each listens on the same port, so there can only be one
+      if mocks++; mocks > 1 {
+        log.Fatal("only one Mock sensor source may be configured")
+      }
+    default:
+      log.Fatal("unknown mode '" + src.Mode + "' for sensor source '" + src.Name + "'")
+    }
+
+    for _, id := range src.Sensors {
+      if _, ok := Sensors[id]; !ok {
+        log.Fatal("sensor source '" + src.Name + "' claims unknown sensor '" + id + "'")
+      }
+      if owner, ok := owners[id]; ok {
+        log.Fatal("sensor '" + id + "' is claimed by both '" + owner + "' and '" + src.Name + "'")
+      }
+      owners[id] = src.Name
+    }
+
+    // only a hub with analog inputs can tell a cut or shorted loop from
+    // an open or closed one
+    for _, id := range src.Sensors {
+      if Sensors[id].Modality == types.SUPERVISED && src.Mode != SOURCE_TTY {
+        log.Fatal("supervised sensor '" + id + "' must be on a TTY source, not '" + src.Name + "'")
+      }
+    }
+
+    if src.Mode != SOURCE_GPIOD {
+      continue
+    }
+    for _, id := range src.Sensors {
+      if _, ok := src.Lines[id]; !ok {
+        log.Fatal("no GPIO line configured for sensor '" + id + "' in source '" + src.Name + "'")
+      }
+    }
+    for id, line := range src.Lines {
+      if owners[id] != src.Name {
+        log.Fatal("sensor source '" + src.Name + "' configures a GPIO line for sensor '" + id + "', which it doesn't claim")
+      }
+      if line.Chip == "" {
+        log.Fatal("no GPIO chip configured for sensor '" + id + "'")
+      }
+      if line.TamperLine != nil && *line.TamperLine == line.Line {
+        log.Fatal("sensor '" + id + "' uses the same GPIO line for its tamper switch")
+      }
+      if b := line.Bias; b != "" && b != BIAS_PULL_UP && b != BIAS_PULL_DOWN && b != BIAS_DISABLED {
+        log.Fatal("unknown bias '" + b + "' for sensor '" + id + "'")
+      }
+    }
+  }
+
+  for id := range Sensors {
+    if _, ok := owners[id]; !ok {
+      plog.Warn("config.init", "sensor '"+id+"' is not reported by any sensor source")
+    }
+  }
+}
+
 /* Returns the full URL (using URL/host as configured in config.json) for a
  * particular URL path */
 func GetURLFor(path PathType) string {
@@ -253,6 +858,15 @@ func GetURLFor(path PathType) string {
     PATH_RECENT:     URLPath.Recent,
     PATH_PHOTO_LIST: URLPath.PhotoList,
     PATH_PHOTO:      URLPath.PhotoFetch,
+    PATH_MODE:       URLPath.Mode,
+    PATH_EVENTS:     URLPath.Events,
+    PATH_STREAM:     URLPath.Stream,
+    PATH_SENSORS:    URLPath.Sensors,
+    PATH_DASHBOARD:  URLPath.Dashboard,
+    PATH_LOGIN:      URLPath.Login,
+    PATH_LOGOUT:     URLPath.Logout,
+    PATH_AUDIT:      URLPath.Audit,
+    PATH_EXPORT:     URLPath.Export,
   }[path]
   // make sure we don't end up with duplicate /-es in URLs
   left := strings.TrimRight(Server.URLRoot, "/")
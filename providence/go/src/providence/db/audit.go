@@ -0,0 +1,158 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package db
+
+/*
+ * Append-only record of who did what: every request anyone makes, other than
+ * the dashboard's routine polls, every login and logout, and every request
+ * refused. Triggers reject updates and deletes, so rows can only be removed
+ * by someone with direct access to the file.
+ */
+
+import (
+  "database/sql"
+  "strings"
+  "time"
+
+  "providence/log"
+)
+
+var auditTables = []string{
+  `CREATE TABLE IF NOT EXISTS Audit (
+      ID integer not null primary key autoincrement,
+      Timestamp datetime not null,
+      Principal text not null,
+      Action text not null,
+      Target text not null default '',
+      SourceIP text not null default '',
+      Outcome text not null,
+      Detail text not null default '');`,
+  `CREATE TRIGGER IF NOT EXISTS AuditNoUpdate BEFORE UPDATE ON Audit
+     BEGIN SELECT RAISE(ABORT, 'audit log is append-only'); END;`,
+  `CREATE TRIGGER IF NOT EXISTS AuditNoDelete BEFORE DELETE ON Audit
+     BEGIN SELECT RAISE(ABORT, 'audit log is append-only'); END;`,
+}
+
+const (
+  AUDIT_ALLOWED = "allowed"
+  AUDIT_DENIED  = "denied"
+  AUDIT_OK      = "ok"
+  AUDIT_FAILED  = "failed"
+
+  DEFAULT_AUDIT_LIMIT = 100
+  MAX_AUDIT_LIMIT     = 1000
+)
+
+var insertAudit *sql.Stmt
+
+/* One audited action. Principal is an email or local username, or "" if
+ * the caller couldn't be identified; Outcome is one of the AUDIT_ consts. */
+type AuditEntry struct {
+  ID        int64
+  Timestamp time.Time
+  Principal string
+  Action    string
+  Target    string
+  SourceIP  string
+  Outcome   string
+  Detail    string
+}
+
+/* Criteria for QueryAudit; zero values mean "don't filter on this". Action
+ * matches as a prefix, so e.g. "user." finds all account changes. */
+type AuditFilter struct {
+  Principal string
+  Action    string
+  Since     time.Time
+  Until     time.Time
+  Limit     int
+}
+
+func prepareAudit() {
+  var err error
+  insertAudit, err = db.Prepare(
+    `insert into Audit (Timestamp, Principal, Action, Target, SourceIP, Outcome, Detail)
+     values (?, ?, ?, ?, ?, ?, ?)`)
+  if err != nil {
+    log.Error("db.package_init", "audit failed to prepare insertAudit", err)
+  }
+}
+
+/* Appends an entry to the audit log. The timestamp is always the current
+ * time; any in the entry is ignored. */
+func Audit(entry AuditEntry) error {
+  _, err := insertAudit.Exec(time.Now(), entry.Principal, entry.Action, entry.Target,
+    entry.SourceIP, entry.Outcome, entry.Detail)
+  if err != nil {
+    log.Error("db.Audit", "failed to record "+entry.Action+" by "+entry.Principal, err)
+  }
+  return err
+}
+
+/* Returns audit entries matching the filter, newest first. */
+func QueryAudit(filter AuditFilter) ([]AuditEntry, error) {
+  entries := make([]AuditEntry, 0)
+  clauses := make([]string, 0)
+  args := make([]interface{}, 0)
+
+  if filter.Principal != "" {
+    clauses = append(clauses, "Principal = ?")
+    args = append(args, filter.Principal)
+  }
+  if filter.Action != "" {
+    clauses = append(clauses, "substr(Action, 1, ?) = ?")
+    args = append(args, len(filter.Action), filter.Action)
+  }
+  if !filter.Since.IsZero() {
+    clauses = append(clauses, "Timestamp >= ?")
+    args = append(args, localTime(filter.Since))
+  }
+  if !filter.Until.IsZero() {
+    clauses = append(clauses, "Timestamp < ?")
+    args = append(args, localTime(filter.Until))
+  }
+  limit := filter.Limit
+  if limit <= 0 {
+    limit = DEFAULT_AUDIT_LIMIT
+  }
+  if limit > MAX_AUDIT_LIMIT {
+    limit = MAX_AUDIT_LIMIT
+  }
+
+  query := "select ID, Timestamp, Principal, Action, Target, SourceIP, Outcome, Detail from Audit"
+  if len(clauses) > 0 {
+    query += " where " + strings.Join(clauses, " and ")
+  }
+  query += " order by ID desc limit ?"
+  args = append(args, limit)
+
+  rows, err := db.Query(query, args...)
+  if err != nil {
+    log.Error("db.QueryAudit", "failed to query audit log", err)
+    return entries, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var e AuditEntry
+    err := rows.Scan(&e.ID, &e.Timestamp, &e.Principal, &e.Action, &e.Target, &e.SourceIP, &e.Outcome, &e.Detail)
+    if err != nil {
+      log.Warn("db.QueryAudit", "failed to scan audit row", err)
+      continue
+    }
+    entries = append(entries, e)
+  }
+  return entries, nil
+}
@@ -0,0 +1,411 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package db
+
+/*
+ * Online backups of the local database. Copying the file while the Recorder
+ * is writing to it can capture a torn, corrupt database, so instead we use
+ * SQLite's backup API, which copies a consistent snapshot. Each backup is
+ * integrity checked and its SHA-256 recorded in a manifest (in the format
+ * sha256sum -c expects) before older backups are rotated out.
+ *
+ * Restoring can't safely replace the database out from under a running
+ * server, so RestoreBackup only validates a backup and stages it next to the
+ * database; the server swaps it in when it next starts, before opening
+ * anything. Every process with the database open holds a shared flock on a
+ * lock file beside it, and the swap needs an exclusive one, so it's refused
+ * while e.g. another server or a CLI command is still running.
+ */
+
+import (
+  "bufio"
+  "context"
+  "crypto/sha256"
+  "database/sql"
+  "encoding/hex"
+  "errors"
+  "io"
+  "os"
+  "path/filepath"
+  "sort"
+  "strconv"
+  "strings"
+  "syscall"
+  "time"
+
+  "providence/config"
+  "providence/log"
+
+  sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+const (
+  BACKUP_PREFIX   = "providence-"
+  BACKUP_SUFFIX   = ".sqlite3"
+  BACKUP_MANIFEST = "SHA256SUMS"
+  backupTimestamp = "20060102T150405"
+
+  // pages copied per step; the database is only locked during a step, so
+  // this keeps the Recorder from waiting long
+  backupStepPages = 256
+)
+
+/* Where a validated backup waits to be swapped in at startup. */
+func stagedRestorePath() string {
+  return config.General.DatabasePath + ".restore"
+}
+
+/* Copies the live database into dest a few pages at a time. If the database
+ * is written to mid-copy, SQLite starts over, so the result is consistent. */
+func copyDatabase(dest string) error {
+  destConn, err := (&sqlite3.SQLiteDriver{}).Open(dest)
+  if err != nil {
+    return err
+  }
+  defer destConn.Close()
+  conn, err := db.Conn(context.Background())
+  if err != nil {
+    return err
+  }
+  defer conn.Close()
+
+  return conn.Raw(func(driverConn interface{}) error {
+    src, ok := driverConn.(*sqlite3.SQLiteConn)
+    if !ok {
+      return errors.New("database connection is not SQLite")
+    }
+    b, err := destConn.(*sqlite3.SQLiteConn).Backup("main", src, "main")
+    if err != nil {
+      return err
+    }
+    for {
+      done, err := b.Step(backupStepPages)
+      if err != nil {
+        b.Finish()
+        return err
+      }
+      if done {
+        return b.Finish()
+      }
+      time.Sleep(10 * time.Millisecond)
+    }
+  })
+}
+
+/* Checks that the SQLite file at path is intact and has a schema this build
+ * understands. */
+func checkBackup(path string) error {
+  conn, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+  if err != nil {
+    return err
+  }
+  defer conn.Close()
+
+  var result string
+  if err = conn.QueryRow("PRAGMA integrity_check").Scan(&result); err != nil {
+    return err
+  }
+  if result != "ok" {
+    return errors.New("integrity check failed: " + result)
+  }
+  var version sql.NullInt64
+  if err = conn.QueryRow("select max(Version) from schema_version").Scan(&version); err != nil {
+    return err
+  }
+  latest := sqliteMigrations[len(sqliteMigrations)-1].version
+  if int(version.Int64) > latest {
+    return errors.New("schema version " + strconv.FormatInt(version.Int64, 10) +
+      " is newer than this build supports (" + strconv.Itoa(latest) + ")")
+  }
+  return nil
+}
+
+/* Returns the hex SHA-256 of the file at path. */
+func checksum(path string) (string, error) {
+  file, err := os.Open(path)
+  if err != nil {
+    return "", err
+  }
+  defer file.Close()
+  h := sha256.New()
+  if _, err = io.Copy(h, file); err != nil {
+    return "", err
+  }
+  return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+/* Reads the manifest in dir, as a map of backup file name to checksum. A
+ * missing manifest is just empty. */
+func readManifest(dir string) (map[string]string, error) {
+  sums := make(map[string]string)
+  file, err := os.Open(filepath.Join(dir, BACKUP_MANIFEST))
+  if os.IsNotExist(err) {
+    return sums, nil
+  }
+  if err != nil {
+    return nil, err
+  }
+  defer file.Close()
+  scanner := bufio.NewScanner(file)
+  for scanner.Scan() {
+    fields := strings.Fields(scanner.Text())
+    if len(fields) == 2 {
+      sums[fields[1]] = fields[0]
+    }
+  }
+  return sums, scanner.Err()
+}
+
+/* Replaces the manifest in dir, oldest backup first. */
+func writeManifest(dir string, sums map[string]string) error {
+  names := make([]string, 0, len(sums))
+  for name := range sums {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  path := filepath.Join(dir, BACKUP_MANIFEST)
+  file, err := os.Create(path + ".tmp")
+  if err != nil {
+    return err
+  }
+  for _, name := range names {
+    if _, err = io.WriteString(file, sums[name]+"  "+name+"\n"); err != nil {
+      break
+    }
+  }
+  if err == nil {
+    err = file.Sync()
+  }
+  file.Close()
+  if err != nil {
+    os.Remove(path + ".tmp")
+    return err
+  }
+  return os.Rename(path+".tmp", path)
+}
+
+/* Returns the names of the backups in the manifest, oldest first. Since the
+ * names embed the time, sorting them sorts by age. */
+func backupNames(sums map[string]string) []string {
+  names := make([]string, 0, len(sums))
+  for name := range sums {
+    if strings.HasPrefix(name, BACKUP_PREFIX) && strings.HasSuffix(name, BACKUP_SUFFIX) {
+      names = append(names, name)
+    }
+  }
+  sort.Strings(names)
+  return names
+}
+
+/* Takes a backup of the local database now, records it in the manifest and
+ * removes all but the newest config.Backup.Keep backups. Returns the path of
+ * the new backup. */
+func Backup() (string, error) {
+  dir := config.Backup.Directory
+  if dir == "" {
+    return "", errors.New("no backup directory configured")
+  }
+  if err := os.MkdirAll(dir, 0750); err != nil {
+    return "", err
+  }
+  sums, err := readManifest(dir)
+  if err != nil {
+    return "", err
+  }
+
+  start := time.Now()
+  name := BACKUP_PREFIX + start.Format(backupTimestamp) + BACKUP_SUFFIX
+  path := filepath.Join(dir, name)
+  partial := path + ".partial"
+  os.Remove(partial) // left over from a crash, if anything
+  err = copyDatabase(partial)
+  if err == nil {
+    err = checkBackup(partial)
+  }
+  if err == nil {
+    sums[name], err = checksum(partial)
+  }
+  if err == nil {
+    err = os.Rename(partial, path)
+  }
+  if err != nil {
+    os.Remove(partial)
+    log.Error("db.backup", "backup to "+path+" failed", err)
+    return "", err
+  }
+
+  names := backupNames(sums)
+  for len(names) > config.Backup.Keep {
+    if err := os.Remove(filepath.Join(dir, names[0])); err != nil && !os.IsNotExist(err) {
+      log.Warn("db.backup", "failed to remove old backup "+names[0], err)
+      break
+    }
+    delete(sums, names[0])
+    names = names[1:]
+  }
+  if err = writeManifest(dir, sums); err != nil {
+    log.Error("db.backup", "failed to write backup manifest", err)
+    return path, err
+  }
+  log.Status("db.backup", "backed up "+config.General.DatabasePath+" to "+path+" in "+time.Since(start).String())
+  return path, nil
+}
+
+/* Validates a backup against the manifest in its directory, and stages it to
+ * replace the database the next time providence starts. With path "", the
+ * newest backup in config.Backup.Directory is used. Returns the path of the
+ * backup staged. */
+func RestoreBackup(path string) (string, error) {
+  if path == "" {
+    sums, err := readManifest(config.Backup.Directory)
+    if err != nil {
+      return "", err
+    }
+    names := backupNames(sums)
+    if len(names) == 0 {
+      return "", errors.New("no backups in " + config.Backup.Directory)
+    }
+    path = filepath.Join(config.Backup.Directory, names[len(names)-1])
+  }
+
+  sums, err := readManifest(filepath.Dir(path))
+  if err != nil {
+    return "", err
+  }
+  want, ok := sums[filepath.Base(path)]
+  if !ok {
+    return "", errors.New(path + " is not in the backup manifest")
+  }
+  if got, err := checksum(path); err != nil {
+    return "", err
+  } else if got != want {
+    return "", errors.New(path + " does not match its checksum; it may be corrupt")
+  }
+  if err = checkBackup(path); err != nil {
+    return "", err
+  }
+
+  // copy rather than rename, so the backup itself stays put
+  staged := stagedRestorePath()
+  in, err := os.Open(path)
+  if err != nil {
+    return "", err
+  }
+  defer in.Close()
+  out, err := os.OpenFile(staged+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+  if err != nil {
+    return "", err
+  }
+  _, err = io.Copy(out, in)
+  if err == nil {
+    err = out.Sync()
+  }
+  out.Close()
+  if err == nil {
+    err = os.Rename(staged+".tmp", staged)
+  }
+  if err != nil {
+    os.Remove(staged + ".tmp")
+    return "", err
+  }
+  return path, nil
+}
+
+/* The lock file every process with the database open holds a flock on. */
+var lockFile *os.File
+
+/* Takes (or converts an existing lock to) a flock of the given kind on the
+ * database's lock file, without waiting. The lock is held until exit. */
+func lockDatabase(how int) error {
+  if lockFile == nil {
+    f, err := os.OpenFile(config.General.DatabasePath+".lock", os.O_RDWR|os.O_CREATE, 0640)
+    if err != nil {
+      return err
+    }
+    lockFile = f
+  }
+  return syscall.Flock(int(lockFile.Fd()), how|syscall.LOCK_NB)
+}
+
+/* Swaps a staged restore in for the database, if there is one; returns
+ * whether it did. Must be called before Open, and only by the server. The
+ * database it replaces, along with its journal files, is kept alongside with
+ * a ".pre-restore" suffix; the journals in particular must not be left where
+ * SQLite would apply them to the restored database. */
+func ApplyStagedRestore() (bool, error) {
+  // a dry run checks the database in use, and leaves the restore staged
+  if config.DryRunMigrations {
+    return false, nil
+  }
+  staged := stagedRestorePath()
+  if _, err := os.Stat(staged); os.IsNotExist(err) {
+    return false, nil
+  }
+  if err := lockDatabase(syscall.LOCK_EX); err == syscall.EWOULDBLOCK {
+    return false, errors.New("another process has " + config.General.DatabasePath + " open; not restoring")
+  } else if err != nil {
+    return false, err
+  }
+  if err := checkBackup(staged); err != nil {
+    return false, errors.New("staged restore " + staged + " is unusable: " + err.Error())
+  }
+
+  path := config.General.DatabasePath
+  aside := path + ".pre-restore"
+  for _, suffix := range []string{"", "-journal", "-wal", "-shm"} {
+    err := os.Rename(path+suffix, aside+suffix)
+    if err != nil && !os.IsNotExist(err) {
+      return false, err
+    }
+  }
+  if err := os.Rename(staged, path); err != nil {
+    return false, err
+  }
+  log.Status("db.restore", "restored database from backup; previous database is at "+aside)
+  return true, nil
+}
+
+/* A goroutine that takes a backup whenever the newest one is older than
+ * the configured interval, checking hourly. */
+func startBackups() {
+  dir := config.Backup.Directory
+  if dir == "" {
+    return
+  }
+  interval, _ := time.ParseDuration(config.Backup.Interval) // validated by config
+  var last time.Time
+  if sums, err := readManifest(dir); err == nil {
+    if names := backupNames(sums); len(names) > 0 {
+      stamp := strings.TrimSuffix(strings.TrimPrefix(names[len(names)-1], BACKUP_PREFIX), BACKUP_SUFFIX)
+      last, _ = time.ParseInLocation(backupTimestamp, stamp, time.Local)
+    }
+  }
+
+  ticker := time.Tick(1 * time.Hour)
+  if config.General.Debug {
+    ticker = time.Tick(1 * time.Minute)
+  }
+  go func() {
+    for {
+      if time.Since(last) >= interval {
+        if _, err := Backup(); err == nil {
+          last = time.Now()
+        }
+      }
+      <-ticker
+    }
+  }()
+}
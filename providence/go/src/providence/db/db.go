@@ -17,7 +17,9 @@ package db
 
 import (
   "database/sql"
-  "errors"
+  "os"
+  "syscall"
+  "time"
 
   "providence/common"
   "providence/config"
@@ -28,102 +30,118 @@ import (
 )
 
 var (
-  db                 *sql.DB
-  storeEvent         *sql.Stmt
-  selectEvent        *sql.Stmt
-  selectRecentEvents *sql.Stmt
-  insertRegId        *sql.Stmt
-  updateRegId        *sql.Stmt
-  deleteRegId        *sql.Stmt
-  selectRegId        *sql.Stmt
+  db         *sql.DB
+  insertMode *sql.Stmt
+  selectMode *sql.Stmt
 )
 
-func init() {
+/* Columns of the Events table, in the order scanEvent expects them. */
+const eventColumns = "EventID, SensorID, Trip, Reset, IsAjar, IsAnomalous, IsPending, AckedBy, AckedAt, IsOffline, Source, IsTampered, Tamper"
+
+/* Reads a single row selected with eventColumns into an Event. */
+func scanEvent(rows *sql.Rows) (types.Event, error) {
+  var ev types.Event
+  err := rows.Scan(&ev.EventID, &ev.SensorID, &ev.Trip, &ev.Reset, &ev.IsAjar, &ev.IsAnomalous, &ev.IsPending, &ev.AckedBy, &ev.AckedAt, &ev.IsOffline, &ev.Source, &ev.IsTampered, &ev.Tamper)
+  return ev, err
+}
+
+/* Times are stored as text in whatever zone they're bound in, and compared
+ * as text, so every time written or compared against must be in the same
+ * zone. Events have always been stored in server-local time. */
+func localTime(t time.Time) time.Time {
+  return t.In(time.Local)
+}
+
+func localTimePtr(t *time.Time) *time.Time {
+  if t == nil {
+    return nil
+  }
+  l := localTime(*t)
+  return &l
+}
+
+/* Opens the database, bringing its schema up to date, and prepares the
+ * statements everything else here uses. Must be called before any other
+ * function in this package; the server calls ApplyStagedRestore first. */
+func Open() {
   var err error
 
+  // A dry run mustn't leave behind a database it was only meant to check
+  path := config.General.DatabasePath
+  if config.DryRunMigrations {
+    if _, err = os.Stat(path); err != nil {
+      log.Error("db.Open", "nothing to dry run migrations against", err)
+      panic("database " + path + " does not exist")
+    }
+    path = "file:" + path + "?mode=rw"
+  }
+
+  // Hold a shared lock for as long as we're running, so a restore can tell
+  // whether anyone else has the database open
+  if err = lockDatabase(syscall.LOCK_SH); err != nil {
+    msg := "failed to lock database; a restore may be in progress"
+    log.Error("db.Open", msg, err)
+    panic(msg)
+  }
+
   // Get a DB connection.
-  db, err = sql.Open("sqlite3", config.General.DatabasePath)
+  db, err = sql.Open("sqlite3", path)
   if err != nil {
     log.Error("db.package_init", "recorder failed to open ", config.General.DatabasePath, err)
     panic("recorder failed to open")
   }
 
-  // First, create the tables
-  tx, err := db.Begin()
+  // Bring the schema up to date before preparing any statements against it
+  err = migrate(db, sqliteDialect, sqliteMigrations, config.DryRunMigrations)
   if err != nil {
-    msg := "error creating database tables"
+    msg := "error migrating database schema"
     log.Error("db.package_init", msg, err)
     panic(msg)
   }
-  for _, stmt := range []string{
-    `CREATE TABLE IF NOT EXISTS Events (
-        EventID text not null unique primary key,
-        SensorID text not null,
-        Trip datetime not null,
-        Reset datetime,
-        IsAjar integer not null default false,
-        IsAnomalous integer not null default false,
-        Timestamp datetime not null default(datetime('now')));`,
-    `CREATE TABLE IF NOT EXISTS RegIDs (
-        RegID text not null unique primary key,
-        Timestamp datetime not null default(datetime('now')));`,
-  } {
-    _, err = tx.Exec(stmt)
-    if err != nil {
-      msg := "error executing table create statement"
-      log.Error("db.package_init", msg, err)
-      panic(msg)
-    }
-  }
-  tx.Commit()
-
 
-  // Initialize events table prepared statements
-  storeEvent, err = db.Prepare(
-    `insert or replace into events
-       (EventID, SensorID, Trip, Reset, IsAjar, IsAnomalous)
-     values (?, ?, ?, ?, ?, ?)`)
-  if err != nil {
-    log.Error("db.package_init", "recorder failed to prepare storeEvent", err)
+  // Events, RegIDs & photos go to the Store, which may be elsewhere
+  if config.General.StoreDriver == "postgres" {
+    store, err = openPostgres(config.General.StoreURL, config.DryRunMigrations)
+  } else if !config.DryRunMigrations {
+    store, err = newSQLStore(db, sqliteDialect)
   }
-  selectRecentEvents, err = db.Prepare(
-    `select EventID, SensorID, Trip, Reset, IsAjar, IsAnomalous from events
-     order by timestamp desc limit 10`)
   if err != nil {
-    log.Error("db.package_init", "recorder failed to prepare selectRecentEvents", err)
+    msg := "error opening " + config.General.StoreDriver + " store"
+    log.Error("db.package_init", msg, err)
+    panic(msg)
   }
-  selectEvent, err = db.Prepare(`select EventID, SensorID, Trip, Reset, IsAjar, IsAnomalous from events where EventID=?`)
-  if err != nil {
-    log.Error("db.package_init", "recorder failed to prepare selectEvent", err)
+  if config.DryRunMigrations {
+    log.Status("db.package_init", "migration dry run complete; exiting")
+    os.Exit(0)
   }
 
-
-  // Initialize RegIDs table prepared statements
-  insertRegId, err = db.Prepare("insert or ignore into RegIDs values (?)")
+  // Initialize SystemMode table prepared statements. Every change is kept as
+  // a new row, so the table doubles as a history of who armed what & when.
+  insertMode, err = db.Prepare("insert into SystemMode (Mode, ChangedBy, Timestamp) values (?, ?, ?)")
   if err != nil {
-    log.Error("db.package_init", "regId updater failed to prepare insert", err)
+    log.Error("db.package_init", "failed to prepare insertMode", err)
   }
-  updateRegId, err = db.Prepare("update RegIDs set RegID=? where RegID=?")
+  selectMode, err = db.Prepare("select Mode, ChangedBy, Timestamp from SystemMode order by rowid desc limit 1")
   if err != nil {
-    log.Error("db.package_init", "regId updater failed to prepare update", err)
-  }
-  deleteRegId, err = db.Prepare("delete from RegIDs where RegID=?")
-  if err != nil {
-    log.Error("db.package_init", "regId updater failed to prepare delete", err)
-  }
-  selectRegId, err = db.Prepare("select RegID from RegIDs")
-  if err != nil {
-    log.Error("db.package_init", "regId updater failed to prepare select", err)
+    log.Error("db.package_init", "failed to prepare selectMode", err)
   }
 
-  // No defer foo.Close() here since this is package init(); when these go out
-  // of scope, it will be because process is shutting down
+  prepareQueue()
+  prepareUsers()
+  prepareAudit()
+
+  // No defer foo.Close() here since these are used for the life of the
+  // process; when they go out of scope, it will be because it's shutting down
 }
 
 /* Logs all events it gets to a sqlite3 database. Should be registered for all
- * eventCodes. Never sends anything to the outgoing channel.
+ * eventCodes. Never sends anything to the outgoing channel. Also starts the
+ * jobs that purge old events and back up the database, since this is where
+ * they accumulate.
  */
 func Recorder(incoming chan types.Event, outgoing chan types.Event) {
+  startPurger()
+  startBackups()
   for {
     StoreEvent(<-incoming) // ignore error response since it's already logged
   }
@@ -151,48 +169,22 @@ func StartRegIdUpdater() chan RegIdUpdate {
         log.Debug("db.regid_updater", update)
         if update.Remove {
           // Basic delete.
-          _, err := deleteRegId.Exec(update.RegId)
+          err := store.DeleteRegId(update.RegId)
           if err != nil {
             log.Warn("db.regid_updater", "failed deleting RegID ", err)
           }
         } else if update.CanonicalRegId != "" {
-          // To handle the case where the server sends us a canonicalization
-          // correction for a regID that isn't actually in the database, we
-          // first insert the old one (with the statement set to no-op if
-          // already present) and then execute the update. We do these in a
-          // transaction to avoid race conditions. This case should actually
-          // never happen, since if we don't have a given regID, we can't send
-          // it to the server so we can't get a correction for it. So this is
-          // a lot of work to cover a case that should never happen. But this
-          // does defend against the in-memory map getting out of sync with
-          // the persistence store.
-          tx, err := db.Begin()
-          if err != nil {
-            log.Warn("db.regid_updater", "failed to start a transaction for canon-RegID update ", err)
-            break
-          }
-          _, err = tx.Stmt(insertRegId).Exec(update.RegId)
+          // This case should actually never happen, since if we don't have a
+          // given regID, we can't send it to the server so we can't get a
+          // correction for it. But this does defend against the in-memory map
+          // getting out of sync with the persistence store.
+          err := store.CanonicalizeRegId(update.RegId, update.CanonicalRegId)
           if err != nil {
-            log.Warn("db.regid_updater", "failed to insertOrIgnore canon-RegID ", err)
-            tx.Rollback()
-            break
-          }
-          _, err = tx.Stmt(updateRegId).Exec(update.CanonicalRegId, update.RegId)
-          if err != nil {
-            log.Warn("db.regid_updater", "failed on update canon-RegID ", err)
-            tx.Rollback()
-            break
-          }
-          err = tx.Commit()
-          if err != nil {
-            log.Warn("db.regid_updater", "failed to commit canon-RegID transaction", err)
-            tx.Rollback()
-            break
+            log.Warn("db.regid_updater", "failed on canon-RegID update ", err)
           }
         } else {
-          // Basic insert. Note that the table is NOT NULL UNIQUE on reg IDs,
-          // so we can use the "INSERT OR IGNORE" query form.
-          _, err := insertRegId.Exec(update.RegId)
+          // Basic insert; a no-op if the reg ID is already known.
+          err := store.AddRegId(update.RegId)
           if err != nil {
             log.Warn("db.regid_updater", "failed on RegID insert ", err)
           }
@@ -211,15 +203,12 @@ func GetRegIds(skip []string) (regIds []string, err error) {
   // args at this time. So instead we filter results manually.
 
   rowIds := make([]string, 0)
-  rows, err := selectRegId.Query()
+  all, err := store.GetRegIds()
   if err != nil {
     log.Error("db.get_regids", "failed to fetch known regIds during query ", err)
     return rowIds, err
   } else {
-    defer rows.Close()
-    for rows.Next() {
-      var s string
-      rows.Scan(&s)
+    for _, s := range all {
       add := true
       for _, sk := range skip {
         if s == sk {
@@ -236,68 +225,81 @@ func GetRegIds(skip []string) (regIds []string, err error) {
 }
 
 func GetRecentEvents() ([]types.Event, error) {
-  rows, err := selectRecentEvents.Query()
-  if err != nil {
-    log.Error("db.get_recents", "failed to fetch recent rows ", err)
-    return make([]types.Event, 0), err
-  }
-  defer rows.Close()
+  return store.GetRecentEvents()
+}
+
+func GetEvent(eventID string) (types.Event, error) {
+  return store.GetEvent(eventID)
+}
+
+func StoreEvent(event types.Event) error {
+  return store.StoreEvent(event)
+}
 
-  count := 0
-  events := make([]types.Event, 10)
-  for rows.Next() {
-    ev := types.Event{}
-    var eventID, sensorID string
-    var trip, reset time.Time
-    var isAjar, isAnomalous bool
-    rows.Scan(&eventID, &sensorID, &trip, &reset, &isAjar, &isAnomalous)
-    event := types.Event{eventID, sensorID, trip, reset, isAjar, isAnomalous}
-    events[count] = event
-    count += 1
-    if count == 10 {
-      break
+/* Returns the latest stored copy of an event, or the event itself if it
+ * hasn't been recorded yet. Anything that resends an event it has been
+ * holding on to, e.g. to reset it, should start from this so as not to undo
+ * changes made since, like an acknowledgement. */
+func Refresh(event types.Event) types.Event {
+  stored, err := store.GetEvent(event.EventID)
+  if err != nil {
+    if err != ErrEventNotFound {
+      log.Warn("db.Refresh", "failed to reload event '"+event.EventID+"'", err)
     }
+    return event
   }
+  return stored
+}
 
-  return events[:count], nil
+/* Records a photo captured for an event. */
+func AddPhoto(photo Photo) error {
+  return store.AddPhoto(photo)
 }
 
-func GetEvent(eventID string) (types.Event, error) {
-  rows, err := selectEvent.Query(eventID)
+/* Returns metadata for photos of the indicated events, by event ID. */
+func GetPhotos(eventIDs []string) (map[string][]Photo, error) {
+  return store.GetPhotos(eventIDs)
+}
+
+/* Forgets photos taken before the cutoff. */
+func PurgePhotos(cutoff time.Time) error {
+  return store.PurgePhotos(cutoff)
+}
+
+/* Returns the current system mode. A database that has never had a mode set
+ * is DISARMED. */
+func GetMode() (types.ModeState, error) {
+  state := types.ModeState{Mode: types.DISARMED}
+  rows, err := selectMode.Query()
   if err != nil {
-    log.Error("db.get_recents", "failed to fetch recent rows ", err)
-    return types.Event{}, err
+    log.Error("db.GetMode", "failed to fetch system mode ", err)
+    return state, err
   }
   defer rows.Close()
 
   if !rows.Next() {
-    s := "no result found loading event for '" + eventID + "'"
-    log.Error("db.GetEvent", s)
-    return types.Event{}, errors.New(s)
+    return state, nil
   }
-
-  var eventID, sensorID string
-  var trip, reset time.Time
-  var isAjar, isAnomalous bool
-  rows.Scan(&eventID, &sensorID, &trip, &reset, &isAjar, &isAnomalous)
-
-  return types.Event{eventID, sensorID, trip, reset, isAjar, isAnomalous}, nil
+  var mode int
+  err = rows.Scan(&mode, &state.ChangedBy, &state.Changed)
+  if err != nil {
+    log.Error("db.GetMode", "failed to scan system mode ", err)
+    return types.ModeState{Mode: types.DISARMED}, err
+  }
+  state.Mode = types.SystemMode(mode)
+  return state, nil
 }
 
-func StoreEvent(event types.Event) error {
-  res, err := storeEvent.Exec(event.EventID, event.SensorID, event.Trip, event.Reset, event.IsAjar, event.IsAnomalous)
+/* Records a new system mode, set by the indicated user. */
+func SetMode(mode types.SystemMode, who string) (types.ModeState, error) {
+  state := types.ModeState{Mode: mode, Changed: time.Now(), ChangedBy: who}
+  _, err := insertMode.Exec(int(mode), who, state.Changed)
   if err != nil {
-    log.Error("db.StoreEvent", "failed inserting or updating event '" + event.EventID + "'", err)
-    return err
-  }
-  numRows, err := res.RowsAffected()
-  if numRows > 1 {
-    log.Warning("db.StoreEvent", "multiple rows affected by store operation for '" + event.EventID + "'")
-  }
-  if numRows < 1 {
-    log.Warning("db.StoreEvent", "success but 0 rows affected by store operation for '" + event.EventID + "'")
+    log.Error("db.SetMode", "failed storing mode "+mode.Name()+" for "+who, err)
+    return state, err
   }
-  return nil
+  log.Status("db.SetMode", "system mode set to "+mode.Name()+" by "+who)
+  return state, nil
 }
 
 var Handler common.Handler = Recorder
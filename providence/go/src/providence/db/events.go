@@ -0,0 +1,212 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package db
+
+import (
+  "encoding/base64"
+  "errors"
+  "strconv"
+  "strings"
+  "time"
+
+  "providence/log"
+  "providence/types"
+)
+
+/* Criteria for QueryEvents. Zero values mean "don't filter on this". Zone is
+ * resolved to the sensors configured in that zone. Cursor is the NextCursor
+ * returned by a previous query, and continues where that one left off. */
+type EventFilter struct {
+  SensorIDs []string
+  Zone      string
+  Since     time.Time
+  Until     time.Time
+  Anomalous *bool
+  Ajar      *bool
+  Cursor    string
+  Limit     int
+}
+
+const (
+  DEFAULT_EVENT_LIMIT = 50
+  MAX_EVENT_LIMIT     = 500
+)
+
+/* Returned by QueryEvents for a cursor it didn't issue. */
+var ErrBadCursor = errors.New("malformed cursor")
+
+/* Cursors are opaque to clients, but are just the sort key of the last event
+ * on the previous page. */
+func encodeCursor(ev types.Event) string {
+  raw := strconv.FormatInt(ev.Trip.UnixNano(), 10) + "|" + ev.EventID
+  return base64.URLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCursor(cursor string) (time.Time, string, error) {
+  raw, err := base64.URLEncoding.DecodeString(cursor)
+  if err != nil {
+    return time.Time{}, "", err
+  }
+  chunks := strings.SplitN(string(raw), "|", 2)
+  if len(chunks) != 2 {
+    return time.Time{}, "", ErrBadCursor
+  }
+  nanos, err := strconv.ParseInt(chunks[0], 10, 64)
+  if err != nil {
+    return time.Time{}, "", err
+  }
+  return time.Unix(0, nanos), chunks[1], nil
+}
+
+/* Returns events matching the filter, newest first, plus a cursor for the
+ * next page, which is "" if there are no more results. */
+func QueryEvents(filter EventFilter) ([]types.Event, string, error) {
+  return store.QueryEvents(filter)
+}
+
+func (s *sqlStore) QueryEvents(filter EventFilter) ([]types.Event, string, error) {
+  events := make([]types.Event, 0)
+
+  clauses := make([]string, 0)
+  args := make([]interface{}, 0)
+
+  sensorIDs := filter.SensorIDs
+  if filter.Zone != "" {
+    zoneIDs := make([]string, 0)
+    for id, sensor := range types.Sensors {
+      if sensor.Zone == filter.Zone {
+        zoneIDs = append(zoneIDs, id)
+      }
+    }
+    if len(zoneIDs) == 0 {
+      return events, "", nil
+    }
+    if len(sensorIDs) > 0 {
+      // both given; only sensors that are in the zone
+      both := make([]string, 0)
+      for _, id := range sensorIDs {
+        for _, zid := range zoneIDs {
+          if id == zid {
+            both = append(both, id)
+          }
+        }
+      }
+      if len(both) == 0 {
+        return events, "", nil
+      }
+      sensorIDs = both
+    } else {
+      sensorIDs = zoneIDs
+    }
+  }
+  if len(sensorIDs) > 0 {
+    placeholders := make([]string, len(sensorIDs))
+    for i, id := range sensorIDs {
+      placeholders[i] = "?"
+      args = append(args, id)
+    }
+    clauses = append(clauses, "SensorID in ("+strings.Join(placeholders, ", ")+")")
+  }
+  if !filter.Since.IsZero() {
+    clauses = append(clauses, "Trip >= ?")
+    args = append(args, localTime(filter.Since))
+  }
+  if !filter.Until.IsZero() {
+    clauses = append(clauses, "Trip < ?")
+    args = append(args, localTime(filter.Until))
+  }
+  if filter.Anomalous != nil {
+    clauses = append(clauses, "IsAnomalous = ?")
+    args = append(args, *filter.Anomalous)
+  }
+  if filter.Ajar != nil {
+    clauses = append(clauses, "IsAjar = ?")
+    args = append(args, *filter.Ajar)
+  }
+  if filter.Cursor != "" {
+    trip, eventID, err := decodeCursor(filter.Cursor)
+    if err != nil {
+      log.Warn("db.QueryEvents", "bogus cursor '"+filter.Cursor+"'", err)
+      return events, "", ErrBadCursor
+    }
+    clauses = append(clauses, "(Trip < ? or (Trip = ? and EventID < ?))")
+    args = append(args, localTime(trip), localTime(trip), eventID)
+  }
+
+  limit := filter.Limit
+  if limit <= 0 {
+    limit = DEFAULT_EVENT_LIMIT
+  }
+  if limit > MAX_EVENT_LIMIT {
+    limit = MAX_EVENT_LIMIT
+  }
+
+  query := "select " + eventColumns + " from events"
+  if len(clauses) > 0 {
+    query += " where " + strings.Join(clauses, " and ")
+  }
+  // fetch one extra row, to find out whether there's another page
+  query += " order by Trip desc, EventID desc limit ?"
+  args = append(args, limit+1)
+
+  log.Debug("db.QueryEvents", query, args)
+  rows, err := s.conn.Query(s.d.rebind(query), args...)
+  if err != nil {
+    log.Error("db.QueryEvents", "failed to query events ", err)
+    return events, "", err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    event, err := scanEvent(rows)
+    if err != nil {
+      log.Warn("db.QueryEvents", "failed to scan event row ", err)
+      continue
+    }
+    events = append(events, event)
+  }
+
+  if len(events) > limit {
+    events = events[:limit]
+    return events, encodeCursor(events[limit-1]), nil
+  }
+  return events, "", nil
+}
+
+/* Returns the most recent event for each sensor that has one, by sensor ID. */
+func GetLatestEvents() (map[string]types.Event, error) {
+  return store.GetLatestEvents()
+}
+
+func (s *sqlStore) GetLatestEvents() (map[string]types.Event, error) {
+  latest := make(map[string]types.Event)
+  rows, err := s.conn.Query(
+    `select ` + eventColumns + ` from events
+     where Trip = (select max(Trip) from events e where e.SensorID = events.SensorID)`)
+  if err != nil {
+    log.Error("db.GetLatestEvents", "failed to query latest events ", err)
+    return latest, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    event, err := scanEvent(rows)
+    if err != nil {
+      log.Warn("db.GetLatestEvents", "failed to scan event row ", err)
+      continue
+    }
+    latest[event.SensorID] = event
+  }
+  return latest, nil
+}
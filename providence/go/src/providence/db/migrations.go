@@ -0,0 +1,218 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package db
+
+/*
+ * Versioned schema migrations. Each one is applied at most once, in order,
+ * in its own transaction along with the schema_version row recording it, so
+ * a failure leaves the database at the last good version. Migrations must
+ * tolerate databases created by older builds that predate this mechanism,
+ * which is why they use IF NOT EXISTS and addColumn rather than bare DDL.
+ *
+ * The local SQLite database and a PostgreSQL store (see postgres.go) each
+ * have their own list. To change a schema, append a migration; never edit
+ * one that has shipped.
+ */
+
+import (
+  "database/sql"
+  "errors"
+  "fmt"
+  "strconv"
+
+  "providence/log"
+)
+
+type migration struct {
+  version     int
+  description string
+  apply       func(tx *sql.Tx) error
+}
+
+var sqliteMigrations = []migration{
+  {1, "initial events and registration ID tables", func(tx *sql.Tx) error {
+    return execAll(tx,
+      `CREATE TABLE IF NOT EXISTS Events (
+          EventID text not null unique primary key,
+          SensorID text not null,
+          Trip datetime not null,
+          Reset datetime,
+          IsAjar integer not null default false,
+          IsAnomalous integer not null default false,
+          Timestamp datetime not null default(datetime('now')));`,
+      `CREATE TABLE IF NOT EXISTS RegIDs (
+          RegID text not null unique primary key,
+          Timestamp datetime not null default(datetime('now')));`)
+  }},
+  {2, "system mode history", func(tx *sql.Tx) error {
+    return execAll(tx,
+      `CREATE TABLE IF NOT EXISTS SystemMode (
+          Mode integer not null,
+          ChangedBy text not null default '',
+          Timestamp datetime not null default(datetime('now')));`)
+  }},
+  {3, "entry delay pending flag on events", func(tx *sql.Tx) error {
+    return addColumn(tx, "Events", "IsPending", "integer not null default false")
+  }},
+  {4, "outbound notification queue and dead letters", func(tx *sql.Tx) error {
+    return execAll(tx, queueTables...)
+  }},
+  {5, "alert acknowledgement on events", func(tx *sql.Tx) error {
+    if err := addColumn(tx, "Events", "AckedBy", "text not null default ''"); err != nil {
+      return err
+    }
+    return addColumn(tx, "Events", "AckedAt", "datetime")
+  }},
+  {6, "local users, sessions, API tokens and roles", func(tx *sql.Tx) error {
+    return execAll(tx, userTables...)
+  }},
+  {7, "audit log", func(tx *sql.Tx) error {
+    return execAll(tx, auditTables...)
+  }},
+  {8, "photo metadata", func(tx *sql.Tx) error {
+    return execAll(tx, sqliteDialect.ddlAll(photosTables)...)
+  }},
+  {9, "sensor and hub offline events", func(tx *sql.Tx) error {
+    if err := addColumn(tx, "Events", "IsOffline", "integer not null default false"); err != nil {
+      return err
+    }
+    return addColumn(tx, "Events", "Source", "text not null default ''")
+  }},
+  {10, "tamper events", func(tx *sql.Tx) error {
+    if err := addColumn(tx, "Events", "IsTampered", "integer not null default false"); err != nil {
+      return err
+    }
+    return addColumn(tx, "Events", "Tamper", "text not null default ''")
+  }},
+}
+
+func execAll(tx *sql.Tx, stmts ...string) error {
+  for _, stmt := range stmts {
+    if _, err := tx.Exec(stmt); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+/* Adds a column to a table, unless it's already there. */
+func addColumn(tx *sql.Tx, table string, column string, decl string) error {
+  rows, err := tx.Query("PRAGMA table_info(" + table + ")")
+  if err != nil {
+    return err
+  }
+  found := false
+  for rows.Next() {
+    var cid, notNull, pk int
+    var name, kind string
+    var dflt sql.NullString
+    if err := rows.Scan(&cid, &name, &kind, &notNull, &dflt, &pk); err != nil {
+      rows.Close()
+      return err
+    }
+    if name == column {
+      found = true
+    }
+  }
+  rows.Close()
+  if found {
+    return nil
+  }
+  _, err = tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + decl)
+  return err
+}
+
+const schemaVersionTable = `CREATE TABLE IF NOT EXISTS schema_version (
+      Version integer not null unique primary key,
+      Description text not null,
+      Applied {timestamp} not null default {now});`
+
+/* Returns the version the database is currently at; 0 if it's new, or
+ * predates migrations. Creates the table recording versions if need be,
+ * unless dryRun is set, in which case the table's absence just means 0. */
+func schemaVersion(conn *sql.DB, d dialect, dryRun bool) (int, error) {
+  if dryRun {
+    var n int
+    if err := conn.QueryRow(d.rebind(d.hasTable), "schema_version").Scan(&n); err != nil || n == 0 {
+      return 0, err
+    }
+  } else if _, err := conn.Exec(d.ddl(schemaVersionTable)); err != nil {
+    return 0, err
+  }
+  var version sql.NullInt64
+  if err := conn.QueryRow("select max(Version) from schema_version").Scan(&version); err != nil {
+    return 0, err
+  }
+  return int(version.Int64), nil
+}
+
+/* Brings the schema up to date. With dryRun, pending migrations are still
+ * run, to prove that they work, but all in one transaction that is then
+ * rolled back. Returns an error without touching anything if the database is
+ * from a newer build than this one, since we can't know what it expects. */
+func migrate(conn *sql.DB, d dialect, migrations []migration, dryRun bool) error {
+  current, err := schemaVersion(conn, d, dryRun)
+  if err != nil {
+    log.Error("db.migrate", "failed to read schema version", err)
+    return err
+  }
+  latest := migrations[len(migrations)-1].version
+  if current > latest {
+    return errors.New(d.name + " schema version " + strconv.Itoa(current) +
+      " is newer than this build supports (" + strconv.Itoa(latest) + ")")
+  }
+
+  var tx *sql.Tx
+  for _, m := range migrations {
+    if m.version <= current {
+      continue
+    }
+    desc := fmt.Sprintf("%s migration %d (%s)", d.name, m.version, m.description)
+    if tx == nil || !dryRun {
+      if tx, err = conn.Begin(); err != nil {
+        return err
+      }
+      // schemaVersion left creating this to us, so it's rolled back too
+      if dryRun {
+        if _, err = tx.Exec(d.ddl(schemaVersionTable)); err != nil {
+          tx.Rollback()
+          return err
+        }
+      }
+    }
+    if err = m.apply(tx); err == nil {
+      _, err = tx.Exec(d.rebind("insert into schema_version (Version, Description) values (?, ?)"), m.version, m.description)
+    }
+    if err != nil {
+      tx.Rollback()
+      log.Error("db.migrate", desc+" failed", err)
+      return err
+    }
+    if dryRun {
+      log.Status("db.migrate", "dry run: would apply "+desc)
+      continue
+    }
+    if err = tx.Commit(); err != nil {
+      log.Error("db.migrate", desc+" failed to commit", err)
+      return err
+    }
+    log.Status("db.migrate", "applied "+desc)
+  }
+  if dryRun && tx != nil {
+    tx.Rollback()
+  }
+  return nil
+}
@@ -0,0 +1,49 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package db
+
+import (
+  "testing"
+)
+
+func TestMigrateDryRun(t *testing.T) {
+  conn := memoryDB(t)
+  if err := migrate(conn, sqliteDialect, sqliteMigrations, true); err != nil {
+    t.Fatal(err)
+  }
+  var n int
+  if err := conn.QueryRow("select count(*) from sqlite_master").Scan(&n); err != nil {
+    t.Fatal(err)
+  }
+  if n != 0 {
+    t.Errorf("dry run left %d objects in a new database", n)
+  }
+
+  if err := migrate(conn, sqliteDialect, sqliteMigrations, false); err != nil {
+    t.Fatal(err)
+  }
+  version, err := schemaVersion(conn, sqliteDialect, true)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if latest := sqliteMigrations[len(sqliteMigrations)-1].version; version != latest {
+    t.Errorf("schema at version %d after migrating, want %d", version, latest)
+  }
+  // nothing pending, so nothing to roll back
+  if err := migrate(conn, sqliteDialect, sqliteMigrations, true); err != nil {
+    t.Error(err)
+  }
+}
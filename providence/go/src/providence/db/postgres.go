@@ -0,0 +1,60 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package db
+
+import (
+  "database/sql"
+
+  _ "github.com/lib/pq"
+)
+
+/* Schema for a central PostgreSQL store. It only holds Store data; see
+ * store.go. */
+var postgresMigrations = []migration{
+  {1, "events, registration IDs and photo metadata", func(tx *sql.Tx) error {
+    stmts := append([]string{eventsTable, regIdsTable}, photosTables...)
+    return execAll(tx, postgresDialect.ddlAll(stmts)...)
+  }},
+  {2, "sensor and hub offline events", func(tx *sql.Tx) error {
+    return execAll(tx,
+      "ALTER TABLE Events ADD COLUMN IF NOT EXISTS IsOffline boolean not null default false",
+      "ALTER TABLE Events ADD COLUMN IF NOT EXISTS Source text not null default ''")
+  }},
+  {3, "tamper events", func(tx *sql.Tx) error {
+    return execAll(tx,
+      "ALTER TABLE Events ADD COLUMN IF NOT EXISTS IsTampered boolean not null default false",
+      "ALTER TABLE Events ADD COLUMN IF NOT EXISTS Tamper text not null default ''")
+  }},
+}
+
+/* Connects to the PostgreSQL database at the indicated URL and brings its
+ * schema up to date. */
+func openPostgres(url string, dryRun bool) (*sqlStore, error) {
+  conn, err := sql.Open("postgres", url)
+  if err != nil {
+    return nil, err
+  }
+  if err = conn.Ping(); err != nil {
+    return nil, err
+  }
+  if err = migrate(conn, postgresDialect, postgresMigrations, dryRun); err != nil {
+    return nil, err
+  }
+  if dryRun {
+    return nil, nil
+  }
+  return newSQLStore(conn, postgresDialect)
+}
@@ -0,0 +1,212 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package db
+
+/*
+ * Persistent outbound notification queue. Each row is one message for one
+ * device, so a failure for one registration ID is retried without resending
+ * to the devices that already got it. Messages that exhaust their retries,
+ * or fail permanently, move to the DeadLetters table for later inspection.
+ */
+
+import (
+  "database/sql"
+  "time"
+
+  "providence/log"
+)
+
+var queueTables = []string{
+  `CREATE TABLE IF NOT EXISTS OutboundQueue (
+      ID integer not null primary key autoincrement,
+      RegID text not null,
+      Payload text not null,
+      Attempts integer not null default 0,
+      NextAttempt datetime not null,
+      LastError text not null default '',
+      Created datetime not null default(datetime('now')));`,
+  `CREATE TABLE IF NOT EXISTS DeadLetters (
+      ID integer not null primary key,
+      RegID text not null,
+      Payload text not null,
+      Attempts integer not null,
+      LastError text not null,
+      Created datetime not null,
+      Died datetime not null default(datetime('now')));`,
+}
+
+var (
+  enqueueNotification *sql.Stmt
+  selectDueQueue      *sql.Stmt
+  deleteQueued        *sql.Stmt
+  rescheduleQueued    *sql.Stmt
+  insertDeadLetter    *sql.Stmt
+  selectDeadLetters   *sql.Stmt
+)
+
+/* A message for a single device awaiting (re)delivery. Payload is opaque to
+ * this package; the transmitter stores the JSON it wants to send. */
+type QueuedNotification struct {
+  ID          int64
+  RegID       string
+  Payload     string
+  Attempts    int
+  NextAttempt time.Time
+  LastError   string
+  Created     time.Time
+}
+
+/* A message that was given up on, and why. */
+type DeadLetter struct {
+  QueuedNotification
+  Died time.Time
+}
+
+func prepareQueue() {
+  var err error
+  enqueueNotification, err = db.Prepare(
+    `insert into OutboundQueue (RegID, Payload, NextAttempt, Created) values (?, ?, ?, ?)`)
+  if err != nil {
+    log.Error("db.package_init", "queue failed to prepare enqueueNotification", err)
+  }
+  selectDueQueue, err = db.Prepare(
+    `select ID, RegID, Payload, Attempts, NextAttempt, LastError, Created from OutboundQueue
+     where NextAttempt <= ? order by NextAttempt limit ?`)
+  if err != nil {
+    log.Error("db.package_init", "queue failed to prepare selectDueQueue", err)
+  }
+  deleteQueued, err = db.Prepare("delete from OutboundQueue where ID=?")
+  if err != nil {
+    log.Error("db.package_init", "queue failed to prepare deleteQueued", err)
+  }
+  rescheduleQueued, err = db.Prepare(
+    "update OutboundQueue set Attempts=Attempts+1, NextAttempt=?, LastError=? where ID=?")
+  if err != nil {
+    log.Error("db.package_init", "queue failed to prepare rescheduleQueued", err)
+  }
+  insertDeadLetter, err = db.Prepare(
+    `insert into DeadLetters (ID, RegID, Payload, Attempts, LastError, Created, Died)
+     select ID, RegID, Payload, Attempts+1, ?, Created, ? from OutboundQueue where ID=?`)
+  if err != nil {
+    log.Error("db.package_init", "queue failed to prepare insertDeadLetter", err)
+  }
+  selectDeadLetters, err = db.Prepare(
+    `select ID, RegID, Payload, Attempts, LastError, Created, Died from DeadLetters
+     order by Died desc limit ?`)
+  if err != nil {
+    log.Error("db.package_init", "queue failed to prepare selectDeadLetters", err)
+  }
+}
+
+/* Queues the payload for immediate delivery to each of the indicated
+ * devices. */
+func EnqueueNotification(regIds []string, payload string) error {
+  tx, err := db.Begin()
+  if err != nil {
+    log.Error("db.EnqueueNotification", "failed to start a transaction", err)
+    return err
+  }
+  now := time.Now()
+  for _, regId := range regIds {
+    if _, err = tx.Stmt(enqueueNotification).Exec(regId, payload, now, now); err != nil {
+      log.Error("db.EnqueueNotification", "failed queueing notification", err)
+      tx.Rollback()
+      return err
+    }
+  }
+  return tx.Commit()
+}
+
+/* Returns up to limit queued messages whose next attempt is due. */
+func DueNotifications(limit int) ([]QueuedNotification, error) {
+  due := make([]QueuedNotification, 0)
+  rows, err := selectDueQueue.Query(time.Now(), limit)
+  if err != nil {
+    log.Error("db.DueNotifications", "failed to fetch due notifications ", err)
+    return due, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var q QueuedNotification
+    err = rows.Scan(&q.ID, &q.RegID, &q.Payload, &q.Attempts, &q.NextAttempt, &q.LastError, &q.Created)
+    if err != nil {
+      log.Warn("db.DueNotifications", "failed to scan queue row ", err)
+      continue
+    }
+    due = append(due, q)
+  }
+  return due, nil
+}
+
+/* Removes a message from the queue, i.e. because it was delivered or because
+ * its device no longer exists. */
+func CompleteNotification(id int64) error {
+  _, err := deleteQueued.Exec(id)
+  if err != nil {
+    log.Warn("db.CompleteNotification", "failed deleting queued notification ", err)
+  }
+  return err
+}
+
+/* Records a failed attempt and schedules the next one. */
+func RetryNotification(id int64, next time.Time, reason string) error {
+  _, err := rescheduleQueued.Exec(next, reason, id)
+  if err != nil {
+    log.Warn("db.RetryNotification", "failed rescheduling queued notification ", err)
+  }
+  return err
+}
+
+/* Gives up on a message, moving it to the dead letter table. */
+func KillNotification(id int64, reason string) error {
+  tx, err := db.Begin()
+  if err != nil {
+    log.Error("db.KillNotification", "failed to start a transaction", err)
+    return err
+  }
+  if _, err = tx.Stmt(insertDeadLetter).Exec(reason, time.Now(), id); err != nil {
+    log.Error("db.KillNotification", "failed inserting dead letter", err)
+    tx.Rollback()
+    return err
+  }
+  if _, err = tx.Stmt(deleteQueued).Exec(id); err != nil {
+    log.Error("db.KillNotification", "failed deleting queued notification", err)
+    tx.Rollback()
+    return err
+  }
+  return tx.Commit()
+}
+
+/* Returns the most recent dead letters, newest first. */
+func GetDeadLetters(limit int) ([]DeadLetter, error) {
+  letters := make([]DeadLetter, 0)
+  rows, err := selectDeadLetters.Query(limit)
+  if err != nil {
+    log.Error("db.GetDeadLetters", "failed to fetch dead letters ", err)
+    return letters, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var d DeadLetter
+    err = rows.Scan(&d.ID, &d.RegID, &d.Payload, &d.Attempts, &d.LastError, &d.Created, &d.Died)
+    if err != nil {
+      log.Warn("db.GetDeadLetters", "failed to scan dead letter row ", err)
+      continue
+    }
+    letters = append(letters, d)
+  }
+  return letters, nil
+}
@@ -0,0 +1,136 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package db
+
+/*
+ * Keeps the database from growing forever: an hourly job purges events past
+ * their retention period, optionally archiving them first, and periodically
+ * vacuums the local SQLite file so the space is actually given back.
+ */
+
+import (
+  "compress/gzip"
+  "encoding/json"
+  "os"
+  "path/filepath"
+  "strconv"
+  "time"
+
+  "providence/config"
+  "providence/log"
+  "providence/types"
+)
+
+/* Appends the events to a new gzipped JSONL file, one event per line. */
+func archiveEvents(events []types.Event) error {
+  name := "events-" + time.Now().Format("20060102T150405.000000000") + ".jsonl.gz"
+  path := filepath.Join(config.Retention.ArchiveDirectory, name)
+  file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+  if err != nil {
+    log.Error("db.archive", "failed to create "+path, err)
+    return err
+  }
+  gz := gzip.NewWriter(file)
+  enc := json.NewEncoder(gz)
+  for _, event := range events {
+    if err = enc.Encode(event); err != nil {
+      break
+    }
+  }
+  if err == nil {
+    err = gz.Close()
+  }
+  if err == nil {
+    err = file.Sync()
+  }
+  file.Close()
+  if err != nil {
+    log.Error("db.archive", "failed writing "+path, err)
+    os.Remove(path)
+    return err
+  }
+  log.Status("db.archive", "archived "+strconv.Itoa(len(events))+" events to "+path)
+  return nil
+}
+
+func purgeEvents() {
+  var archive func([]types.Event) error
+  if config.Retention.ArchiveDirectory != "" {
+    archive = archiveEvents
+  }
+  for _, r := range []struct {
+    security  bool
+    retention string
+  }{
+    {false, config.Retention.MundaneEvents},
+    {true, config.Retention.AnomalousEvents},
+  } {
+    if r.retention == "" {
+      continue
+    }
+    d, _ := time.ParseDuration(r.retention) // validated by config
+    cutoff := time.Now().Add(-d)
+    n, err := store.PurgeEvents(r.security, cutoff, archive)
+    if err != nil {
+      log.Error("db.purger", "failed purging events before "+cutoff.Format(time.RFC3339), err)
+      continue
+    }
+    if n > 0 {
+      kind := "mundane"
+      if r.security {
+        kind = "security"
+      }
+      log.Status("db.purger", "purged "+strconv.Itoa(n)+" "+kind+" events before "+cutoff.Format(time.RFC3339))
+    }
+  }
+}
+
+/* Vacuums the local database. This rewrites the whole file, so it's slow
+ * and hard on flash storage; hence the (long) configured interval. */
+func vacuum() {
+  start := time.Now()
+  if _, err := db.Exec("VACUUM"); err != nil {
+    log.Error("db.vacuum", "vacuum failed", err)
+    return
+  }
+  log.Status("db.vacuum", "vacuumed "+config.General.DatabasePath+" in "+time.Since(start).String())
+}
+
+/* A goroutine that runs once an hour, purging expired events and vacuuming
+ * when due. */
+func startPurger() {
+  ticker := time.Tick(1 * time.Hour)
+  if config.General.Debug {
+    ticker = time.Tick(1 * time.Minute)
+  }
+  if dir := config.Retention.ArchiveDirectory; dir != "" {
+    if err := os.MkdirAll(dir, 0750); err != nil {
+      log.Error("db.purger", "can't create archive directory "+dir, err)
+    }
+  }
+  vacuumInterval, _ := time.ParseDuration(config.Retention.VacuumInterval)
+  lastVacuum := time.Now()
+  go func() {
+    for {
+      <-ticker
+      purgeEvents()
+      if vacuumInterval > 0 && time.Since(lastVacuum) >= vacuumInterval {
+        vacuum()
+        lastVacuum = time.Now()
+      }
+    }
+  }()
+}
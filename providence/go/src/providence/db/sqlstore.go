@@ -0,0 +1,314 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package db
+
+import (
+  "database/sql"
+  "strings"
+  "time"
+
+  "providence/log"
+  "providence/types"
+)
+
+/* Tables holding Store data, in the notation of dialect.ddl. */
+var (
+  eventsTable = `CREATE TABLE IF NOT EXISTS Events (
+      EventID text not null unique primary key,
+      SensorID text not null,
+      Trip {timestamp} not null,
+      Reset {timestamp},
+      IsAjar {boolean} not null default false,
+      IsAnomalous {boolean} not null default false,
+      IsPending {boolean} not null default false,
+      AckedBy text not null default '',
+      AckedAt {timestamp},
+      IsOffline {boolean} not null default false,
+      Source text not null default '',
+      IsTampered {boolean} not null default false,
+      Tamper text not null default '',
+      Timestamp {timestamp} not null default {now});`
+  regIdsTable = `CREATE TABLE IF NOT EXISTS RegIDs (
+      RegID text not null unique primary key,
+      Timestamp {timestamp} not null default {now});`
+  photosTables = []string{
+    `CREATE TABLE IF NOT EXISTS Photos (
+        Name text not null unique primary key,
+        EventID text not null,
+        Taken {timestamp} not null);`,
+    `CREATE INDEX IF NOT EXISTS PhotosByEvent ON Photos (EventID);`,
+  }
+)
+
+/* A Store backed by a database/sql connection; the same SQL serves both
+ * SQLite and PostgreSQL, modulo the dialect. */
+type sqlStore struct {
+  conn *sql.DB
+  d    dialect
+
+  storeEvent         *sql.Stmt
+  selectEvent        *sql.Stmt
+  selectRecentEvents *sql.Stmt
+  insertRegId        *sql.Stmt
+  updateRegId        *sql.Stmt
+  deleteRegId        *sql.Stmt
+  selectRegId        *sql.Stmt
+  insertPhoto        *sql.Stmt
+  purgePhotos        *sql.Stmt
+}
+
+/* Prepares statements against a connection whose schema is up to date. */
+func newSQLStore(conn *sql.DB, d dialect) (*sqlStore, error) {
+  s := &sqlStore{conn: conn, d: d}
+  var err error
+  prepare := func(stmt **sql.Stmt, name string, query string) {
+    if err != nil {
+      return
+    }
+    *stmt, err = conn.Prepare(d.rebind(query))
+    if err != nil {
+      log.Error("db.newSQLStore", d.name+" store failed to prepare "+name, err)
+    }
+  }
+
+  prepare(&s.storeEvent, "storeEvent",
+    `insert into events (`+eventColumns+`) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+     on conflict (EventID) do update set
+       SensorID=excluded.SensorID, Trip=excluded.Trip, Reset=excluded.Reset,
+       IsAjar=excluded.IsAjar, IsAnomalous=excluded.IsAnomalous, IsPending=excluded.IsPending,
+       AckedBy=excluded.AckedBy, AckedAt=excluded.AckedAt, IsOffline=excluded.IsOffline,
+       Source=excluded.Source, IsTampered=excluded.IsTampered, Tamper=excluded.Tamper,
+       Timestamp=excluded.Timestamp`)
+  prepare(&s.selectRecentEvents, "selectRecentEvents",
+    `select `+eventColumns+` from events
+     order by timestamp desc limit 10`)
+  prepare(&s.selectEvent, "selectEvent", `select `+eventColumns+` from events where EventID=?`)
+
+  prepare(&s.insertRegId, "insertRegId", "insert into RegIDs (RegID) values (?) on conflict do nothing")
+  prepare(&s.updateRegId, "updateRegId", "update RegIDs set RegID=? where RegID=?")
+  prepare(&s.deleteRegId, "deleteRegId", "delete from RegIDs where RegID=?")
+  prepare(&s.selectRegId, "selectRegId", "select RegID from RegIDs")
+
+  prepare(&s.insertPhoto, "insertPhoto",
+    "insert into Photos (Name, EventID, Taken) values (?, ?, ?) on conflict do nothing")
+  prepare(&s.purgePhotos, "purgePhotos", "delete from Photos where Taken < ?")
+
+  return s, err
+}
+
+func (s *sqlStore) StoreEvent(event types.Event) error {
+  res, err := s.storeEvent.Exec(event.EventID, event.SensorID, localTime(event.Trip), localTimePtr(event.Reset), event.IsAjar, event.IsAnomalous, event.IsPending, event.AckedBy, localTimePtr(event.AckedAt), event.IsOffline, event.Source,
+    event.IsTampered, event.Tamper)
+  if err != nil {
+    log.Error("db.StoreEvent", "failed inserting or updating event '"+event.EventID+"'", err)
+    return err
+  }
+  numRows, err := res.RowsAffected()
+  if numRows > 1 {
+    log.Warn("db.StoreEvent", "multiple rows affected by store operation for '"+event.EventID+"'")
+  }
+  if numRows < 1 {
+    log.Warn("db.StoreEvent", "success but 0 rows affected by store operation for '"+event.EventID+"'")
+  }
+  return nil
+}
+
+func (s *sqlStore) GetEvent(eventID string) (types.Event, error) {
+  rows, err := s.selectEvent.Query(eventID)
+  if err != nil {
+    log.Error("db.GetEvent", "failed to fetch event '"+eventID+"'", err)
+    return types.Event{}, err
+  }
+  defer rows.Close()
+
+  if !rows.Next() {
+    log.Debug("db.GetEvent", "no result found loading event for '"+eventID+"'")
+    return types.Event{}, ErrEventNotFound
+  }
+
+  event, err := scanEvent(rows)
+  if err != nil {
+    log.Error("db.GetEvent", "failed to scan event '"+eventID+"'", err)
+    return types.Event{}, err
+  }
+  return event, nil
+}
+
+func (s *sqlStore) GetRecentEvents() ([]types.Event, error) {
+  rows, err := s.selectRecentEvents.Query()
+  if err != nil {
+    log.Error("db.get_recents", "failed to fetch recent rows ", err)
+    return make([]types.Event, 0), err
+  }
+  defer rows.Close()
+
+  events := make([]types.Event, 0, 10)
+  for rows.Next() {
+    event, err := scanEvent(rows)
+    if err != nil {
+      log.Warn("db.get_recents", "failed to scan event row ", err)
+      continue
+    }
+    events = append(events, event)
+  }
+  return events, nil
+}
+
+func (s *sqlStore) AddRegId(regId string) error {
+  _, err := s.insertRegId.Exec(regId)
+  return err
+}
+
+/* To handle the case where the server sends us a canonicalization correction
+ * for a regID that isn't actually in the database, we first insert the old
+ * one (with the statement set to no-op if already present) and then execute
+ * the update. We do these in a transaction to avoid race conditions. */
+func (s *sqlStore) CanonicalizeRegId(regId string, canonical string) error {
+  tx, err := s.conn.Begin()
+  if err != nil {
+    return err
+  }
+  if _, err = tx.Stmt(s.insertRegId).Exec(regId); err == nil {
+    _, err = tx.Stmt(s.updateRegId).Exec(canonical, regId)
+  }
+  if err != nil {
+    tx.Rollback()
+    return err
+  }
+  return tx.Commit()
+}
+
+func (s *sqlStore) DeleteRegId(regId string) error {
+  _, err := s.deleteRegId.Exec(regId)
+  return err
+}
+
+func (s *sqlStore) GetRegIds() ([]string, error) {
+  regIds := make([]string, 0)
+  rows, err := s.selectRegId.Query()
+  if err != nil {
+    return regIds, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var regId string
+    rows.Scan(&regId)
+    regIds = append(regIds, regId)
+  }
+  return regIds, nil
+}
+
+func (s *sqlStore) AddPhoto(photo Photo) error {
+  _, err := s.insertPhoto.Exec(photo.Name, photo.EventID, localTime(photo.Taken))
+  if err != nil {
+    log.Error("db.AddPhoto", "failed recording photo "+photo.Name, err)
+  }
+  return err
+}
+
+/* Returns metadata for photos of the indicated events, by event ID, oldest
+ * first. */
+func (s *sqlStore) GetPhotos(eventIDs []string) (map[string][]Photo, error) {
+  photos := make(map[string][]Photo)
+  if len(eventIDs) == 0 {
+    return photos, nil
+  }
+  placeholders := make([]string, len(eventIDs))
+  args := make([]interface{}, len(eventIDs))
+  for i, id := range eventIDs {
+    placeholders[i] = "?"
+    args[i] = id
+  }
+  query := "select Name, EventID, Taken from Photos where EventID in (" +
+    strings.Join(placeholders, ", ") + ") order by Taken"
+  rows, err := s.conn.Query(s.d.rebind(query), args...)
+  if err != nil {
+    log.Error("db.GetPhotos", "failed to query photos", err)
+    return photos, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var p Photo
+    if err := rows.Scan(&p.Name, &p.EventID, &p.Taken); err != nil {
+      log.Warn("db.GetPhotos", "failed to scan photo row", err)
+      continue
+    }
+    photos[p.EventID] = append(photos[p.EventID], p)
+  }
+  return photos, nil
+}
+
+func (s *sqlStore) PurgePhotos(cutoff time.Time) error {
+  _, err := s.purgePhotos.Exec(localTime(cutoff))
+  if err != nil {
+    log.Error("db.PurgePhotos", "failed purging photo metadata", err)
+  }
+  return err
+}
+
+/* Matches security events: anomalous ones, and sensors going offline or
+ * being tampered with. They're kept as long as anomalous events, since
+ * someone is going to want to know when the alarm was cut off. */
+const securityEvents = "(IsAnomalous or IsOffline or IsTampered)"
+
+/* Deletes events that tripped before the cutoff, have since reset, and are
+ * (or aren't) security events, returning how many. If archive is non-nil, it
+ * is given the events first, and nothing is deleted unless it succeeds. */
+func (s *sqlStore) PurgeEvents(security bool, cutoff time.Time, archive func([]types.Event) error) (int, error) {
+  tx, err := s.conn.Begin()
+  if err != nil {
+    return 0, err
+  }
+  defer tx.Rollback()
+
+  // events still in progress are never purged, however old
+  where := " from events where " + securityEvents + " and Trip < ? and Reset is not null"
+  if !security {
+    where = " from events where not " + securityEvents + " and Trip < ? and Reset is not null"
+  }
+  rows, err := tx.Query(s.d.rebind("select "+eventColumns+where), localTime(cutoff))
+  if err != nil {
+    return 0, err
+  }
+  events := make([]types.Event, 0)
+  for rows.Next() {
+    event, err := scanEvent(rows)
+    if err != nil {
+      rows.Close()
+      return 0, err
+    }
+    events = append(events, event)
+  }
+  rows.Close()
+  if len(events) == 0 {
+    return 0, nil
+  }
+
+  if archive != nil {
+    if err = archive(events); err != nil {
+      return 0, err
+    }
+  }
+  res, err := tx.Exec(s.d.rebind("delete"+where), localTime(cutoff))
+  if err != nil {
+    return 0, err
+  }
+  if err = tx.Commit(); err != nil {
+    return 0, err
+  }
+  n, _ := res.RowsAffected()
+  return int(n), nil
+}
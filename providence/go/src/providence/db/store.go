@@ -0,0 +1,114 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package db
+
+/*
+ * Storage for the data several monitors may want to share: events, device
+ * registration IDs, and photo metadata. By default this lives in the local
+ * SQLite database alongside everything else; config.General.StoreDriver can
+ * point it at a central PostgreSQL database instead. Data that's inherently
+ * per-monitor (the notification queue, accounts, the audit log, the system
+ * mode) always stays in the local database.
+ */
+
+import (
+  "errors"
+  "strconv"
+  "strings"
+  "time"
+
+  "providence/types"
+)
+
+type Store interface {
+  StoreEvent(event types.Event) error
+  GetEvent(eventID string) (types.Event, error)
+  GetRecentEvents() ([]types.Event, error)
+  QueryEvents(filter EventFilter) ([]types.Event, string, error)
+  GetLatestEvents() (map[string]types.Event, error)
+  PurgeEvents(security bool, cutoff time.Time, archive func([]types.Event) error) (int, error)
+
+  AddRegId(regId string) error
+  CanonicalizeRegId(regId string, canonical string) error
+  DeleteRegId(regId string) error
+  GetRegIds() ([]string, error)
+
+  AddPhoto(photo Photo) error
+  GetPhotos(eventIDs []string) (map[string][]Photo, error)
+  PurgePhotos(cutoff time.Time) error
+}
+
+/* Metadata for a camera image captured for an event. Name is the file's name
+ * within config.Photo.Directory. */
+type Photo struct {
+  EventID string
+  Name    string
+  Taken   time.Time
+}
+
+var store Store
+
+var ErrEventNotFound = errors.New("no such event")
+
+/* The SQL differences between the databases we support. */
+type dialect struct {
+  name      string
+  timestamp string // column type for times
+  now       string // expression for the current time
+  boolean   string // column type for flags
+  numbered  bool   // placeholders are $1, $2, ... rather than ?
+  hasTable  string // query counting the tables named by its one argument
+}
+
+var (
+  sqliteDialect = dialect{"sqlite3", "datetime", "(datetime('now'))", "integer", false,
+    "select count(*) from sqlite_master where type = 'table' and name = ?"}
+  postgresDialect = dialect{"postgres", "timestamp with time zone", "now()", "boolean", true,
+    "select count(*) from information_schema.tables where table_schema = current_schema() and table_name = ?"}
+)
+
+/* Rewrites ?-style placeholders for databases that number them. Queries must
+ * not contain literal question marks. */
+func (d dialect) rebind(query string) string {
+  if !d.numbered {
+    return query
+  }
+  var buf strings.Builder
+  n := 0
+  for _, c := range query {
+    if c == '?' {
+      n++
+      buf.WriteString("$" + strconv.Itoa(n))
+    } else {
+      buf.WriteRune(c)
+    }
+  }
+  return buf.String()
+}
+
+/* Substitutes the dialect's types into a table definition, which uses
+ * {timestamp}, {now} and {boolean} in their place. */
+func (d dialect) ddl(stmt string) string {
+  return strings.NewReplacer("{timestamp}", d.timestamp, "{now}", d.now, "{boolean}", d.boolean).Replace(stmt)
+}
+
+func (d dialect) ddlAll(stmts []string) []string {
+  out := make([]string, len(stmts))
+  for i, stmt := range stmts {
+    out[i] = d.ddl(stmt)
+  }
+  return out
+}
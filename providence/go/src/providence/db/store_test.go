@@ -0,0 +1,420 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package db
+
+import (
+  "database/sql"
+  "errors"
+  "os"
+  "testing"
+  "time"
+
+  "providence/types"
+)
+
+/* Stands in for PostgreSQL using an in-memory SQLite database, so the
+ * PostgreSQL flavor of the Store's SQL -- numbered placeholders, boolean
+ * columns -- gets exercised without a server. Timestamps stay SQLite's,
+ * since the driver only parses those back into times. Set
+ * PROVIDENCE_TEST_POSTGRES to a connection URL to test against a real
+ * (scratch!) PostgreSQL database as well. */
+var postgresStandIn = dialect{"postgres stand-in", "timestamp", "CURRENT_TIMESTAMP", postgresDialect.boolean, postgresDialect.numbered,
+  sqliteDialect.hasTable}
+
+func memoryDB(t *testing.T) *sql.DB {
+  conn, err := sql.Open("sqlite3", ":memory:")
+  if err != nil {
+    t.Fatal(err)
+  }
+  // each connection to :memory: gets a database of its own
+  conn.SetMaxOpenConns(1)
+  t.Cleanup(func() { conn.Close() })
+  return conn
+}
+
+/* Runs the test against a fresh, empty Store of each kind. */
+func forEachStore(t *testing.T, test func(t *testing.T, s Store)) {
+  t.Run("sqlite", func(t *testing.T) {
+    conn := memoryDB(t)
+    if err := migrate(conn, sqliteDialect, sqliteMigrations, false); err != nil {
+      t.Fatal(err)
+    }
+    s, err := newSQLStore(conn, sqliteDialect)
+    if err != nil {
+      t.Fatal(err)
+    }
+    test(t, s)
+  })
+
+  t.Run("postgres stand-in", func(t *testing.T) {
+    conn := memoryDB(t)
+    tx, err := conn.Begin()
+    if err != nil {
+      t.Fatal(err)
+    }
+    stmts := append([]string{eventsTable, regIdsTable}, photosTables...)
+    if err = execAll(tx, postgresStandIn.ddlAll(stmts)...); err != nil {
+      t.Fatal(err)
+    }
+    if err = tx.Commit(); err != nil {
+      t.Fatal(err)
+    }
+    s, err := newSQLStore(conn, postgresStandIn)
+    if err != nil {
+      t.Fatal(err)
+    }
+    test(t, s)
+  })
+
+  url := os.Getenv("PROVIDENCE_TEST_POSTGRES")
+  if url == "" {
+    return
+  }
+  t.Run("postgres", func(t *testing.T) {
+    s, err := openPostgres(url, false)
+    if err != nil {
+      t.Fatal(err)
+    }
+    for _, table := range []string{"Events", "RegIDs", "Photos"} {
+      if _, err := s.conn.Exec("delete from " + table); err != nil {
+        t.Fatal(err)
+      }
+    }
+    t.Cleanup(func() { s.conn.Close() })
+    test(t, s)
+  })
+}
+
+var testTime = time.Date(2013, 6, 1, 12, 0, 0, 0, time.UTC)
+
+/* An event tripped the indicated number of minutes after testTime. */
+func testEvent(id string, sensorID string, minutes int) types.Event {
+  return types.Event{EventID: id, SensorID: sensorID, Trip: testTime.Add(time.Duration(minutes) * time.Minute)}
+}
+
+func at(minutes int) *time.Time {
+  t := testTime.Add(time.Duration(minutes) * time.Minute)
+  return &t
+}
+
+func sameTime(a, b *time.Time) bool {
+  if a == nil || b == nil {
+    return a == b
+  }
+  return a.Equal(*b)
+}
+
+func checkEvent(t *testing.T, got types.Event, want types.Event) {
+  t.Helper()
+  if got.EventID != want.EventID || got.SensorID != want.SensorID || !got.Trip.Equal(want.Trip) ||
+    !sameTime(got.Reset, want.Reset) || got.IsAjar != want.IsAjar || got.IsAnomalous != want.IsAnomalous ||
+    got.IsPending != want.IsPending || got.AckedBy != want.AckedBy || !sameTime(got.AckedAt, want.AckedAt) ||
+    got.IsOffline != want.IsOffline || got.Source != want.Source || got.IsTampered != want.IsTampered ||
+    got.Tamper != want.Tamper {
+    t.Errorf("got event %+v, want %+v", got, want)
+  }
+}
+
+func TestStoreEvent(t *testing.T) {
+  forEachStore(t, func(t *testing.T, s Store) {
+    plain := testEvent("plain", "door", 0)
+    full := types.Event{
+      EventID:     "full",
+      SensorID:    "window",
+      Trip:        testTime,
+      Reset:       at(5),
+      IsAjar:      true,
+      IsAnomalous: true,
+      IsPending:   true,
+      AckedBy:     "alice",
+      AckedAt:     at(1),
+      IsOffline:   true,
+      Source:      "hub",
+      IsTampered:  true,
+      Tamper:      types.TAMPER_CUT,
+    }
+    for _, ev := range []types.Event{plain, full} {
+      if err := s.StoreEvent(ev); err != nil {
+        t.Fatal(err)
+      }
+      got, err := s.GetEvent(ev.EventID)
+      if err != nil {
+        t.Fatal(err)
+      }
+      checkEvent(t, got, ev)
+    }
+
+    // storing it again updates it in place
+    plain.Reset = at(2)
+    plain.AckedBy = "bob"
+    plain.AckedAt = at(1)
+    if err := s.StoreEvent(plain); err != nil {
+      t.Fatal(err)
+    }
+    got, err := s.GetEvent(plain.EventID)
+    if err != nil {
+      t.Fatal(err)
+    }
+    checkEvent(t, got, plain)
+
+    recent, err := s.GetRecentEvents()
+    if err != nil {
+      t.Fatal(err)
+    }
+    if len(recent) != 2 {
+      t.Errorf("got %d recent events, want 2", len(recent))
+    }
+
+    if _, err := s.GetEvent("no-such-event"); err != ErrEventNotFound {
+      t.Errorf("got error %v for a missing event, want ErrEventNotFound", err)
+    }
+  })
+}
+
+func TestQueryEvents(t *testing.T) {
+  // events are stored in server-local time; make sure that isn't UTC, and
+  // query from a zone that's neither
+  local, elsewhere := time.FixedZone("UTC-5", -5*3600), time.FixedZone("UTC+9", 9*3600)
+  defer func(saved *time.Location) { time.Local = saved }(time.Local)
+  time.Local = local
+
+  forEachStore(t, func(t *testing.T, s Store) {
+    events := []types.Event{
+      testEvent("a", "door", 0),
+      testEvent("b", "window", 1),
+      testEvent("c", "door", 2),
+      testEvent("d", "window", 3),
+      testEvent("e", "door", 4),
+    }
+    events[2].IsAnomalous = true
+    for _, ev := range events {
+      if err := s.StoreEvent(ev); err != nil {
+        t.Fatal(err)
+      }
+    }
+    yes := true
+
+    for _, tc := range []struct {
+      name   string
+      filter EventFilter
+      want   []string
+    }{
+      {"all", EventFilter{}, []string{"e", "d", "c", "b", "a"}},
+      {"sensor", EventFilter{SensorIDs: []string{"window"}}, []string{"d", "b"}},
+      {"since", EventFilter{Since: testTime.Add(3 * time.Minute)}, []string{"e", "d"}},
+      {"until", EventFilter{Until: testTime.Add(1 * time.Minute)}, []string{"a"}},
+      {"anomalous", EventFilter{Anomalous: &yes}, []string{"c"}},
+      {"combined", EventFilter{SensorIDs: []string{"door"}, Since: testTime.Add(1 * time.Minute)}, []string{"e", "c"}},
+      {"since, other zone", EventFilter{Since: testTime.Add(3 * time.Minute).In(elsewhere)}, []string{"e", "d"}},
+      {"until, other zone", EventFilter{Until: testTime.Add(1 * time.Minute).In(elsewhere)}, []string{"a"}},
+      {"range, local zone", EventFilter{Since: testTime.Add(1 * time.Minute).In(local), Until: testTime.Add(3 * time.Minute).In(local)}, []string{"c", "b"}},
+    } {
+      got, next, err := s.QueryEvents(tc.filter)
+      if err != nil {
+        t.Fatalf("%s: %v", tc.name, err)
+      }
+      if next != "" {
+        t.Errorf("%s: got a next cursor for a single page", tc.name)
+      }
+      if ids := eventIDs(got); !equal(ids, tc.want) {
+        t.Errorf("%s: got %v, want %v", tc.name, ids, tc.want)
+      }
+    }
+
+    // walk through in pages of two
+    all := make([]string, 0)
+    filter := EventFilter{Limit: 2}
+    for pages := 0; ; pages++ {
+      if pages > 3 {
+        t.Fatal("too many pages")
+      }
+      page, next, err := s.QueryEvents(filter)
+      if err != nil {
+        t.Fatal(err)
+      }
+      all = append(all, eventIDs(page)...)
+      if next == "" {
+        break
+      }
+      filter.Cursor = next
+    }
+    if want := []string{"e", "d", "c", "b", "a"}; !equal(all, want) {
+      t.Errorf("paged through %v, want %v", all, want)
+    }
+
+    for _, cursor := range []string{"!!", "bm9uc2Vuc2U="} {
+      if _, _, err := s.QueryEvents(EventFilter{Cursor: cursor}); err != ErrBadCursor {
+        t.Errorf("got error %v for bogus cursor %q, want ErrBadCursor", err, cursor)
+      }
+    }
+
+    latest, err := s.GetLatestEvents()
+    if err != nil {
+      t.Fatal(err)
+    }
+    if len(latest) != 2 || latest["door"].EventID != "e" || latest["window"].EventID != "d" {
+      t.Errorf("got latest events %v, want e for door and d for window", latest)
+    }
+  })
+}
+
+func eventIDs(events []types.Event) []string {
+  ids := make([]string, len(events))
+  for i, ev := range events {
+    ids[i] = ev.EventID
+  }
+  return ids
+}
+
+func equal(a, b []string) bool {
+  if len(a) != len(b) {
+    return false
+  }
+  for i := range a {
+    if a[i] != b[i] {
+      return false
+    }
+  }
+  return true
+}
+
+func TestRegIds(t *testing.T) {
+  forEachStore(t, func(t *testing.T, s Store) {
+    for _, id := range []string{"one", "two", "one"} {
+      if err := s.AddRegId(id); err != nil {
+        t.Fatal(err)
+      }
+    }
+    if err := s.CanonicalizeRegId("two", "deux"); err != nil {
+      t.Fatal(err)
+    }
+    // one we've never seen is added, then canonicalized
+    if err := s.CanonicalizeRegId("three", "trois"); err != nil {
+      t.Fatal(err)
+    }
+    if err := s.DeleteRegId("one"); err != nil {
+      t.Fatal(err)
+    }
+    got, err := s.GetRegIds()
+    if err != nil {
+      t.Fatal(err)
+    }
+    have := make(map[string]bool)
+    for _, id := range got {
+      have[id] = true
+    }
+    if len(got) != 2 || !have["deux"] || !have["trois"] {
+      t.Errorf("got regIds %v, want deux and trois", got)
+    }
+  })
+}
+
+func TestPhotos(t *testing.T) {
+  forEachStore(t, func(t *testing.T, s Store) {
+    for _, p := range []Photo{
+      {Name: "e1-b.jpg", EventID: "e1", Taken: testTime.Add(2 * time.Second)},
+      {Name: "e1-a.jpg", EventID: "e1", Taken: testTime.Add(1 * time.Second)},
+      {Name: "e2-a.jpg", EventID: "e2", Taken: testTime.Add(time.Hour)},
+    } {
+      if err := s.AddPhoto(p); err != nil {
+        t.Fatal(err)
+      }
+    }
+    photos, err := s.GetPhotos([]string{"e1", "e2", "e3"})
+    if err != nil {
+      t.Fatal(err)
+    }
+    if len(photos["e1"]) != 2 || photos["e1"][0].Name != "e1-a.jpg" || len(photos["e2"]) != 1 {
+      t.Errorf("got photos %v, want e1's two oldest first and e2's one", photos)
+    }
+
+    if err := s.PurgePhotos(testTime.Add(time.Minute)); err != nil {
+      t.Fatal(err)
+    }
+    photos, err = s.GetPhotos([]string{"e1", "e2"})
+    if err != nil {
+      t.Fatal(err)
+    }
+    if len(photos["e1"]) != 0 || len(photos["e2"]) != 1 {
+      t.Errorf("after purge got photos %v, want only e2's", photos)
+    }
+  })
+}
+
+func TestPurgeEvents(t *testing.T) {
+  forEachStore(t, func(t *testing.T, s Store) {
+    old := testEvent("old", "door", 0)
+    old.Reset = at(1)
+    open := testEvent("open", "door", 0) // never reset
+    recent := testEvent("recent", "door", 120)
+    recent.Reset = at(121)
+    anomalous := testEvent("anomalous", "door", 0)
+    anomalous.IsAnomalous = true
+    anomalous.Reset = at(1)
+    offline := types.Event{EventID: "offline", Trip: testTime, Reset: at(1), IsOffline: true, Source: "hub"}
+    tampered := testEvent("tampered", "door", 0)
+    tampered.IsTampered = true
+    tampered.Tamper = types.TAMPER_SWITCH
+    tampered.Reset = at(1)
+    for _, ev := range []types.Event{old, open, recent, anomalous, offline, tampered} {
+      if err := s.StoreEvent(ev); err != nil {
+        t.Fatal(err)
+      }
+    }
+    cutoff := testTime.Add(time.Hour)
+
+    // nothing is deleted if archiving fails
+    failed := errors.New("disk full")
+    n, err := s.PurgeEvents(false, cutoff, func([]types.Event) error { return failed })
+    if err != failed || n != 0 {
+      t.Errorf("purge with failing archive returned %d, %v", n, err)
+    }
+    if _, err := s.GetEvent("old"); err != nil {
+      t.Error("event deleted despite failed archive")
+    }
+
+    var archived []types.Event
+    archive := func(events []types.Event) error {
+      archived = append(archived, events...)
+      return nil
+    }
+    n, err = s.PurgeEvents(false, cutoff, archive)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if ids := eventIDs(archived); n != 1 || !equal(ids, []string{"old"}) {
+      t.Errorf("mundane purge removed %d and archived %v, want just old", n, ids)
+    }
+
+    archived = nil
+    n, err = s.PurgeEvents(true, cutoff, archive)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if n != 3 || len(archived) != 3 {
+      t.Errorf("security purge removed %d and archived %v, want anomalous, offline and tampered", n, eventIDs(archived))
+    }
+
+    for id, kept := range map[string]bool{"old": false, "open": true, "recent": true, "anomalous": false, "offline": false, "tampered": false} {
+      _, err := s.GetEvent(id)
+      if kept && err != nil {
+        t.Errorf("%s was purged", id)
+      } else if !kept && err != ErrEventNotFound {
+        t.Errorf("%s was kept", id)
+      }
+    }
+  })
+}
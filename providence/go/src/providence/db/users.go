@@ -0,0 +1,452 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package db
+
+/*
+ * Local user accounts, for when Google sign-in isn't wanted or the WAN is
+ * down. Passwords are stored as bcrypt hashes. Browser sessions and API
+ * tokens are random bearer secrets; only their SHA-256 hashes are stored, so
+ * a copy of the database doesn't hand out working credentials.
+ */
+
+import (
+  "crypto/rand"
+  "crypto/sha256"
+  "database/sql"
+  "encoding/hex"
+  "errors"
+  "strings"
+  "time"
+
+  "golang.org/x/crypto/bcrypt"
+
+  "providence/log"
+)
+
+var userTables = []string{
+  `CREATE TABLE IF NOT EXISTS Users (
+      Username text not null unique primary key,
+      PasswordHash text not null,
+      Created datetime not null default(datetime('now')));`,
+  `CREATE TABLE IF NOT EXISTS Sessions (
+      SessionHash text not null unique primary key,
+      Username text not null,
+      Expires datetime not null);`,
+  `CREATE TABLE IF NOT EXISTS APITokens (
+      TokenHash text not null unique primary key,
+      Name text not null,
+      Username text not null,
+      Scopes text not null default '',
+      Created datetime not null,
+      LastUsed datetime);`,
+  `CREATE TABLE IF NOT EXISTS Roles (
+      Username text not null unique primary key,
+      Role text not null);`,
+}
+
+var (
+  insertUser       *sql.Stmt
+  updatePassword   *sql.Stmt
+  selectPassword   *sql.Stmt
+  deleteUser       *sql.Stmt
+  selectUsers      *sql.Stmt
+  insertSession    *sql.Stmt
+  selectSession    *sql.Stmt
+  deleteSession    *sql.Stmt
+  purgeSessions    *sql.Stmt
+  insertAPIToken   *sql.Stmt
+  selectAPIToken   *sql.Stmt
+  touchAPIToken    *sql.Stmt
+  selectAPITokens  *sql.Stmt
+  deleteAPIToken   *sql.Stmt
+  deleteUserTokens *sql.Stmt
+  upsertRole       *sql.Stmt
+  selectRole       *sql.Stmt
+  selectRoles      *sql.Stmt
+  deleteRole       *sql.Stmt
+)
+
+var ErrBadCredentials = errors.New("bad credentials")
+
+/* A long-lived credential for scripts. ID is a prefix of the token's hash,
+ * enough to name it when listing or revoking without exposing the token. */
+type APIToken struct {
+  ID       string
+  Name     string
+  Username string
+  Scopes   []string
+  Created  time.Time
+  LastUsed *time.Time
+}
+
+func prepareUsers() {
+  var err error
+  insertUser, err = db.Prepare("insert into Users (Username, PasswordHash) values (?, ?)")
+  if err != nil {
+    log.Error("db.package_init", "users failed to prepare insertUser", err)
+  }
+  updatePassword, err = db.Prepare("update Users set PasswordHash=? where Username=?")
+  if err != nil {
+    log.Error("db.package_init", "users failed to prepare updatePassword", err)
+  }
+  selectPassword, err = db.Prepare("select PasswordHash from Users where Username=?")
+  if err != nil {
+    log.Error("db.package_init", "users failed to prepare selectPassword", err)
+  }
+  deleteUser, err = db.Prepare("delete from Users where Username=?")
+  if err != nil {
+    log.Error("db.package_init", "users failed to prepare deleteUser", err)
+  }
+  selectUsers, err = db.Prepare("select Username from Users order by Username")
+  if err != nil {
+    log.Error("db.package_init", "users failed to prepare selectUsers", err)
+  }
+  insertSession, err = db.Prepare("insert into Sessions (SessionHash, Username, Expires) values (?, ?, ?)")
+  if err != nil {
+    log.Error("db.package_init", "users failed to prepare insertSession", err)
+  }
+  selectSession, err = db.Prepare("select Username from Sessions where SessionHash=? and Expires > ?")
+  if err != nil {
+    log.Error("db.package_init", "users failed to prepare selectSession", err)
+  }
+  deleteSession, err = db.Prepare("delete from Sessions where SessionHash=?")
+  if err != nil {
+    log.Error("db.package_init", "users failed to prepare deleteSession", err)
+  }
+  purgeSessions, err = db.Prepare("delete from Sessions where Expires <= ? or Username=?")
+  if err != nil {
+    log.Error("db.package_init", "users failed to prepare purgeSessions", err)
+  }
+  insertAPIToken, err = db.Prepare(
+    "insert into APITokens (TokenHash, Name, Username, Scopes, Created) values (?, ?, ?, ?, ?)")
+  if err != nil {
+    log.Error("db.package_init", "users failed to prepare insertAPIToken", err)
+  }
+  selectAPIToken, err = db.Prepare(
+    `select APITokens.Username, Scopes from APITokens
+     join Users on Users.Username = APITokens.Username where TokenHash=?`)
+  if err != nil {
+    log.Error("db.package_init", "users failed to prepare selectAPIToken", err)
+  }
+  touchAPIToken, err = db.Prepare("update APITokens set LastUsed=? where TokenHash=?")
+  if err != nil {
+    log.Error("db.package_init", "users failed to prepare touchAPIToken", err)
+  }
+  selectAPITokens, err = db.Prepare(
+    "select TokenHash, Name, Username, Scopes, Created, LastUsed from APITokens order by Username, Created")
+  if err != nil {
+    log.Error("db.package_init", "users failed to prepare selectAPITokens", err)
+  }
+  deleteAPIToken, err = db.Prepare("delete from APITokens where TokenHash like ?")
+  if err != nil {
+    log.Error("db.package_init", "users failed to prepare deleteAPIToken", err)
+  }
+  deleteUserTokens, err = db.Prepare("delete from APITokens where Username=?")
+  if err != nil {
+    log.Error("db.package_init", "users failed to prepare deleteUserTokens", err)
+  }
+  upsertRole, err = db.Prepare("insert or replace into Roles (Username, Role) values (?, ?)")
+  if err != nil {
+    log.Error("db.package_init", "users failed to prepare upsertRole", err)
+  }
+  selectRole, err = db.Prepare("select Role from Roles where Username=?")
+  if err != nil {
+    log.Error("db.package_init", "users failed to prepare selectRole", err)
+  }
+  selectRoles, err = db.Prepare("select Username, Role from Roles order by Username")
+  if err != nil {
+    log.Error("db.package_init", "users failed to prepare selectRoles", err)
+  }
+  deleteRole, err = db.Prepare("delete from Roles where Username=?")
+  if err != nil {
+    log.Error("db.package_init", "users failed to prepare deleteRole", err)
+  }
+}
+
+/* Returns a new random secret, and the hash under which it is stored. */
+func newSecret() (string, string, error) {
+  buf := make([]byte, 32)
+  if _, err := rand.Read(buf); err != nil {
+    return "", "", err
+  }
+  secret := hex.EncodeToString(buf)
+  return secret, hashSecret(secret), nil
+}
+
+func hashSecret(secret string) string {
+  sum := sha256.Sum256([]byte(secret))
+  return hex.EncodeToString(sum[:])
+}
+
+func AddUser(username string, password string) error {
+  if username == "" || password == "" {
+    return errors.New("username and password are required")
+  }
+  hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+  if err != nil {
+    log.Error("db.AddUser", "failed to hash password", err)
+    return err
+  }
+  if _, err = insertUser.Exec(username, string(hash)); err != nil {
+    log.Error("db.AddUser", "failed to add user '"+username+"'", err)
+    return err
+  }
+  log.Status("db.AddUser", "added user '"+username+"'")
+  return nil
+}
+
+/* Changes a user's password, and signs out all of their browser sessions. */
+func SetPassword(username string, password string) error {
+  if password == "" {
+    return errors.New("password is required")
+  }
+  hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+  if err != nil {
+    log.Error("db.SetPassword", "failed to hash password", err)
+    return err
+  }
+  res, err := updatePassword.Exec(string(hash), username)
+  if err != nil {
+    log.Error("db.SetPassword", "failed to update password for '"+username+"'", err)
+    return err
+  }
+  if n, _ := res.RowsAffected(); n == 0 {
+    return errors.New("no such user '" + username + "'")
+  }
+  purgeSessions.Exec(time.Now(), username)
+  return nil
+}
+
+/* Removes a user, along with their sessions and API tokens. */
+func DeleteUser(username string) error {
+  res, err := deleteUser.Exec(username)
+  if err != nil {
+    log.Error("db.DeleteUser", "failed to delete '"+username+"'", err)
+    return err
+  }
+  if n, _ := res.RowsAffected(); n == 0 {
+    return errors.New("no such user '" + username + "'")
+  }
+  purgeSessions.Exec(time.Now(), username)
+  deleteUserTokens.Exec(username)
+  deleteRole.Exec(username)
+  return nil
+}
+
+func GetUsers() ([]string, error) {
+  users := make([]string, 0)
+  rows, err := selectUsers.Query()
+  if err != nil {
+    log.Error("db.GetUsers", "failed to query users", err)
+    return users, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var username string
+    if err := rows.Scan(&username); err != nil {
+      log.Warn("db.GetUsers", "failed to scan user row", err)
+      continue
+    }
+    users = append(users, username)
+  }
+  return users, nil
+}
+
+/* Returns nil if the password is correct for the user, ErrBadCredentials if
+ * the user doesn't exist or the password is wrong, or some other error. */
+func CheckPassword(username string, password string) error {
+  var hash string
+  err := selectPassword.QueryRow(username).Scan(&hash)
+  if err == sql.ErrNoRows {
+    return ErrBadCredentials
+  }
+  if err != nil {
+    log.Error("db.CheckPassword", "failed to look up '"+username+"'", err)
+    return err
+  }
+  if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+    return ErrBadCredentials
+  }
+  return nil
+}
+
+/* Starts a browser session for the user, returning its secret. */
+func CreateSession(username string, lifetime time.Duration) (string, error) {
+  secret, hash, err := newSecret()
+  if err != nil {
+    log.Error("db.CreateSession", "failed to generate session ID", err)
+    return "", err
+  }
+  now := time.Now()
+  purgeSessions.Exec(now, "")
+  if _, err = insertSession.Exec(hash, username, now.Add(lifetime)); err != nil {
+    log.Error("db.CreateSession", "failed to store session for '"+username+"'", err)
+    return "", err
+  }
+  return secret, nil
+}
+
+/* Returns the user a live session belongs to, or ErrBadCredentials. */
+func GetSession(secret string) (string, error) {
+  var username string
+  err := selectSession.QueryRow(hashSecret(secret), time.Now()).Scan(&username)
+  if err == sql.ErrNoRows {
+    return "", ErrBadCredentials
+  }
+  if err != nil {
+    log.Error("db.GetSession", "failed to look up session", err)
+    return "", err
+  }
+  return username, nil
+}
+
+func DeleteSession(secret string) error {
+  _, err := deleteSession.Exec(hashSecret(secret))
+  if err != nil {
+    log.Error("db.DeleteSession", "failed to delete session", err)
+  }
+  return err
+}
+
+/* Issues a new API token for the user, returning its secret. The secret is
+ * not recoverable afterward. */
+func CreateAPIToken(username string, name string, scopes []string) (string, error) {
+  var exists string
+  if err := selectPassword.QueryRow(username).Scan(&exists); err != nil {
+    return "", errors.New("no such user '" + username + "'")
+  }
+  secret, hash, err := newSecret()
+  if err != nil {
+    log.Error("db.CreateAPIToken", "failed to generate token", err)
+    return "", err
+  }
+  _, err = insertAPIToken.Exec(hash, name, username, strings.Join(scopes, ","), time.Now())
+  if err != nil {
+    log.Error("db.CreateAPIToken", "failed to store token for '"+username+"'", err)
+    return "", err
+  }
+  log.Status("db.CreateAPIToken", "issued token '"+name+"' to '"+username+"'")
+  return secret, nil
+}
+
+/* Returns the user and scopes for an API token, or ErrBadCredentials. */
+func CheckAPIToken(secret string) (string, []string, error) {
+  var username, scopes string
+  hash := hashSecret(secret)
+  err := selectAPIToken.QueryRow(hash).Scan(&username, &scopes)
+  if err == sql.ErrNoRows {
+    return "", nil, ErrBadCredentials
+  }
+  if err != nil {
+    log.Error("db.CheckAPIToken", "failed to look up token", err)
+    return "", nil, err
+  }
+  touchAPIToken.Exec(time.Now(), hash)
+  return username, splitScopes(scopes), nil
+}
+
+func splitScopes(scopes string) []string {
+  if scopes == "" {
+    return []string{}
+  }
+  return strings.Split(scopes, ",")
+}
+
+func GetAPITokens() ([]APIToken, error) {
+  tokens := make([]APIToken, 0)
+  rows, err := selectAPITokens.Query()
+  if err != nil {
+    log.Error("db.GetAPITokens", "failed to query tokens", err)
+    return tokens, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var t APIToken
+    var hash, scopes string
+    if err := rows.Scan(&hash, &t.Name, &t.Username, &scopes, &t.Created, &t.LastUsed); err != nil {
+      log.Warn("db.GetAPITokens", "failed to scan token row", err)
+      continue
+    }
+    t.ID = hash[:12]
+    t.Scopes = splitScopes(scopes)
+    tokens = append(tokens, t)
+  }
+  return tokens, nil
+}
+
+/* Revokes the token whose ID (as reported by GetAPITokens) is given. */
+func RevokeAPIToken(id string) error {
+  if len(id) < 12 || strings.ContainsAny(id, "%_") {
+    return errors.New("bogus token ID '" + id + "'")
+  }
+  res, err := deleteAPIToken.Exec(id + "%")
+  if err != nil {
+    log.Error("db.RevokeAPIToken", "failed to revoke '"+id+"'", err)
+    return err
+  }
+  if n, _ := res.RowsAffected(); n == 0 {
+    return errors.New("no such token '" + id + "'")
+  }
+  return nil
+}
+
+/* Assigns a role to a user, who may be a local user or known by email from
+ * an identity provider. An empty role removes the assignment. Roles are
+ * opaque here; the server package decides what they permit. */
+func SetRole(username string, role string) error {
+  var err error
+  if role == "" {
+    _, err = deleteRole.Exec(username)
+  } else {
+    _, err = upsertRole.Exec(username, role)
+  }
+  if err != nil {
+    log.Error("db.SetRole", "failed to set role for '"+username+"'", err)
+  }
+  return err
+}
+
+/* Returns the user's role, or "" if none is assigned in the database. */
+func GetRole(username string) (string, error) {
+  var role string
+  err := selectRole.QueryRow(username).Scan(&role)
+  if err == sql.ErrNoRows {
+    return "", nil
+  }
+  if err != nil {
+    log.Error("db.GetRole", "failed to look up role for '"+username+"'", err)
+  }
+  return role, err
+}
+
+func GetRoles() (map[string]string, error) {
+  roles := make(map[string]string)
+  rows, err := selectRoles.Query()
+  if err != nil {
+    log.Error("db.GetRoles", "failed to query roles", err)
+    return roles, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var username, role string
+    if err := rows.Scan(&username, &role); err != nil {
+      log.Warn("db.GetRoles", "failed to scan role row", err)
+      continue
+    }
+    roles[username] = role
+  }
+  return roles, nil
+}
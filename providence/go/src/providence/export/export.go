@@ -0,0 +1,209 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package export
+
+/*
+ * Dumps event history in formats other tools understand -- CSV for
+ * spreadsheets, JSONL for scripts and for moving to new hardware, and an
+ * iCalendar feed of anomalous events -- and reads the CSV & JSONL forms back
+ * in, merging with whatever is already stored.
+ */
+
+import (
+  "errors"
+  "io"
+  "strings"
+
+  "providence/config"
+  "providence/db"
+  "providence/log"
+  "providence/types"
+)
+
+const (
+  FORMAT_CSV   = "csv"
+  FORMAT_JSONL = "jsonl"
+  FORMAT_ICAL  = "ical"
+)
+
+/* One exported event; Photos holds file names within config.Photo.Directory,
+ * if they were asked for. */
+type Record struct {
+  types.Event
+  Photos []string `json:",omitempty"`
+}
+
+/* Returns the MIME type and file extension for a format. */
+func ContentType(format string) (string, string, error) {
+  switch format {
+  case FORMAT_CSV:
+    return "text/csv", "csv", nil
+  case FORMAT_JSONL:
+    return "application/x-ndjson", "jsonl", nil
+  case FORMAT_ICAL:
+    return "text/calendar", "ics", nil
+  }
+  return "", "", errors.New("unknown export format '" + format + "'")
+}
+
+type writer interface {
+  write(r Record) error
+  close() error
+}
+
+/* Writes every event matching the filter (ignoring its Cursor and Limit) to
+ * out in the indicated format, newest first. iCalendar
+ * output only ever includes anomalous events. */
+func Write(out io.Writer, format string, filter db.EventFilter, withPhotos bool) (int, error) {
+  var w writer
+  switch format {
+  case FORMAT_CSV:
+    w = newCSVWriter(out)
+  case FORMAT_JSONL:
+    w = newJSONLWriter(out)
+  case FORMAT_ICAL:
+    w = newICalWriter(out)
+    anomalous := true
+    filter.Anomalous = &anomalous
+  default:
+    return 0, errors.New("unknown export format '" + format + "'")
+  }
+
+  count := 0
+  filter.Cursor = ""
+  filter.Limit = db.MAX_EVENT_LIMIT
+  for {
+    events, next, err := db.QueryEvents(filter)
+    if err != nil {
+      return count, err
+    }
+    photos := make(map[string][]db.Photo)
+    if withPhotos {
+      ids := make([]string, len(events))
+      for i, ev := range events {
+        ids[i] = ev.EventID
+      }
+      if photos, err = db.GetPhotos(ids); err != nil {
+        return count, err
+      }
+    }
+    for _, ev := range events {
+      r := Record{Event: ev}
+      for _, p := range photos[ev.EventID] {
+        r.Photos = append(r.Photos, p.Name)
+      }
+      if err = w.write(r); err != nil {
+        return count, err
+      }
+      count++
+    }
+    if next == "" {
+      break
+    }
+    filter.Cursor = next
+  }
+  return count, w.close()
+}
+
+/* Stores each record read from in, returning how many were new and how many
+ * merged into events already present. */
+func Read(in io.Reader, format string) (int, int, error) {
+  var next func() (Record, error)
+  switch format {
+  case FORMAT_CSV:
+    r, err := newCSVReader(in)
+    if err != nil {
+      return 0, 0, err
+    }
+    next = r.read
+  case FORMAT_JSONL:
+    next = newJSONLReader(in).read
+  default:
+    return 0, 0, errors.New("can't import format '" + format + "'")
+  }
+
+  added, merged := 0, 0
+  for {
+    r, err := next()
+    if err == io.EOF {
+      return added, merged, nil
+    }
+    if err != nil {
+      return added, merged, err
+    }
+    // only a whole sensor hub going offline has no sensor
+    hubOffline := r.IsOffline && r.Source != "" && r.SensorID == ""
+    if r.EventID == "" || (r.SensorID == "" && !hubOffline) || r.Trip.IsZero() {
+      return added, merged, errors.New("record is missing EventID, SensorID or Trip")
+    }
+    if _, ok := types.Sensors[r.SensorID]; !ok && !hubOffline {
+      log.Warn("export.Read", "importing event '"+r.EventID+"' for unknown sensor '"+r.SensorID+"'")
+    }
+
+    existing, err := db.GetEvent(r.EventID)
+    switch err {
+    case nil:
+      r.Event = merge(existing, r.Event)
+      merged++
+    case db.ErrEventNotFound:
+      added++
+    default:
+      return added, merged, err
+    }
+    if err = db.StoreEvent(r.Event); err != nil {
+      return added, merged, err
+    }
+    for _, name := range r.Photos {
+      if strings.ContainsAny(name, "/\\") {
+        log.Warn("export.Read", "skipping bogus photo name '"+name+"'")
+        continue
+      }
+      db.AddPhoto(db.Photo{EventID: r.EventID, Name: name, Taken: r.Trip})
+    }
+  }
+}
+
+/* Combines an imported event with the stored one having the same ID. Facts
+ * only ever get added to an event -- it resets, gets flagged, gets
+ * acknowledged -- so keep whatever either copy knows. */
+func merge(stored types.Event, imported types.Event) types.Event {
+  ev := stored
+  if ev.Reset == nil {
+    ev.Reset = imported.Reset
+  }
+  ev.IsAjar = ev.IsAjar || imported.IsAjar
+  ev.IsAnomalous = ev.IsAnomalous || imported.IsAnomalous
+  ev.IsOffline = ev.IsOffline || imported.IsOffline
+  if ev.Source == "" {
+    ev.Source = imported.Source
+  }
+  ev.IsTampered = ev.IsTampered || imported.IsTampered
+  if ev.Tamper == "" {
+    ev.Tamper = imported.Tamper
+  }
+  if ev.AckedBy == "" {
+    ev.AckedBy = imported.AckedBy
+    ev.AckedAt = imported.AckedAt
+  }
+  // a pending alarm is only still pending if neither copy has moved on
+  ev.IsPending = ev.IsPending && imported.IsPending
+  return ev
+}
+
+/* Returns a URL for a photo, as exported to formats meant for people. */
+func photoURL(name string) string {
+  return config.URLJoin(config.GetURLFor(config.PATH_PHOTO), name)
+}
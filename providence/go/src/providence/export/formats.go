@@ -0,0 +1,267 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package export
+
+import (
+  "bufio"
+  "encoding/csv"
+  "encoding/json"
+  "errors"
+  "io"
+  "strconv"
+  "strings"
+  "time"
+
+  "providence/types"
+)
+
+var csvHeader = []string{
+  "EventID", "SensorID", "Sensor", "Zone", "Trip", "Reset", "IsAjar", "IsAnomalous",
+  "IsPending", "AckedBy", "AckedAt", "IsOffline", "Source",
+  "IsTampered", "Tamper", "Photos",
+}
+
+type csvWriter struct {
+  w       *csv.Writer
+  started bool
+}
+
+func newCSVWriter(out io.Writer) *csvWriter {
+  return &csvWriter{w: csv.NewWriter(out)}
+}
+
+func formatTime(t *time.Time) string {
+  if t == nil {
+    return ""
+  }
+  return t.Format(time.RFC3339)
+}
+
+func (c *csvWriter) write(r Record) error {
+  if !c.started {
+    c.started = true
+    if err := c.w.Write(csvHeader); err != nil {
+      return err
+    }
+  }
+  sensor := types.Sensors[r.SensorID]
+  return c.w.Write([]string{
+    r.EventID, r.SensorID, sensor.Name, sensor.Zone,
+    formatTime(&r.Trip), formatTime(r.Reset),
+    strconv.FormatBool(r.IsAjar), strconv.FormatBool(r.IsAnomalous), strconv.FormatBool(r.IsPending),
+    r.AckedBy, formatTime(r.AckedAt), strconv.FormatBool(r.IsOffline), r.Source,
+    strconv.FormatBool(r.IsTampered), r.Tamper, strings.Join(r.Photos, ";"),
+  })
+}
+
+func (c *csvWriter) close() error {
+  c.w.Flush()
+  return c.w.Error()
+}
+
+type csvReader struct {
+  r       *csv.Reader
+  columns map[string]int
+}
+
+/* Reads CSV as written by csvWriter; columns are found by their header, so
+ * a spreadsheet may reorder or drop the informational ones. */
+func newCSVReader(in io.Reader) (*csvReader, error) {
+  r := csv.NewReader(in)
+  header, err := r.Read()
+  if err != nil {
+    return nil, err
+  }
+  columns := make(map[string]int)
+  for i, name := range header {
+    columns[strings.TrimSpace(name)] = i
+  }
+  for _, required := range []string{"EventID", "SensorID", "Trip"} {
+    if _, ok := columns[required]; !ok {
+      return nil, errors.New("CSV is missing column " + required)
+    }
+  }
+  r.FieldsPerRecord = len(header)
+  return &csvReader{r, columns}, nil
+}
+
+func (c *csvReader) read() (Record, error) {
+  row, err := c.r.Read()
+  if err != nil {
+    return Record{}, err
+  }
+  get := func(name string) string {
+    if i, ok := c.columns[name]; ok {
+      return strings.TrimSpace(row[i])
+    }
+    return ""
+  }
+  parseTime := func(name string) (*time.Time, error) {
+    s := get(name)
+    if s == "" {
+      return nil, nil
+    }
+    t, err := time.Parse(time.RFC3339, s)
+    if err != nil {
+      return nil, errors.New("bad " + name + " '" + s + "'")
+    }
+    return &t, nil
+  }
+  parseBool := func(name string) bool {
+    b, _ := strconv.ParseBool(get(name))
+    return b
+  }
+
+  var r Record
+  r.EventID = get("EventID")
+  r.SensorID = get("SensorID")
+  trip, err := parseTime("Trip")
+  if err != nil {
+    return r, err
+  }
+  if trip != nil {
+    r.Trip = *trip
+  }
+  if r.Reset, err = parseTime("Reset"); err != nil {
+    return r, err
+  }
+  if r.AckedAt, err = parseTime("AckedAt"); err != nil {
+    return r, err
+  }
+  r.IsAjar = parseBool("IsAjar")
+  r.IsAnomalous = parseBool("IsAnomalous")
+  r.IsPending = parseBool("IsPending")
+  r.AckedBy = get("AckedBy")
+  r.IsOffline = parseBool("IsOffline")
+  r.Source = get("Source")
+  r.IsTampered = parseBool("IsTampered")
+  r.Tamper = get("Tamper")
+  if photos := get("Photos"); photos != "" {
+    r.Photos = strings.Split(photos, ";")
+  }
+  return r, nil
+}
+
+type jsonlWriter struct {
+  enc *json.Encoder
+}
+
+func newJSONLWriter(out io.Writer) *jsonlWriter {
+  return &jsonlWriter{json.NewEncoder(out)}
+}
+
+func (j *jsonlWriter) write(r Record) error {
+  return j.enc.Encode(r)
+}
+
+func (j *jsonlWriter) close() error {
+  return nil
+}
+
+type jsonlReader struct {
+  dec *json.Decoder
+}
+
+func newJSONLReader(in io.Reader) *jsonlReader {
+  return &jsonlReader{json.NewDecoder(bufio.NewReader(in))}
+}
+
+func (j *jsonlReader) read() (Record, error) {
+  var r Record
+  err := j.dec.Decode(&r)
+  return r, err
+}
+
+/* Writes an RFC 5545 calendar with one VEVENT per event, lasting from trip
+ * to reset, so alarms show up in calendar apps alongside everything else. */
+type icalWriter struct {
+  w       *bufio.Writer
+  started bool
+}
+
+func newICalWriter(out io.Writer) *icalWriter {
+  return &icalWriter{w: bufio.NewWriter(out)}
+}
+
+const ICAL_TIME = "20060102T150405Z"
+
+/* Escapes TEXT values per RFC 5545 section 3.3.11. */
+func icalText(s string) string {
+  return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`).Replace(s)
+}
+
+/* Writes a content line, folding it at 75 octets as RFC 5545 requires;
+ * the space starting each continuation counts towards its 75. */
+func (c *icalWriter) line(s string) {
+  max := 75
+  for len(s) > max {
+    cut := max
+    // don't split a UTF-8 sequence
+    for cut > 0 && s[cut]&0xC0 == 0x80 {
+      cut--
+    }
+    c.w.WriteString(s[:cut] + "\r\n ")
+    s = s[cut:]
+    max = 74
+  }
+  c.w.WriteString(s + "\r\n")
+}
+
+func (c *icalWriter) begin() {
+  c.started = true
+  c.line("BEGIN:VCALENDAR")
+  c.line("VERSION:2.0")
+  c.line("PRODID:-//Providence//Event Export//EN")
+  c.line("X-WR-CALNAME:Providence alarms")
+}
+
+func (c *icalWriter) write(r Record) error {
+  if !c.started {
+    c.begin()
+  }
+  end := r.Trip
+  if r.Reset != nil {
+    end = *r.Reset
+  }
+  desc := "Sensor " + r.SensorID
+  if r.AckedBy != "" {
+    desc += "\nAcknowledged by " + r.AckedBy
+  }
+  for _, p := range r.Photos {
+    desc += "\n" + photoURL(p)
+  }
+
+  c.line("BEGIN:VEVENT")
+  c.line("UID:" + r.EventID + "@providence")
+  c.line("DTSTAMP:" + time.Now().UTC().Format(ICAL_TIME))
+  c.line("DTSTART:" + r.Trip.UTC().Format(ICAL_TIME))
+  c.line("DTEND:" + end.UTC().Format(ICAL_TIME))
+  c.line("SUMMARY:" + icalText(r.Description()))
+  c.line("DESCRIPTION:" + icalText(desc))
+  if zone := types.Sensors[r.SensorID].Zone; zone != "" {
+    c.line("LOCATION:" + icalText(zone))
+  }
+  c.line("END:VEVENT")
+  return nil
+}
+
+func (c *icalWriter) close() error {
+  if !c.started {
+    c.begin()
+  }
+  c.line("END:VCALENDAR")
+  return c.w.Flush()
+}
@@ -0,0 +1,213 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package export
+
+import (
+  "bytes"
+  "io"
+  "reflect"
+  "strings"
+  "testing"
+  "time"
+
+  "providence/types"
+)
+
+var (
+  est  = time.FixedZone("EST", -5*3600)
+  trip = time.Date(2013, 6, 1, 12, 0, 0, 0, est)
+)
+
+func at(secs int) *time.Time {
+  t := trip.Add(time.Duration(secs) * time.Second)
+  return &t
+}
+
+/* Records that exercise quoting and empty fields in every format. */
+func testRecords() []Record {
+  return []Record{
+    {Event: types.Event{EventID: "e1", SensorID: "door", Trip: trip, Reset: at(30), IsAjar: true, IsAnomalous: true,
+      AckedBy: `O'Brien, "Pat"` + "\nnight shift", AckedAt: at(10)},
+      Photos: []string{"e1-a.jpg", "e1-b.jpg"}},
+    {Event: types.Event{EventID: "e2", SensorID: "", Trip: trip.Add(time.Minute), IsOffline: true, Source: "hub; basement"}},
+    {Event: types.Event{EventID: "e3", SensorID: "window", Trip: trip.Add(2 * time.Minute), IsPending: true,
+      IsTampered: true, Tamper: types.TAMPER_CUT}},
+  }
+}
+
+func sameTime(a *time.Time, b *time.Time) bool {
+  if a == nil || b == nil {
+    return a == b
+  }
+  return a.Equal(*b)
+}
+
+func checkRecords(t *testing.T, got []Record, want []Record) {
+  t.Helper()
+  if len(got) != len(want) {
+    t.Fatalf("read %d records, want %d", len(got), len(want))
+  }
+  for i := range want {
+    g, w := got[i], want[i]
+    if !g.Trip.Equal(w.Trip) || !sameTime(g.Reset, w.Reset) || !sameTime(g.AckedAt, w.AckedAt) {
+      t.Errorf("%s: times %v/%v/%v, want %v/%v/%v", w.EventID, g.Trip, g.Reset, g.AckedAt, w.Trip, w.Reset, w.AckedAt)
+    }
+    // times compared already; compare the rest as is
+    g.Trip, g.Reset, g.AckedAt = w.Trip, w.Reset, w.AckedAt
+    if !reflect.DeepEqual(g, w) {
+      t.Errorf("read %+v, want %+v", g, w)
+    }
+  }
+}
+
+func TestCSVRoundTrip(t *testing.T) {
+  var buf bytes.Buffer
+  w := newCSVWriter(&buf)
+  for _, r := range testRecords() {
+    if err := w.write(r); err != nil {
+      t.Fatal(err)
+    }
+  }
+  if err := w.close(); err != nil {
+    t.Fatal(err)
+  }
+
+  r, err := newCSVReader(&buf)
+  if err != nil {
+    t.Fatal(err)
+  }
+  got := make([]Record, 0)
+  for {
+    rec, err := r.read()
+    if err == io.EOF {
+      break
+    }
+    if err != nil {
+      t.Fatal(err)
+    }
+    got = append(got, rec)
+  }
+  checkRecords(t, got, testRecords())
+}
+
+func TestCSVReader(t *testing.T) {
+  // columns may come in any order, and the informational ones may be gone
+  in := "Trip, EventID ,SensorID\n2013-06-01T12:00:00-05:00,e1,door\n"
+  r, err := newCSVReader(strings.NewReader(in))
+  if err != nil {
+    t.Fatal(err)
+  }
+  rec, err := r.read()
+  if err != nil {
+    t.Fatal(err)
+  }
+  if rec.EventID != "e1" || rec.SensorID != "door" || !rec.Trip.Equal(trip) || rec.Reset != nil {
+    t.Errorf("read %+v", rec)
+  }
+
+  if _, err := newCSVReader(strings.NewReader("EventID,Trip\n")); err == nil {
+    t.Error("CSV without a SensorID column accepted")
+  }
+  r, err = newCSVReader(strings.NewReader("EventID,SensorID,Trip\ne1,door,noon\n"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if _, err := r.read(); err == nil {
+    t.Error("bad Trip accepted")
+  }
+}
+
+func TestJSONLRoundTrip(t *testing.T) {
+  var buf bytes.Buffer
+  w := newJSONLWriter(&buf)
+  for _, r := range testRecords() {
+    if err := w.write(r); err != nil {
+      t.Fatal(err)
+    }
+  }
+  if err := w.close(); err != nil {
+    t.Fatal(err)
+  }
+  if lines := strings.Count(buf.String(), "\n"); lines != len(testRecords()) {
+    t.Errorf("wrote %d lines, want one per record", lines)
+  }
+
+  r := newJSONLReader(&buf)
+  got := make([]Record, 0)
+  for {
+    rec, err := r.read()
+    if err == io.EOF {
+      break
+    }
+    if err != nil {
+      t.Fatal(err)
+    }
+    got = append(got, rec)
+  }
+  checkRecords(t, got, testRecords())
+}
+
+func TestICalText(t *testing.T) {
+  for in, want := range map[string]string{
+    "Front Door":      "Front Door",
+    `a\b`:             `a\\b`,
+    "one; two, three": `one\; two\, three`,
+    "line\nbreak":     `line\nbreak`,
+    `\;` + "\n":       `\\\;\n`,
+  } {
+    if got := icalText(in); got != want {
+      t.Errorf("icalText(%q) = %q, want %q", in, got, want)
+    }
+  }
+}
+
+func TestICalWriter(t *testing.T) {
+  var buf bytes.Buffer
+  w := newICalWriter(&buf)
+  // long enough to need folding, with multibyte characters about the folds
+  source := strings.Repeat("Kellergeschoß, ", 12)
+  rec := Record{Event: types.Event{EventID: "e2", Trip: trip, IsOffline: true, Source: source}}
+  if err := w.write(rec); err != nil {
+    t.Fatal(err)
+  }
+  if err := w.close(); err != nil {
+    t.Fatal(err)
+  }
+
+  out := buf.String()
+  if !strings.HasSuffix(out, "\r\n") {
+    t.Error("output doesn't end with CRLF")
+  }
+  for _, line := range strings.Split(strings.TrimSuffix(out, "\r\n"), "\r\n") {
+    if len(line) > 75 {
+      t.Errorf("%d-octet line %q", len(line), line)
+    }
+  }
+  unfolded := strings.Replace(out, "\r\n ", "", -1)
+  for _, want := range []string{
+    "BEGIN:VCALENDAR\r\n",
+    "UID:e2@providence\r\n",
+    "DTSTART:20130601T170000Z\r\n",
+    // no reset, so it ends where it starts
+    "DTEND:20130601T170000Z\r\n",
+    "SUMMARY:" + icalText("Sensor hub "+source+" Offline") + "\r\n",
+    "END:VCALENDAR\r\n",
+  } {
+    if !strings.Contains(unfolded, want) {
+      t.Errorf("output lacks %q:\n%s", want, out)
+    }
+  }
+}
@@ -0,0 +1,133 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gcm
+
+import (
+  "time"
+
+  "providence/config"
+  "providence/log"
+  "providence/notify"
+  "providence/types"
+)
+
+/* One tier of the escalation chain: who gets told about an alert once it
+ * has gone unacknowledged for a while. */
+type tier struct {
+  after     time.Duration
+  notifiers []notify.Notifier
+}
+
+/* Resolves the configured escalation tiers against the available notifiers.
+ * With no tiers configured, everything is notified immediately. */
+func resolveTiers(notifiers []notify.Notifier) []tier {
+  if len(config.Escalation.Tiers) == 0 {
+    return []tier{{0, notifiers}}
+  }
+
+  byName := make(map[string]notify.Notifier)
+  for _, n := range notifiers {
+    byName[n.Name()] = n
+  }
+  tiers := make([]tier, 0)
+  for i, cfg := range config.Escalation.Tiers {
+    t := tier{cfg.After * time.Second, make([]notify.Notifier, 0)}
+    for _, name := range cfg.Notifiers {
+      n, ok := byName[name]
+      if !ok {
+        log.Error("gcm.resolveTiers", "escalation tier ", i, " names unknown notifier '"+name+"'")
+        continue
+      }
+      t.notifiers = append(t.notifiers, n)
+    }
+    tiers = append(tiers, t)
+  }
+  return tiers
+}
+
+/* Tracks an alert that has not yet been acknowledged. */
+type escalation struct {
+  note    notify.Notification
+  start   time.Time
+  reached int // how many tiers have been notified so far
+}
+
+/* Walks unacknowledged alerts up the escalation chain. */
+type escalator struct {
+  tiers  []tier
+  active map[string]*escalation
+}
+
+func newEscalator(notifiers []notify.Notifier) *escalator {
+  return &escalator{resolveTiers(notifiers), make(map[string]*escalation)}
+}
+
+/* Handles a new or updated alert: everyone already paged about it hears the
+ * update, and any tiers that are due get paged. Once the alert has reset or
+ * been acknowledged it stops escalating, though a new alert still pages
+ * whoever is due straight away even if its sensor has already reset. */
+func (e *escalator) alert(ev types.Event) {
+  esc, ok := e.active[ev.EventID]
+  if !ok {
+    esc = &escalation{start: time.Now()}
+    e.active[ev.EventID] = esc
+  }
+  esc.note = notify.FromEvent(ev)
+  for _, t := range e.tiers[:esc.reached] {
+    notify.Send(t.notifiers, esc.note)
+  }
+  done := ev.Reset != nil || ev.AckedBy != ""
+  if !ok || !done {
+    e.advance(ev.EventID, esc, time.Now())
+  }
+  if done {
+    delete(e.active, ev.EventID)
+  }
+}
+
+/* Notifies every tier whose delay has elapsed. */
+func (e *escalator) advance(id string, esc *escalation, now time.Time) {
+  for esc.reached < len(e.tiers) && now.Sub(esc.start) >= e.tiers[esc.reached].after {
+    log.Status("gcm.escalator", "escalating '"+id+"' to tier ", esc.reached)
+    notify.Send(e.tiers[esc.reached].notifiers, esc.note)
+    esc.reached += 1
+  }
+}
+
+/* Called periodically to escalate alerts that have sat unacknowledged. */
+func (e *escalator) tick(now time.Time) {
+  for id, esc := range e.active {
+    e.advance(id, esc, now)
+  }
+}
+
+/* Stops escalation of an acknowledged alert, and lets everyone who was paged
+ * about it know who has it in hand. */
+func (e *escalator) acknowledge(ev types.Event) {
+  esc, ok := e.active[ev.EventID]
+  if !ok {
+    return
+  }
+  delete(e.active, ev.EventID)
+  log.Status("gcm.escalator", "'"+ev.EventID+"' acknowledged by "+ev.AckedBy)
+
+  note := esc.note
+  note.Title = note.Title + " acknowledged by " + ev.AckedBy
+  note.AckedBy = ev.AckedBy
+  for _, t := range e.tiers[:esc.reached] {
+    notify.Send(t.notifiers, note)
+  }
+}
@@ -0,0 +1,289 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gcm
+
+/*
+ * Transport for the Firebase Cloud Messaging HTTP v1 API, which replaces the
+ * retired legacy GCM endpoint. Authentication is via an OAuth2 access token
+ * minted from a service account key: we sign a JWT assertion with the
+ * account's private key and trade it at the token URL for a bearer token.
+ * Unlike legacy GCM, v1 has no multicast, so each device gets its own request.
+ */
+
+import (
+  "bytes"
+  "crypto"
+  "crypto/rand"
+  "crypto/rsa"
+  "crypto/sha256"
+  "crypto/x509"
+  "encoding/base64"
+  "encoding/json"
+  "encoding/pem"
+  "errors"
+  "io/ioutil"
+  "net/http"
+  "net/url"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+
+  "providence/config"
+  "providence/log"
+)
+
+const (
+  FCM_SCOPE    = "https://www.googleapis.com/auth/firebase.messaging"
+  FCM_MIMETYPE = "application/json"
+)
+
+var fcmClient = &http.Client{Timeout: 30 * time.Second}
+
+/* Mints and caches OAuth2 access tokens for the configured service account.
+ * Safe for concurrent use; callers needing a fresh token wait for one mint
+ * rather than each starting their own. */
+type tokenSource struct {
+  account config.ServiceAccount
+  key     *rsa.PrivateKey
+
+  mutex  sync.Mutex
+  token  string
+  expiry time.Time
+}
+
+func newTokenSource(account config.ServiceAccount) (*tokenSource, error) {
+  block, _ := pem.Decode([]byte(account.PrivateKey))
+  if block == nil {
+    return nil, errors.New("no PEM data in service account private key")
+  }
+  parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+  if err != nil {
+    parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+    if err != nil {
+      return nil, err
+    }
+  }
+  key, ok := parsed.(*rsa.PrivateKey)
+  if !ok {
+    return nil, errors.New("service account private key is not RSA")
+  }
+  return &tokenSource{account: account, key: key}, nil
+}
+
+/* Returns a JWT assertion for the service account, signed with RS256. */
+func (ts *tokenSource) assertion(now time.Time) (string, error) {
+  enc := base64.RawURLEncoding
+  header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": ts.account.PrivateKeyID})
+  if err != nil {
+    return "", err
+  }
+  claims, err := json.Marshal(map[string]interface{}{
+    "iss":   ts.account.ClientEmail,
+    "scope": FCM_SCOPE,
+    "aud":   ts.account.TokenURI,
+    "iat":   now.Unix(),
+    "exp":   now.Add(time.Hour).Unix(),
+  })
+  if err != nil {
+    return "", err
+  }
+  signingInput := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+  digest := sha256.Sum256([]byte(signingInput))
+  sig, err := rsa.SignPKCS1v15(rand.Reader, ts.key, crypto.SHA256, digest[:])
+  if err != nil {
+    return "", err
+  }
+  return signingInput + "." + enc.EncodeToString(sig), nil
+}
+
+/* Returns a current access token, minting a new one if the cached one is
+ * missing or about to expire. */
+func (ts *tokenSource) Token() (string, error) {
+  ts.mutex.Lock()
+  defer ts.mutex.Unlock()
+  now := time.Now()
+  if ts.token != "" && now.Add(time.Minute).Before(ts.expiry) {
+    return ts.token, nil
+  }
+
+  jwt, err := ts.assertion(now)
+  if err != nil {
+    log.Error("gcm.tokenSource", "failed to sign JWT assertion", err)
+    return "", err
+  }
+  form := url.Values{
+    "grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+    "assertion":  {jwt},
+  }
+  res, err := fcmClient.PostForm(ts.account.TokenURI, form)
+  if err != nil {
+    log.Warn("gcm.tokenSource", "token request failed during execution", err)
+    return "", err
+  }
+  defer res.Body.Close()
+  body, err := ioutil.ReadAll(res.Body)
+  if err != nil {
+    return "", err
+  }
+  if res.StatusCode != http.StatusOK {
+    log.Error("gcm.tokenSource", "token request refused: ", string(body))
+    return "", errors.New("token request returned HTTP " + strconv.Itoa(res.StatusCode))
+  }
+
+  var tokenResponse struct {
+    AccessToken string `json:"access_token"`
+    ExpiresIn   int    `json:"expires_in"`
+    TokenType   string `json:"token_type"`
+  }
+  if err = json.Unmarshal(body, &tokenResponse); err != nil {
+    log.Error("gcm.tokenSource", "JSON unmarshal failure on token response", err)
+    return "", err
+  }
+  ts.token = tokenResponse.AccessToken
+  ts.expiry = now.Add(time.Duration(tokenResponse.ExpiresIn) * time.Second)
+  log.Debug("gcm.tokenSource", "minted access token expiring ", ts.expiry)
+  return ts.token, nil
+}
+
+/* Discards the cached token, so the next call to Token mints a new one. */
+func (ts *tokenSource) invalidate() {
+  ts.mutex.Lock()
+  defer ts.mutex.Unlock()
+  ts.token = ""
+}
+
+/* Outcome of sending one message to one device. */
+type sendResult struct {
+  remove     bool          // device token is permanently invalid; drop it
+  retry      bool          // transient failure; worth trying again later
+  retryAfter time.Duration // server-requested minimum delay, if any
+  err        error
+}
+
+/* Parses a Retry-After header, which is either delay-seconds or an HTTP
+ * date. Returns 0 if absent or unparseable. */
+func parseRetryAfter(header string) time.Duration {
+  if header == "" {
+    return 0
+  }
+  if secs, err := strconv.Atoi(header); err == nil {
+    return time.Duration(secs) * time.Second
+  }
+  if when, err := http.ParseTime(header); err == nil {
+    return when.Sub(time.Now())
+  }
+  return 0
+}
+
+/* Sends the data payload to a single device via the FCM v1 API. */
+func sendFCM(ts *tokenSource, regId string, data map[string]string) sendResult {
+  type fcmMessage struct {
+    Message struct {
+      Token string            `json:"token"`
+      Data  map[string]string `json:"data"`
+    } `json:"message"`
+  }
+  type fcmError struct {
+    Error struct {
+      Code    int    `json:"code"`
+      Message string `json:"message"`
+      Status  string `json:"status"`
+      Details []struct {
+        Type            string `json:"@type"`
+        ErrorCode       string `json:"errorCode"`
+        FieldViolations []struct {
+          Field string `json:"field"`
+        } `json:"fieldViolations"`
+      } `json:"details"`
+    } `json:"error"`
+  }
+
+  token, err := ts.Token()
+  if err != nil {
+    return sendResult{retry: true, err: err}
+  }
+
+  var msg fcmMessage
+  msg.Message.Token = regId
+  msg.Message.Data = data
+  j, err := json.Marshal(msg)
+  if err != nil {
+    log.Error("gcm.sendFCM", "JSON failure during encode for FCM", err)
+    return sendResult{err: err}
+  }
+
+  endpoint := config.URLJoin(config.GCM.FCMBaseURL, "v1/projects", ts.account.ProjectID, "messages:send")
+  httpReq, err := http.NewRequest("POST", endpoint, bytes.NewReader(j))
+  if err != nil {
+    log.Error("gcm.sendFCM", "failed to create FCM HTTP request", err)
+    return sendResult{err: err}
+  }
+  httpReq.Header.Add("Authorization", "Bearer "+token)
+  httpReq.Header.Add("Content-Type", FCM_MIMETYPE)
+  httpResp, err := fcmClient.Do(httpReq)
+  if err != nil {
+    log.Warn("gcm.sendFCM", "FCM request failed during execution", err)
+    return sendResult{retry: true, err: err}
+  }
+  defer httpResp.Body.Close()
+
+  body, err := ioutil.ReadAll(httpResp.Body)
+  if err != nil {
+    return sendResult{retry: true, err: err}
+  }
+  log.Debug("gcm.sendFCM", "FCM response payload as follows:")
+  log.Debug("gcm.sendFCM", string(body))
+  if httpResp.StatusCode == http.StatusOK {
+    return sendResult{}
+  }
+
+  // v1 reports the FCM-specific error code in the details, and the generic
+  // RPC status at top level; prefer the former
+  var errResponse fcmError
+  if jsonErr := json.Unmarshal(body, &errResponse); jsonErr != nil {
+    log.Error("gcm.sendFCM", "JSON unmarshal failure on FCM error response: ", jsonErr)
+  }
+  code := errResponse.Error.Status
+  badToken := false
+  for _, detail := range errResponse.Error.Details {
+    if strings.HasSuffix(detail.Type, "FcmError") && detail.ErrorCode != "" {
+      code = detail.ErrorCode
+    }
+    for _, violation := range detail.FieldViolations {
+      badToken = badToken || violation.Field == "message.token"
+    }
+  }
+  result := sendResult{err: errors.New("FCM error " + code + ": " + errResponse.Error.Message)}
+  switch {
+  case code == "UNREGISTERED":
+    // the app was uninstalled, or the token expired
+    result.remove = true
+  case code == "INVALID_ARGUMENT" && badToken:
+    // the token itself is garbage; any other invalid argument is our fault,
+    // and no reason to forget the device
+    result.remove = true
+  case code == "UNAVAILABLE" || code == "INTERNAL" || code == "QUOTA_EXCEEDED" ||
+    httpResp.StatusCode == http.StatusTooManyRequests || httpResp.StatusCode >= 500:
+    result.retry = true
+    result.retryAfter = parseRetryAfter(httpResp.Header.Get("Retry-After"))
+  case httpResp.StatusCode == http.StatusUnauthorized:
+    // our access token was revoked or expired early; mint a fresh one
+    ts.invalidate()
+    result.retry = true
+  }
+  return result
+}
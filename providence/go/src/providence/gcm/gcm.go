@@ -16,10 +16,7 @@
 package gcm
 
 import (
-  "bytes"
   "encoding/json"
-  "io/ioutil"
-  "net/http"
   "strconv"
   "time"
 
@@ -27,6 +24,7 @@ import (
   "providence/config"
   "providence/db"
   "providence/log"
+  "providence/notify"
   "providence/server"
   "providence/types"
 )
@@ -39,124 +37,215 @@ type payload struct {
   SensorName       string
   SensorType       string
   SensorTypeName   string
+  Mode             string
+  ModeChangedBy    string
+  AckedBy          string
 }
 type request struct {
   data payload
   skip []string
 }
 
-func startTransmitter() (chan request, chan db.RegIdUpdate) {
-  type gcmRequest struct {
-    RegistrationIds []string `json:"registration_ids"`
-    Data            payload  `json:"data"`
+/* FCM data messages only support string values, so flatten the payload. */
+func (p payload) data() map[string]string {
+  return map[string]string{
+    "EventID":          p.EventID,
+    "EventDescription": p.EventDescription,
+    "EventTrip":        p.EventTrip.Format(time.RFC3339),
+    "IsAjar":           strconv.FormatBool(p.IsAjar),
+    "SensorName":       p.SensorName,
+    "SensorType":       p.SensorType,
+    "SensorTypeName":   p.SensorTypeName,
+    "Mode":             p.Mode,
+    "ModeChangedBy":    p.ModeChangedBy,
+    "AckedBy":          p.AckedBy,
+  }
+}
+
+/* Returns how long to wait before the next attempt at a message that has
+ * already failed the indicated number of times: exponential backoff from
+ * config.GCM.RetryBase, capped at config.GCM.RetryMax, but never sooner than
+ * the server asked for. */
+func backoff(attempts int, retryAfter time.Duration) time.Duration {
+  delay := config.GCM.RetryBase * time.Second
+  max := config.GCM.RetryMax * time.Second
+  for i := 0; i < attempts && delay < max; i++ {
+    delay *= 2
+  }
+  if delay > max {
+    delay = max
+  }
+  if retryAfter > delay {
+    delay = retryAfter
   }
-  type gcmResponse struct {
-    MulticastId  uint64 `json:"multicast_id"`
-    Success      int    `json:"success"`
-    Failure      int    `json:"failure"`
-    CanonicalIds int    `json:"canonical_ids"`
-    Results      []struct {
-      MessageId      string `json:"message_id"`
-      RegistrationId string `json:"registration_id"`
-      Error          string `json:"error"`
-    } `json:"results"`
+  return delay
+}
+
+/* Attempts delivery of everything in the outbound queue that is due, and
+ * settles each message: done, rescheduled, or dead-lettered. Devices whose
+ * tokens FCM has rejected are reported on regIdUpdateSink. */
+func drainQueue(ts *tokenSource, regIdUpdateSink chan db.RegIdUpdate) {
+  due, err := db.DueNotifications(100)
+  if err != nil || len(due) == 0 {
+    return
+  }
+
+  success, failure := 0, 0
+  for _, q := range due {
+    var data map[string]string
+    if err := json.Unmarshal([]byte(q.Payload), &data); err != nil {
+      log.Error("gcm.transmitter", "corrupt queued payload ", q.ID, err)
+      db.KillNotification(q.ID, "corrupt payload: "+err.Error())
+      continue
+    }
+
+    result := sendFCM(ts, q.RegID, data)
+    switch {
+    case result.err == nil:
+      success += 1
+      db.CompleteNotification(q.ID)
+    case result.remove:
+      // check to see if the reg ID had a permanent error, and if so remove from the list
+      failure += 1
+      log.Warn("gcm.transmitter", "FCM rejected device; removing ", result.err)
+      db.CompleteNotification(q.ID)
+      regIdUpdateSink <- db.RegIdUpdate{q.RegID, "", true}
+    case result.retry && q.Attempts+1 < config.GCM.MaxAttempts:
+      failure += 1
+      next := time.Now().Add(backoff(q.Attempts, result.retryAfter))
+      log.Warn("gcm.transmitter", "FCM send failed; retrying at ", next, " ", result.err)
+      db.RetryNotification(q.ID, next, result.err.Error())
+    default:
+      failure += 1
+      log.Error("gcm.transmitter", "FCM send failed permanently; dead-lettering ", q.ID, " ", result.err)
+      db.KillNotification(q.ID, result.err.Error())
+    }
   }
+  log.Status("gcm.transmitter", "FCM send summary: success: ", success, "; failure: ", failure)
+}
 
-  // define some constants and structs used only for JSON data formatting
-  // & communication with GCM
-  const (
-    GCM_URL      = "https://android.googleapis.com/gcm/send"
-    GCM_MIMETYPE = "application/json"
-  )
+/* Drains the outbound queue whenever kicked, and once per second for
+ * retries that come due. Runs on its own, since a pass can take as long as
+ * the FCM timeout per message, and neither new requests nor the Escalator
+ * should wait on that. */
+func drainer(ts *tokenSource, kick chan bool, regIdUpdateSink chan db.RegIdUpdate) {
+  ticker := time.Tick(1 * time.Second)
+  for {
+    select {
+    case <-kick:
+    case <-ticker:
+    }
+    drainQueue(ts, regIdUpdateSink)
+  }
+}
 
+/* Spins up a goroutine that delivers requests to every registered device via
+ * FCM. Requests are persisted to the outbound queue first, so a message
+ * survives both network outages and restarts; the queue is then drained
+ * as soon as the drainer is free. */
+func startTransmitter() (chan request, chan db.RegIdUpdate) {
   requestSource := make(chan request, 10)
   regIdUpdateSink := make(chan db.RegIdUpdate, 10)
 
+  var ts *tokenSource
+  if config.GCM.Account.PrivateKey != "" {
+    var err error
+    ts, err = newTokenSource(config.GCM.Account)
+    if err != nil {
+      log.Error("gcm.transmitter", "unusable FCM service account; push notifications disabled", err)
+    }
+  }
+  // a pending kick covers any number of requests enqueued meanwhile
+  kick := make(chan bool, 1)
+  if ts != nil {
+    go drainer(ts, kick, regIdUpdateSink)
+  }
+
   go func() {
-    for {
+    for req := range requestSource {
+      if ts == nil {
+        continue
+      }
+      regIds, err := db.GetRegIds(req.skip)
+      if err != nil {
+        log.Warn("gcm.transmitter", "failed getting RegIDs during FCM send ", err)
+        continue
+      }
+      if len(regIds) == 0 {
+        // no recipients == nothing to do
+        continue
+      }
+
+      j, err := json.Marshal(req.data.data())
+      if err != nil {
+        log.Error("gcm.transmitter", "JSON failure during encode for FCM", err)
+        continue
+      }
+      log.Debug("gcm.transmitter", "FCM data payload as follows:")
+      log.Debug("gcm.transmitter", string(j))
+      if err = db.EnqueueNotification(regIds, string(j)); err != nil {
+        continue
+      }
       select {
-      case req := <-requestSource:
-        regIds, err := db.GetRegIds(req.skip)
-        if err != nil {
-          log.Warn("gcm.transmitter", "failed getting RegIDs during GCM send ", err)
-          continue
-        }
-        if len(regIds) == 0 {
-          // no recipients == nothing to do
-          continue
-        }
-
-        // format up a GCM JSON message for the request
-        j, ok := json.Marshal(gcmRequest{regIds, req.data})
-        log.Debug("gcm.transmitter", "DEBUG: GCM request as follows:")
-        log.Debug("gcm.transmitter", string(j))
-        if ok != nil {
-          log.Status("gcm.transmitter", "JSON failure during encode for GCM", ok)
-          break
-        }
-
-        // send the event to GCM server via HTTP POST, per spec
-        httpReq, err := http.NewRequest("POST", GCM_URL, bytes.NewReader(j))
-        if err != nil {
-          log.Error("gcm.transmitter", "Failed to create GCM HTTP request", err)
-          break
-        }
-        httpReq.Header.Add("Authorization", "key="+config.GCM.OAuthToken)
-        httpReq.Header.Add("Content-Type", GCM_MIMETYPE)
-        client := &http.Client{}
-        httpResp, err := client.Do(httpReq)
-        if err != nil {
-          log.Warn("gcm.transmitter", "GCM request failed during execution", err)
-          break
-        }
-        defer httpResp.Body.Close()
-
-        // look at the JSON response from GCM server & take any actions indicated
-        body, err := ioutil.ReadAll(httpResp.Body)
-        if err == nil && len(body) > 0 {
-          log.Debug("gcm.transmitter", "GCM response payload as follows:")
-          log.Debug("gcm.transmitter", string(body))
-          var jsonResponse gcmResponse
-          jsonErr := json.Unmarshal(body, &jsonResponse)
-          if jsonErr != nil {
-            log.Error("gcm.transmitter", "JSON unmarshal failure on GCM response: ", jsonErr)
-            log.Error("gcm.transmitter", string(body))
-            break
-          }
-          log.Status("gcm.transmitter", "GCM response summary: success: ", jsonResponse.Success, "; failure: ", jsonResponse.Failure)
-          for i, oldId := range regIds {
-            result := jsonResponse.Results[i]
-
-            // GCM server sent a "canonical registration ID" message; update our list accordingly
-            if result.RegistrationId != "" {
-              regIdUpdateSink <- db.RegIdUpdate{oldId, result.RegistrationId, false}
-            }
-
-            // check to see if the reg ID had a permanent error, and if so remove from the list
-            if result.Error != "" && result.Error != "Unavailable" {
-              regIdUpdateSink <- db.RegIdUpdate{oldId, "", true}
-            }
-          }
-        }
-      } // select
-    } //for
+      case kick <- true:
+      default:
+      }
+    }
   }()
 
   return requestSource, regIdUpdateSink
 }
 
+/* Adapts the GCM transmitter to the notify.Notifier interface, so that it is
+ * just one of the backends the Escalator fans out to. */
+type gcmNotifier struct {
+  sink chan request
+}
+
+func (g *gcmNotifier) Name() string {
+  return "gcm"
+}
+
+func (g *gcmNotifier) Notify(n notify.Notification) error {
+  g.sink <- request{
+    payload{
+      EventID:          n.EventID,
+      EventDescription: n.Title,
+      EventTrip:        n.Trip,
+      IsAjar:           n.IsAjar,
+      SensorName:       n.SensorName,
+      SensorType:       n.SensorType,
+      SensorTypeName:   n.SensorTypeName,
+      Mode:             n.Mode,
+      ModeChangedBy:    n.ModeChangedBy,
+      AckedBy:          n.AckedBy,
+    },
+    []string{},
+  }
+  return nil
+}
+
 /* Watches for higher-level event types and escalates them for
- * human review -- i.e. via GCM. Should only be registered for AJAR and
- * ANOMALY.
+ * human review -- i.e. via GCM and whatever other notifiers are configured,
+ * moving up the escalation chain until someone acknowledges the alert.
+ * Acknowledgements are recorded on the event and sent back to the
+ * dispatcher. Should only be registered for AJAR and ANOMALY.
  */
 func Escalator(incoming chan types.Event, outgoing chan types.Event) {
   regIdUpdateSink := db.StartRegIdUpdater()
 
-  // start the HTTP server which is our source for regID creates & deletes
-  regIdHttpSource, gcmRequestSource := server.Start()
+  // start the HTTP server which is our source for regID creates & deletes,
+  // system mode changes, and acknowledgements
+  regIdHttpSource, gcmRequestSource, modeChangeSource, ackSource := server.Start()
 
-  // start the GCM helper
+  // start the GCM helper, and any other notification backends
   gcmRequestSink, regIdGcmUpdateSource := startTransmitter()
+  notifiers := append([]notify.Notifier{&gcmNotifier{gcmRequestSink}}, notify.Configured()...)
+  for i, n := range notifiers {
+    notifiers[i] = notify.Coalesce(n)
+  }
+  chain := newEscalator(notifiers)
+  ticker := time.Tick(1 * time.Second)
 
   // check each raw event and synthesize higher level events as appropriate
   for {
@@ -172,19 +261,39 @@ func Escalator(incoming chan types.Event, outgoing chan types.Event) {
     case urlRequest := <-gcmRequestSource:
       gcmRequestSink <- request{payload{Url: urlRequest.Url}, urlRequest.Skip}
 
+    // System was armed or disarmed; let everyone know
+    case mode := <-modeChangeSource:
+      notify.Send(notifiers, notify.FromMode(mode))
+
+    // Someone has an alert in hand; record that on the event
+    case ack := <-ackSource:
+      lock, err := common.LockEvent(ack.EventID)
+      if err != nil {
+        log.Warn("gcm.Escalator", "failed to lock '"+ack.EventID+"' for acknowledgement", err)
+        break
+      }
+      now := time.Now()
+      lock.event.AckedBy = ack.By
+      lock.event.AckedAt = &now
+      lock.Commit()
+      outgoing <- lock.event
+
+    case now := <-ticker:
+      chain.tick(now)
+
     // New monitoring event from the dispatcher.
     case ev := <-incoming:
-      if !ev.IsAjar && !ev.IsAnomalous {
-        log.Debug("gcm.Escalator", "skipping mundane event '" + ev.EventID + "'")
+      if ev.AckedBy != "" {
+        chain.acknowledge(ev)
         break
       }
-      sensor := ev.Sensor()
-      gcmRequestSink <- request{
-        payload{ // GCM only supports strings so we can't be very typesafe here
-          ev.EventID, ev.Description(), ev.Trip, ev.IsAjar, sensor.Name,
-          strconv.Itoa(int(sensor.Subject)), sensor.SubjectName()))},
-        []string{},
+      // tampering and lost sensors escalate no matter the mode or exclusion
+      // windows, since they may be someone defeating the system
+      if !ev.IsAjar && !ev.IsAnomalous && !ev.IsOffline && !ev.IsTampered {
+        log.Debug("gcm.Escalator", "skipping mundane event '" + ev.EventID + "'")
+        break
       }
+      chain.alert(ev)
     }
   }
 }
@@ -0,0 +1,234 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gpio
+
+/*
+ * Access to GPIO lines via the Linux character device interface (uapi v2,
+ * Linux 5.11 and later), which replaces the deprecated sysfs interface. A
+ * line is requested as an input with edge detection, bias and debounce all
+ * configured by the kernel, and each edge is read back from the request's fd
+ * along with the kernel's timestamp for it.
+ *
+ * The handler only sees the Chip and Line interfaces, so it can be driven by
+ * a fake chip instead of real hardware via openChip.
+ */
+
+import (
+  "errors"
+  "os"
+  "path/filepath"
+  "strings"
+  "syscall"
+  "time"
+  "unsafe"
+)
+
+/* Input settings for a requested line. */
+type LineSettings struct {
+  Consumer  string // label shown by gpioinfo
+  ActiveLow bool
+  PullUp    bool
+  PullDown  bool
+  NoBias    bool
+  Debounce  time.Duration
+}
+
+/* An edge on a line: Active is the line's new logical value, i.e. after
+ * ActiveLow is applied; When is the kernel's timestamp; Seq counts edges on
+ * the line, so a gap means the kernel's buffer overflowed. */
+type Edge struct {
+  Active bool
+  When   time.Time
+  Seq    uint32
+}
+
+/* A GPIO chip that input lines can be requested from. */
+type Chip interface {
+  RequestLine(offset uint32, settings LineSettings) (Line, error)
+  Close() error
+}
+
+/* A requested input line. ReadEdge blocks until the next edge. */
+type Line interface {
+  Value() (bool, error)
+  ReadEdge() (Edge, error)
+  Close() error
+}
+
+/* Opens the named chip; replaceable so the handler can run on a fake. */
+var openChip = func(name string) (Chip, error) {
+  return openCharDev(name)
+}
+
+// from linux/gpio.h
+const (
+  gpioMaxNameSize      = 32
+  gpioV2LinesMax       = 64
+  gpioV2LineNumAttrMax = 10
+
+  gpioV2LineFlagActiveLow          = 1 << 1
+  gpioV2LineFlagInput              = 1 << 2
+  gpioV2LineFlagEdgeRising         = 1 << 4
+  gpioV2LineFlagEdgeFalling        = 1 << 5
+  gpioV2LineFlagBiasPullUp         = 1 << 8
+  gpioV2LineFlagBiasPullDown       = 1 << 9
+  gpioV2LineFlagBiasDisabled       = 1 << 10
+  gpioV2LineFlagEventClockRealtime = 1 << 11
+
+  gpioV2LineAttrIDDebounce = 3
+
+  gpioV2LineEventRisingEdge = 1
+
+  // _IOWR(0xB4, nr, size)
+  gpioV2GetLineIoctl       = 0xC000B400 | uintptr(unsafe.Sizeof(lineRequest{}))<<16 | 0x07
+  gpioV2LineGetValuesIoctl = 0xC000B400 | uintptr(unsafe.Sizeof(lineValues{}))<<16 | 0x0E
+)
+
+type lineAttribute struct {
+  id      uint32
+  padding uint32
+  value   uint64 // flags, output values, or debounce period in µs
+}
+
+type lineConfigAttribute struct {
+  attr lineAttribute
+  mask uint64
+}
+
+type lineConfig struct {
+  flags    uint64
+  numAttrs uint32
+  padding  [5]uint32
+  attrs    [gpioV2LineNumAttrMax]lineConfigAttribute
+}
+
+type lineRequest struct {
+  offsets         [gpioV2LinesMax]uint32
+  consumer        [gpioMaxNameSize]byte
+  config          lineConfig
+  numLines        uint32
+  eventBufferSize uint32
+  padding         [5]uint32
+  fd              int32
+}
+
+type lineValues struct {
+  bits uint64
+  mask uint64
+}
+
+type lineEvent struct {
+  timestampNs uint64
+  id          uint32
+  offset      uint32
+  seqno       uint32
+  lineSeqno   uint32
+  padding     [6]uint32
+}
+
+type charDevChip struct {
+  file *os.File
+}
+
+type charDevLine struct {
+  file *os.File
+}
+
+func ioctl(fd uintptr, req uintptr, arg unsafe.Pointer) error {
+  _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg))
+  if errno != 0 {
+    return errno
+  }
+  return nil
+}
+
+/* Opens a GPIO character device, by path or by name under /dev. */
+func openCharDev(name string) (*charDevChip, error) {
+  if !strings.Contains(name, "/") {
+    name = filepath.Join("/dev", name)
+  }
+  file, err := os.OpenFile(name, os.O_RDWR, 0)
+  if err != nil {
+    return nil, err
+  }
+  return &charDevChip{file}, nil
+}
+
+func (c *charDevChip) RequestLine(offset uint32, settings LineSettings) (Line, error) {
+  var req lineRequest
+  req.offsets[0] = offset
+  req.numLines = 1
+  copy(req.consumer[:gpioMaxNameSize-1], settings.Consumer)
+
+  req.config.flags = gpioV2LineFlagInput | gpioV2LineFlagEdgeRising | gpioV2LineFlagEdgeFalling |
+    gpioV2LineFlagEventClockRealtime
+  if settings.ActiveLow {
+    req.config.flags |= gpioV2LineFlagActiveLow
+  }
+  switch {
+  case settings.PullUp:
+    req.config.flags |= gpioV2LineFlagBiasPullUp
+  case settings.PullDown:
+    req.config.flags |= gpioV2LineFlagBiasPullDown
+  case settings.NoBias:
+    req.config.flags |= gpioV2LineFlagBiasDisabled
+  }
+  if settings.Debounce > 0 {
+    req.config.attrs[0] = lineConfigAttribute{
+      attr: lineAttribute{id: gpioV2LineAttrIDDebounce, value: uint64(settings.Debounce / time.Microsecond)},
+      mask: 1, // i.e. the first (only) line in the request
+    }
+    req.config.numAttrs = 1
+  }
+
+  if err := ioctl(c.file.Fd(), gpioV2GetLineIoctl, unsafe.Pointer(&req)); err != nil {
+    return nil, err
+  }
+  return &charDevLine{os.NewFile(uintptr(req.fd), c.file.Name())}, nil
+}
+
+func (c *charDevChip) Close() error {
+  return c.file.Close()
+}
+
+func (l *charDevLine) Value() (bool, error) {
+  values := lineValues{mask: 1}
+  if err := ioctl(l.file.Fd(), gpioV2LineGetValuesIoctl, unsafe.Pointer(&values)); err != nil {
+    return false, err
+  }
+  return values.bits&1 != 0, nil
+}
+
+func (l *charDevLine) ReadEdge() (Edge, error) {
+  var ev lineEvent
+  buf := (*[unsafe.Sizeof(lineEvent{})]byte)(unsafe.Pointer(&ev))[:]
+  n, err := l.file.Read(buf)
+  if err != nil {
+    return Edge{}, err
+  }
+  if n != len(buf) {
+    return Edge{}, errors.New("short read of GPIO line event")
+  }
+  return Edge{
+    Active: ev.id == gpioV2LineEventRisingEdge,
+    When:   time.Unix(0, int64(ev.timestampNs)),
+    Seq:    ev.lineSeqno,
+  }, nil
+}
+
+func (l *charDevLine) Close() error {
+  return l.file.Close()
+}
@@ -15,6 +15,7 @@
 package gpio
 
 import (
+  "io/ioutil"
   "os"
   "syscall"
   "time"
@@ -102,15 +103,23 @@ func makeGpioMonitor(path string) (chan bool, error) {
   return ch, nil
 }
 
+/* Whether a GPIO values file can still be read, e.g. the pin hasn't been
+ * unexported out from under us. */
+func readable(path string) bool {
+  buf, err := ioutil.ReadFile(path)
+  return err == nil && len(buf) > 0 && (buf[0] == '0' || buf[0] == '1')
+}
+
 /* A binary sensor is a simple normally-closed switch, like a door or window
  * sensor. As a mechanical switch, it needs to be debounced. We accomplish
  * that by simply delaying the channel send by a debounce interval. */
-func binaryMonitor(path string, outgoing chan types.Event) {
+func binaryMonitor(path string, outgoing chan types.Event, lines *lineSet) {
   monitor, err := makeGpioMonitor(path)
   if err != nil {
     log.Error("gpio.binaryMonitor", "error during GPIO setup, aborting", err)
     return
   }
+  lines.set(path, true)
 
   timer := time.AfterFunc(0, func() {})
   lastSent := RESET
@@ -150,12 +159,13 @@ func binaryMonitor(path string, outgoing chan types.Event) {
 /* A ringing sensor is one which alternates rapidly between TRIP and RESET for
  * the duration of the event it is reporting. This is typical of electronic
  * sensors such as motion detectors. */
-func ringerMonitor(path string, outgoing chan types.Event) {
+func ringerMonitor(path string, outgoing chan types.Event, lines *lineSet) {
   monitor, err := makeGpioMonitor(path)
   if err != nil {
     log.Error("gpio.ringerMonitor", "error during GPIO setup, aborting", err)
     return
   }
+  lines.set(path, true)
 
   logicalState := RESET
   pendingEventId := ""
@@ -194,22 +204,27 @@ func ringerMonitor(path string, outgoing chan types.Event) {
   }
 }
 
-/* Reads 1/0 values from sensors connected to GPIO pins. Pin config is
- * specified in types.Config: if this module is in use, it assumes the pin
- * IDs are actually path names to a /sys/class/gpio values file.
+/* Returns a handler that reads 1/0 values from the source's sensors,
+ * connected to GPIO pins: for this mode, the sensor IDs are actually path
+ * names to a /sys/class/gpio values file.
  * Injects low-level (trip and reset) eventCodes into the outgoing channel.
+ * Pins that fail to set up, or whose values file stops being readable, are
+ * reported offline by the supervisor.
  * Never reads from 'incoming'; accordingly, should never be registered for
  * any message types or it will eventually deadlock when the channel buffer
  * fills.
  */
-func Handler(updates chan types.Event) {
-  for path, _ := range config.Sensor.Names {
-    log.Debug("gpio.Reader", "starting monitor for "+path)
-    if config.Sensor.Types[path] == types.MOTION {
-      // TODO: hook in modalities properly
-      go ringerMonitor(path)
-    } else {
-      go binaryMonitor(path)
+func NewHandler(src config.SensorSourceConfig) common.Handler {
+  return func(incoming chan types.Event, outgoing chan types.Event) {
+    lines := newLineSet(readable)
+    for _, path := range src.Sensors {
+      log.Debug("gpio.Reader", "starting monitor for "+path)
+      if types.Sensors[path].Modality == types.RINGING {
+        go ringerMonitor(path, outgoing, lines)
+      } else {
+        go binaryMonitor(path, outgoing, lines)
+      }
     }
+    lines.supervise(src)
   }
 }
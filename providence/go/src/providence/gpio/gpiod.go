@@ -0,0 +1,253 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gpio
+
+import (
+  "strconv"
+  "time"
+
+  "providence/common"
+  "providence/config"
+  "providence/db"
+  "providence/log"
+  "providence/types"
+)
+
+/* How long to wait before re-requesting a line that failed. */
+const LINE_RETRY_INTERVAL = 10 * time.Second
+
+/* Loads the latest stored copy of an event; see db.Refresh. Resets start
+ * from it rather than our own copy of the event, which would undo anything
+ * done to it since it was sent, like an acknowledgement. */
+var refresh = db.Refresh
+
+/* Converts a sensor's line config to request settings, filling in the
+ * default debounce. Binary sensors are debounced by the kernel; ringing
+ * sensors flicker by design, so they get none unless configured, and are
+ * smoothed in software instead. */
+func lineSettings(id string, sensor types.Sensor, lc config.GPIODLineConfig) LineSettings {
+  settings := LineSettings{
+    Consumer:  "providence:" + id,
+    ActiveLow: lc.ActiveLow,
+    PullUp:    lc.Bias == config.BIAS_PULL_UP,
+    PullDown:  lc.Bias == config.BIAS_PULL_DOWN,
+    NoBias:    lc.Bias == config.BIAS_DISABLED,
+    Debounce:  lc.Debounce * time.Millisecond,
+  }
+  if lc.Debounce == 0 && sensor.Modality != types.RINGING {
+    settings.Debounce = DEBOUNCE_BINARY * time.Millisecond
+  }
+  return settings
+}
+
+/* Tracks the event in progress for one sensor. Edges come in already
+ * debounced by the kernel, so for binary sensors each one is a trip or a
+ * reset. Ringing sensors toggle for as long as they are tripped, so a reset
+ * only counts once the line has stayed inactive for DEBOUNCE_RINGER. */
+type lineMonitor struct {
+  id       string
+  sensor   types.Sensor
+  outgoing chan types.Event
+  current  *types.Event
+  lines    *lineSet
+}
+
+func (m *lineMonitor) trip(when time.Time) {
+  if m.current != nil {
+    return
+  }
+  event := types.NewEvent(m.id)
+  event.Trip = when
+  m.current = &event
+  m.outgoing <- event
+}
+
+func (m *lineMonitor) reset(when time.Time) {
+  if m.current == nil {
+    return
+  }
+  event := refresh(*m.current)
+  event.Reset = &when
+  m.outgoing <- event
+  m.current = nil
+}
+
+/* Requests the line and reports its edges until reading fails, then returns
+ * so the caller can retry. */
+func (m *lineMonitor) watch(chip Chip, lc config.GPIODLineConfig) error {
+  line, err := chip.RequestLine(lc.Line, lineSettings(m.id, m.sensor, lc))
+  if err != nil {
+    return err
+  }
+  defer line.Close()
+
+  // catch up with whatever happened while we weren't watching, e.g. a door
+  // already open at startup
+  active, err := line.Value()
+  if err != nil {
+    return err
+  }
+  m.lines.set(m.id, true)
+  defer m.lines.set(m.id, false)
+  if active && m.sensor.Modality != types.RINGING {
+    m.trip(time.Now())
+  } else if !active {
+    m.reset(time.Now())
+  }
+
+  edges := make(chan Edge)
+  errs := make(chan error, 1)
+  go func() {
+    for {
+      edge, err := line.ReadEdge()
+      if err != nil {
+        errs <- err
+        close(edges)
+        return
+      }
+      edges <- edge
+    }
+  }()
+
+  var lastSeq uint32
+  var settled <-chan time.Time
+  var lastInactive time.Time
+  for {
+    select {
+    case edge, ok := <-edges:
+      if !ok {
+        return <-errs
+      }
+      if lastSeq != 0 && edge.Seq != lastSeq+1 {
+        log.Warn("gpio.lineMonitor", "missed "+strconv.Itoa(int(edge.Seq-lastSeq-1))+" edges on '"+m.id+"'")
+      }
+      lastSeq = edge.Seq
+
+      switch {
+      case edge.Active:
+        settled = nil
+        m.trip(edge.When)
+      case m.sensor.Modality == types.RINGING:
+        lastInactive = edge.When
+        settled = time.After(DEBOUNCE_RINGER * time.Millisecond)
+      default:
+        m.reset(edge.When)
+      }
+
+    case <-settled:
+      settled = nil
+      m.reset(lastInactive)
+    }
+  }
+}
+
+/* Tracks a sensor's tamper switch, which has a line of its own. While it's
+ * active, the sensor has a tamper event open. */
+type tamperMonitor struct {
+  id       string
+  outgoing chan types.Event
+  current  *types.Event
+}
+
+func (m *tamperMonitor) set(tampered bool, when time.Time) {
+  switch {
+  case tampered && m.current == nil:
+    log.Error("gpio.tamperMonitor", "tamper switch tripped on '"+m.id+"'")
+    event := types.NewTamperEvent(m.id, types.TAMPER_SWITCH)
+    event.Trip = when
+    m.current = &event
+    m.outgoing <- event
+  case !tampered && m.current != nil:
+    event := refresh(*m.current)
+    event.Reset = &when
+    m.outgoing <- event
+    m.current = nil
+  }
+}
+
+/* Requests the tamper line and reports changes until reading fails. */
+func (m *tamperMonitor) watch(chip Chip, lc config.GPIODLineConfig) error {
+  // wired like the sensor, but always debounced like a switch
+  settings := lineSettings(m.id+":tamper", types.Sensor{Modality: types.NORMALLY_CLOSED}, lc)
+  settings.ActiveLow = lc.TamperActiveLow
+  line, err := chip.RequestLine(*lc.TamperLine, settings)
+  if err != nil {
+    return err
+  }
+  defer line.Close()
+
+  active, err := line.Value()
+  if err != nil {
+    return err
+  }
+  m.set(active, time.Now())
+  for {
+    edge, err := line.ReadEdge()
+    if err != nil {
+      return err
+    }
+    m.set(edge.Active, edge.When)
+  }
+}
+
+/* Returns a handler that reads the source's sensors, wired to GPIO
+ * character devices as configured in its Lines, and injects trip and reset
+ * events (stamped with the kernel's edge timestamps) into the outgoing
+ * channel, along with tamper events from any tamper switches. Sensors whose
+ * lines can't be requested are reported offline by the supervisor. Never
+ * reads from 'incoming'; accordingly, should never be registered for any
+ * message types or it will eventually deadlock when the channel buffer
+ * fills.
+ */
+func NewGPIODHandler(src config.SensorSourceConfig) common.Handler {
+  return func(incoming chan types.Event, outgoing chan types.Event) {
+    lines := newLineSet(nil)
+    startLines(src, lines, outgoing)
+    lines.supervise(src)
+  }
+}
+
+func startLines(src config.SensorSourceConfig, lines *lineSet, outgoing chan types.Event) {
+  chips := make(map[string]Chip)
+  for id, lc := range src.Lines {
+    chip, ok := chips[lc.Chip]
+    if !ok {
+      var err error
+      if chip, err = openChip(lc.Chip); err != nil {
+        log.Error("gpio.startLines", "failed to open GPIO chip '"+lc.Chip+"'; sensor '"+id+"' disabled", err)
+        continue
+      }
+      chips[lc.Chip] = chip
+    }
+
+    log.Debug("gpio.startLines", "starting monitor for '"+id+"' on "+lc.Chip+" line "+strconv.Itoa(int(lc.Line)))
+    m := &lineMonitor{id: id, sensor: types.Sensors[id], outgoing: outgoing, lines: lines}
+    go retry(id, m.watch, chip, lc)
+    if lc.TamperLine != nil {
+      t := &tamperMonitor{id: id, outgoing: outgoing}
+      go retry(id+" tamper switch", t.watch, chip, lc)
+    }
+  }
+}
+
+/* Runs watch until it fails, then again after a pause, forever. */
+func retry(what string, watch func(Chip, config.GPIODLineConfig) error, chip Chip, lc config.GPIODLineConfig) {
+  for {
+    err := watch(chip, lc)
+    log.Error("gpio.retry", "lost GPIO line for '"+what+"'; retrying in "+LINE_RETRY_INTERVAL.String(), err)
+    time.Sleep(LINE_RETRY_INTERVAL)
+  }
+}
@@ -0,0 +1,316 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gpio
+
+import (
+  "errors"
+  "sync"
+  "testing"
+  "time"
+
+  "providence/config"
+  "providence/types"
+)
+
+/* A chip whose lines are driven by the test. Requests for offsets in fail
+ * return that error. */
+type fakeChip struct {
+  mutex    sync.Mutex
+  lines    map[uint32]*fakeLine
+  fail     map[uint32]error
+  settings map[uint32]LineSettings
+}
+
+func newFakeChip() *fakeChip {
+  return &fakeChip{lines: make(map[uint32]*fakeLine), fail: make(map[uint32]error), settings: make(map[uint32]LineSettings)}
+}
+
+/* Adds a line, initially at the given value. */
+func (c *fakeChip) line(offset uint32, active bool) *fakeLine {
+  c.mutex.Lock()
+  defer c.mutex.Unlock()
+  l := &fakeLine{active: active, edges: make(chan Edge), errs: make(chan error, 1)}
+  c.lines[offset] = l
+  return l
+}
+
+func (c *fakeChip) RequestLine(offset uint32, settings LineSettings) (Line, error) {
+  c.mutex.Lock()
+  defer c.mutex.Unlock()
+  if err := c.fail[offset]; err != nil {
+    return nil, err
+  }
+  l, ok := c.lines[offset]
+  if !ok {
+    return nil, errors.New("no such line")
+  }
+  c.settings[offset] = settings
+  return l, nil
+}
+
+func (c *fakeChip) Close() error {
+  return nil
+}
+
+type fakeLine struct {
+  active bool
+  edges  chan Edge
+  errs   chan error
+  seq    uint32
+}
+
+func (l *fakeLine) Value() (bool, error) {
+  return l.active, nil
+}
+
+func (l *fakeLine) ReadEdge() (Edge, error) {
+  select {
+  case edge := <-l.edges:
+    return edge, nil
+  case err := <-l.errs:
+    return Edge{}, err
+  }
+}
+
+func (l *fakeLine) Close() error {
+  return nil
+}
+
+/* Delivers an edge to whoever is reading the line, returning its
+ * timestamp. */
+func (l *fakeLine) edge(active bool) time.Time {
+  l.seq++
+  when := time.Now()
+  l.edges <- Edge{Active: active, When: when, Seq: l.seq}
+  return when
+}
+
+func expectEvent(t *testing.T, events chan types.Event) types.Event {
+  t.Helper()
+  select {
+  case ev := <-events:
+    return ev
+  case <-time.After(2 * time.Second):
+    t.Fatal("timed out waiting for an event")
+  }
+  return types.Event{}
+}
+
+func expectNoEvent(t *testing.T, events chan types.Event, wait time.Duration) {
+  t.Helper()
+  select {
+  case ev := <-events:
+    t.Fatalf("unexpected event %+v", ev)
+  case <-time.After(wait):
+  }
+}
+
+/* Registers a sensor for the duration of the test, and makes refresh hand
+ * back events unchanged. */
+func setup(t *testing.T, id string, modality types.SensorModality) {
+  types.Sensors[id] = types.Sensor{SensorID: id, Modality: modality}
+  saved := refresh
+  refresh = func(event types.Event) types.Event { return event }
+  t.Cleanup(func() {
+    delete(types.Sensors, id)
+    refresh = saved
+  })
+}
+
+/* Starts watching a sensor's line, returning its monitor's events and the
+ * error watch eventually returns. */
+func watch(id string, chip Chip, lc config.GPIODLineConfig, lines *lineSet) (chan types.Event, chan error) {
+  events := make(chan types.Event, 10)
+  done := make(chan error, 1)
+  m := &lineMonitor{id: id, sensor: types.Sensors[id], outgoing: events, lines: lines}
+  go func() { done <- m.watch(chip, lc) }()
+  return events, done
+}
+
+func TestLineSettings(t *testing.T) {
+  lc := config.GPIODLineConfig{Bias: config.BIAS_PULL_UP, ActiveLow: true}
+  s := lineSettings("door", types.Sensor{Modality: types.NORMALLY_CLOSED}, lc)
+  if !s.PullUp || s.PullDown || s.NoBias || !s.ActiveLow || s.Consumer != "providence:door" {
+    t.Errorf("got %+v", s)
+  }
+  if s.Debounce != DEBOUNCE_BINARY*time.Millisecond {
+    t.Errorf("binary sensor got debounce %v", s.Debounce)
+  }
+  if s = lineSettings("bell", types.Sensor{Modality: types.RINGING}, lc); s.Debounce != 0 {
+    t.Errorf("ringing sensor got debounce %v", s.Debounce)
+  }
+  lc.Debounce = 20
+  if s = lineSettings("bell", types.Sensor{Modality: types.RINGING}, lc); s.Debounce != 20*time.Millisecond {
+    t.Errorf("configured debounce ignored: %v", s.Debounce)
+  }
+}
+
+func TestEdges(t *testing.T) {
+  setup(t, "door", types.NORMALLY_CLOSED)
+  chip := newFakeChip()
+  line := chip.line(3, false)
+  lines := newLineSet(nil)
+  events, _ := watch("door", chip, config.GPIODLineConfig{Line: 3}, lines)
+
+  tripped := line.edge(true)
+  trip := expectEvent(t, events)
+  if trip.SensorID != "door" || !trip.Trip.Equal(tripped) || trip.Reset != nil {
+    t.Errorf("got %+v, want a trip at the edge's time", trip)
+  }
+  if alive := lines.alive(); len(alive) != 1 || alive[0] != "door" {
+    t.Errorf("got live lines %v", alive)
+  }
+
+  // a repeat doesn't start a new event
+  line.edge(true)
+  reset := line.edge(false)
+  ev := expectEvent(t, events)
+  if ev.EventID != trip.EventID || ev.Reset == nil || !ev.Reset.Equal(reset) {
+    t.Errorf("got %+v, want the trip reset at the edge's time", ev)
+  }
+  if got := chip.settings[3].Debounce; got != DEBOUNCE_BINARY*time.Millisecond {
+    t.Errorf("line requested with debounce %v", got)
+  }
+}
+
+func TestActiveAtStartup(t *testing.T) {
+  setup(t, "door", types.NORMALLY_CLOSED)
+  chip := newFakeChip()
+  chip.line(3, true)
+  events, _ := watch("door", chip, config.GPIODLineConfig{Line: 3}, nil)
+  if ev := expectEvent(t, events); ev.SensorID != "door" || ev.Reset != nil {
+    t.Errorf("got %+v, want a trip for a door open at startup", ev)
+  }
+}
+
+func TestRingerDebounce(t *testing.T) {
+  setup(t, "bell", types.RINGING)
+  chip := newFakeChip()
+  line := chip.line(5, false)
+  events, _ := watch("bell", chip, config.GPIODLineConfig{Line: 5}, nil)
+
+  line.edge(true)
+  trip := expectEvent(t, events)
+
+  // toggling faster than DEBOUNCE_RINGER is all one event
+  for i := 0; i < 5; i++ {
+    line.edge(false)
+    time.Sleep(DEBOUNCE_RINGER * time.Millisecond / 5)
+    line.edge(true)
+  }
+  expectNoEvent(t, events, 2*DEBOUNCE_RINGER*time.Millisecond)
+
+  quiet := line.edge(false)
+  ev := expectEvent(t, events)
+  if ev.EventID != trip.EventID || ev.Reset == nil || !ev.Reset.Equal(quiet) {
+    t.Errorf("got %+v, want the trip reset as of the last inactive edge", ev)
+  }
+}
+
+func TestRequestError(t *testing.T) {
+  setup(t, "door", types.NORMALLY_CLOSED)
+  chip := newFakeChip()
+  chip.line(3, false)
+  busy := errors.New("device or resource busy")
+  chip.fail[3] = busy
+  lines := newLineSet(nil)
+  _, done := watch("door", chip, config.GPIODLineConfig{Line: 3}, lines)
+  if err := <-done; err != busy {
+    t.Errorf("got error %v, want %v", err, busy)
+  }
+  if alive := lines.alive(); len(alive) != 0 {
+    t.Errorf("line that couldn't be requested is live: %v", alive)
+  }
+}
+
+func TestReadError(t *testing.T) {
+  setup(t, "door", types.NORMALLY_CLOSED)
+  chip := newFakeChip()
+  line := chip.line(3, false)
+  lines := newLineSet(nil)
+  events, done := watch("door", chip, config.GPIODLineConfig{Line: 3}, lines)
+  line.edge(true)
+  expectEvent(t, events)
+
+  gone := errors.New("no such device")
+  line.errs <- gone
+  if err := <-done; err != gone {
+    t.Errorf("got error %v, want %v", err, gone)
+  }
+  if alive := lines.alive(); len(alive) != 0 {
+    t.Errorf("line that failed is still live: %v", alive)
+  }
+}
+
+func TestTamperSwitch(t *testing.T) {
+  setup(t, "door", types.NORMALLY_CLOSED)
+  refresh = func(event types.Event) types.Event {
+    event.AckedBy = "alice" // acknowledged since it was sent
+    return event
+  }
+  chip := newFakeChip()
+  line := chip.line(4, false)
+  events := make(chan types.Event, 10)
+  m := &tamperMonitor{id: "door", outgoing: events}
+  tamperLine := uint32(4)
+  go m.watch(chip, config.GPIODLineConfig{Line: 3, TamperLine: &tamperLine, TamperActiveLow: true})
+
+  line.edge(true)
+  ev := expectEvent(t, events)
+  if !ev.IsTampered || ev.Tamper != types.TAMPER_SWITCH || ev.SensorID != "door" {
+    t.Errorf("got %+v, want a tamper switch event", ev)
+  }
+  line.edge(false)
+  reset := expectEvent(t, events)
+  if reset.EventID != ev.EventID || reset.Reset == nil || reset.AckedBy != "alice" {
+    t.Errorf("got %+v, want the stored copy of the tamper event, reset", reset)
+  }
+  if s := chip.settings[4]; !s.ActiveLow || s.Debounce != DEBOUNCE_BINARY*time.Millisecond {
+    t.Errorf("tamper line requested with %+v", s)
+  }
+}
+
+func TestStartLines(t *testing.T) {
+  setup(t, "door", types.NORMALLY_CLOSED)
+  setup(t, "window", types.NORMALLY_CLOSED)
+  chip := newFakeChip()
+  line := chip.line(3, false)
+  saved := openChip
+  openChip = func(name string) (Chip, error) {
+    if name == "gpiochip0" {
+      return chip, nil
+    }
+    return nil, errors.New("no such chip")
+  }
+  defer func() { openChip = saved }()
+
+  src := config.SensorSourceConfig{Name: "gpiod", Sensors: []string{"door", "window"}, Lines: map[string]config.GPIODLineConfig{
+    "door":   {Chip: "gpiochip0", Line: 3},
+    "window": {Chip: "gpiochip1", Line: 3},
+  }}
+  events := make(chan types.Event, 10)
+  lines := newLineSet(nil)
+  startLines(src, lines, events)
+
+  line.edge(true)
+  if ev := expectEvent(t, events); ev.SensorID != "door" {
+    t.Errorf("got %+v, want door tripping", ev)
+  }
+  // only the sensor whose chip opened is vouched for
+  if alive := lines.alive(); len(alive) != 1 || alive[0] != "door" {
+    t.Errorf("got live lines %v, want just door", alive)
+  }
+}
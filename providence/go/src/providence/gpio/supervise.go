@@ -0,0 +1,80 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gpio
+
+import (
+  "sort"
+  "sync"
+  "time"
+
+  "providence/config"
+  "providence/supervisor"
+)
+
+/* Tracks which of a source's sensors currently have a working line, and
+ * vouches for those (and only those) to the supervisor, so a line that
+ * can't be requested or read is reported offline. The methods are no-ops on
+ * a nil lineSet. */
+type lineSet struct {
+  mutex sync.Mutex
+  up    map[string]bool
+  probe func(id string) bool // optional extra check at each heartbeat
+}
+
+func newLineSet(probe func(id string) bool) *lineSet {
+  return &lineSet{up: make(map[string]bool), probe: probe}
+}
+
+func (s *lineSet) set(id string, up bool) {
+  if s == nil {
+    return
+  }
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+  s.up[id] = up
+}
+
+/* Returns the sensors whose lines are up, and pass the probe if any. */
+func (s *lineSet) alive() []string {
+  s.mutex.Lock()
+  ids := make([]string, 0, len(s.up))
+  for id, up := range s.up {
+    if up {
+      ids = append(ids, id)
+    }
+  }
+  s.mutex.Unlock()
+
+  live := ids[:0]
+  for _, id := range ids {
+    if s.probe == nil || s.probe(id) {
+      live = append(live, id)
+    }
+  }
+  sort.Strings(live)
+  return live
+}
+
+/* Registers the source with the supervisor, then sends it a heartbeat
+ * listing the live lines a few times per timeout, forever. */
+func (s *lineSet) supervise(src config.SensorSourceConfig) {
+  timeout := src.HeartbeatTimeout * time.Second
+  supervisor.Watch(src.Name, src.Sensors, timeout)
+  for {
+    supervisor.Heartbeat(src.Name, s.alive())
+    time.Sleep(timeout / 3)
+  }
+}
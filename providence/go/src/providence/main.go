@@ -16,6 +16,9 @@
 package main
 
 import (
+  "flag"
+  "os"
+
   "providence/camera"
   "providence/common"
   "providence/config"
@@ -25,17 +28,58 @@ import (
   "providence/log"
   "providence/mock"
   "providence/policy"
+  "providence/server"
+  "providence/supervisor"
   "providence/tty"
   "providence/types"
 )
 
 func main() {
+  // config has already parsed the flags; anything left is a subcommand
+  if args := flag.Args(); len(args) > 0 {
+    db.Open()
+    os.Exit(runCommand(args))
+  }
+
+  // a restore staged by the restore command has to go in before the
+  // database is opened
+  restored, err := db.ApplyStagedRestore()
+  if err != nil {
+    log.Error("main.dispatcher", "failed to restore database from backup", err)
+    os.Exit(1)
+  }
+  db.Open()
+  if restored {
+    // the restore command's own audit entry went into the database just
+    // replaced, so record the restore in the one now in use
+    db.Audit(db.AuditEntry{
+      Principal: "server",
+      Action:    "db.restore",
+      Target:    config.General.DatabasePath,
+      SourceIP:  "local",
+      Outcome:   db.AUDIT_OK,
+      Detail:    "applied staged restore; previous database kept with a .pre-restore suffix",
+    })
+  }
+
   /* Stores handler function and its state and registration info. */
-  sensorHandler := map[string]common.Handler{"GPIO": gpio.Handler, "TTY": tty.Handler, "Mock": mock.Handler}[config.Sensor.Mode]
-  handlers := []common.Handler{sensorHandler, db.Handler, policy.Handler, gcm.Handler, camera.Handler}
+  handlers := []common.Handler{db.Handler, policy.Handler, gcm.Handler, camera.Handler, server.Handler, supervisor.Handler}
+  sourceHandlers := map[string]func(config.SensorSourceConfig) common.Handler{
+    config.SOURCE_GPIO:  gpio.NewHandler,
+    config.SOURCE_GPIOD: gpio.NewGPIODHandler,
+    config.SOURCE_TTY:   tty.NewHandler,
+    config.SOURCE_MOCK:  mock.NewHandler,
+  }
 
   // start up the handlers as goroutines
   events := make(chan types.Event, 10)
+
+  // sensor sources only ever produce events, so they aren't sent any
+  for _, src := range config.Sensor.Sources {
+    log.Status("main.dispatcher", "starting sensor source '"+src.Name+"' ("+src.Mode+")")
+    go sourceHandlers[src.Mode](src)(nil, events)
+  }
+
   listeners := make([]chan types.Event, len(handlers))
   for i, h := range handlers {
     listeners[i] = make(chan types.Event, 10)
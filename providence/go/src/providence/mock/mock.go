@@ -27,9 +27,14 @@ import (
 )
 
 /* Test-mode low-level event injector. Has the same role as ttyReader, but
- * listens on an HTTP server, so that event can be faked locally.
+ * listens on an HTTP server, so that event can be faked locally. Only the
+ * source's own sensors can be faked.
  */
-func MockReader(incoming chan types.Event, outgoing chan types.Event) {
+func mockReader(src config.SensorSourceConfig, outgoing chan types.Event) {
+  owned := make(map[string]bool)
+  for _, id := range src.Sensors {
+    owned[id] = true
+  }
   c := make(chan types.Event, 5)
   go func(c chan types.Event) {
     http.HandleFunc("/fake", func(writer http.ResponseWriter, req *http.Request) {
@@ -40,6 +45,12 @@ func MockReader(incoming chan types.Event, outgoing chan types.Event) {
         log.Debug("mock.reader", "form: ", req.Form)
         which := req.Form["w"][0]
         action, _ := strconv.Atoi(req.Form["a"][0])
+        if !owned[which] {
+          log.Warn("mock.reader", "sensor '"+which+"' isn't claimed by source '"+src.Name+"'")
+          writer.WriteHeader(http.StatusBadRequest)
+          io.WriteString(writer, "UNKNOWN SENSOR")
+          return
+        }
         c <- types.Event{Which: common.SensorState[which], Action: types.EventCode(action), When: time.Now()}
       }
       writer.WriteHeader(http.StatusOK)
@@ -54,4 +65,9 @@ func MockReader(incoming chan types.Event, outgoing chan types.Event) {
   }
 }
 
-var Handler = MockReader
+/* Returns a handler injecting events for the source's sensors. */
+func NewHandler(src config.SensorSourceConfig) common.Handler {
+  return func(incoming chan types.Event, outgoing chan types.Event) {
+    mockReader(src, outgoing)
+  }
+}
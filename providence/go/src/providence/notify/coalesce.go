@@ -0,0 +1,197 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package notify
+
+import (
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+
+  "providence/config"
+  "providence/log"
+)
+
+/* A Notifier decorator that batches event notifications arriving within
+ * config.Notify.CoalesceWindow of each other into a single summary, and
+ * enforces per-sensor and global rate limits per RateLimitPeriod. Anything
+ * dropped by the rate limits is reported in a follow-up once the period
+ * ends. Mode changes, acknowledgements and tampering are passed straight
+ * through: someone defeating a sensor is exactly who'd set off a flood of
+ * other events to hide it in. */
+type coalescer struct {
+  next     Notifier
+  incoming chan Notification
+  window   time.Duration
+  period   time.Duration
+
+  // per period
+  sensorLimit int
+  globalLimit int
+}
+
+/* Wraps the indicated notifier in a coalescer, if coalescing or rate
+ * limiting is configured; otherwise returns it unchanged. */
+func Coalesce(next Notifier) Notifier {
+  cfg := config.Notify
+  if cfg.CoalesceWindow == 0 && cfg.SensorRateLimit == 0 && cfg.GlobalRateLimit == 0 {
+    return next
+  }
+  period := cfg.RateLimitPeriod * time.Second
+  if period <= 0 {
+    period = time.Hour
+  }
+  c := &coalescer{
+    next:        next,
+    incoming:    make(chan Notification, 10),
+    window:      cfg.CoalesceWindow * time.Second,
+    period:      period,
+    sensorLimit: cfg.SensorRateLimit,
+    globalLimit: cfg.GlobalRateLimit,
+  }
+  go c.run()
+  return c
+}
+
+func (c *coalescer) Name() string {
+  return c.next.Name()
+}
+
+func (c *coalescer) Notify(n Notification) error {
+  if n.EventID == "" || n.AckedBy != "" || n.IsTampered {
+    return c.next.Notify(n)
+  }
+  c.incoming <- n
+  return nil
+}
+
+/* Collapses a batch of notifications into one, e.g.
+ * "3 events: Front Door Ajar, Foyer Motion x2". Later updates to the same
+ * event have already replaced earlier ones in the batch. */
+func summarize(batch []Notification) Notification {
+  if len(batch) == 1 {
+    return batch[0]
+  }
+
+  counts := make(map[string]int)
+  order := make([]string, 0)
+  latest := batch[0]
+  summary := Notification{}
+  for _, n := range batch {
+    if _, ok := counts[n.Title]; !ok {
+      order = append(order, n.Title)
+    }
+    counts[n.Title] += 1
+    summary.IsAjar = summary.IsAjar || n.IsAjar
+    summary.IsAnomalous = summary.IsAnomalous || n.IsAnomalous
+    if n.Trip.After(latest.Trip) {
+      latest = n
+    }
+  }
+  parts := make([]string, 0)
+  for _, title := range order {
+    if counts[title] > 1 {
+      parts = append(parts, title+" x"+strconv.Itoa(counts[title]))
+    } else {
+      parts = append(parts, title)
+    }
+  }
+
+  // point clients at the most recent event, so there's something to open
+  summary.EventID = latest.EventID
+  summary.Trip = latest.Trip
+  summary.SensorID = latest.SensorID
+  summary.SensorName = latest.SensorName
+  summary.SensorType = latest.SensorType
+  summary.SensorTypeName = latest.SensorTypeName
+  summary.Title = strconv.Itoa(len(batch)) + " events: " + strings.Join(parts, ", ")
+  return summary
+}
+
+func (c *coalescer) run() {
+  batch := make([]Notification, 0)
+  var flush <-chan time.Time
+  sensorCounts := make(map[string]int)
+  globalCount := 0
+  suppressed := make(map[string]int)
+  reset := time.Tick(c.period)
+
+  deliver := func(n Notification) {
+    Send([]Notifier{c.next}, n)
+  }
+
+  for {
+    select {
+    case n := <-c.incoming:
+      // updates to an event that's already waiting replace it in the batch,
+      // and don't count against the limits again
+      merged := false
+      for i, b := range batch {
+        if b.EventID == n.EventID {
+          batch[i] = n
+          merged = true
+        }
+      }
+      if merged {
+        break
+      }
+
+      if (c.sensorLimit > 0 && sensorCounts[n.SensorID] >= c.sensorLimit) || (c.globalLimit > 0 && globalCount >= c.globalLimit) {
+        log.Debug("notify.coalescer", "rate limit suppressed '"+n.Title+"' via "+c.next.Name())
+        suppressed[n.SensorName] += 1
+        break
+      }
+      sensorCounts[n.SensorID] += 1
+      globalCount += 1
+
+      if c.window <= 0 {
+        deliver(n)
+        break
+      }
+      batch = append(batch, n)
+      if flush == nil {
+        flush = time.After(c.window)
+      }
+
+    case <-flush:
+      flush = nil
+      if len(batch) > 0 {
+        deliver(summarize(batch))
+        batch = make([]Notification, 0)
+      }
+
+    case now := <-reset:
+      sensorCounts = make(map[string]int)
+      globalCount = 0
+      if len(suppressed) == 0 {
+        break
+      }
+      total := 0
+      names := make([]string, 0)
+      for name, count := range suppressed {
+        total += count
+        names = append(names, name)
+      }
+      sort.Strings(names)
+      log.Status("notify.coalescer", "suppressed ", total, " notifications via "+c.next.Name())
+      deliver(Notification{
+        Title: "Suppressed " + strconv.Itoa(total) + " notifications (" + strings.Join(names, ", ") + ")",
+        Trip:  now,
+      })
+      suppressed = make(map[string]int)
+    }
+  }
+}
@@ -0,0 +1,146 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package notify
+
+import (
+  "testing"
+  "time"
+)
+
+/* A Notifier that hands whatever it's sent to the test. */
+type recorder struct {
+  notes chan Notification
+}
+
+func (r *recorder) Name() string { return "recorder" }
+
+func (r *recorder) Notify(n Notification) error {
+  r.notes <- n
+  return nil
+}
+
+/* Starts a coalescer in front of a recorder. */
+func newTestCoalescer(window time.Duration, period time.Duration, sensorLimit int) (*coalescer, *recorder) {
+  r := &recorder{make(chan Notification, 10)}
+  c := &coalescer{next: r, incoming: make(chan Notification, 10), window: window, period: period, sensorLimit: sensorLimit}
+  go c.run()
+  return c, r
+}
+
+func (r *recorder) expect(t *testing.T) Notification {
+  t.Helper()
+  select {
+  case n := <-r.notes:
+    return n
+  case <-time.After(2 * time.Second):
+    t.Fatal("nothing delivered")
+  }
+  return Notification{}
+}
+
+func (r *recorder) expectNothing(t *testing.T, wait time.Duration) {
+  t.Helper()
+  select {
+  case n := <-r.notes:
+    t.Errorf("unexpectedly delivered %q", n.Title)
+  case <-time.After(wait):
+  }
+}
+
+/* A notification for an event tripped the indicated number of seconds after
+ * testNote's. */
+func note(eventID string, sensorID string, title string, secs int) Notification {
+  return Notification{EventID: eventID, SensorID: sensorID, SensorName: sensorID, Title: title,
+    Trip: testNote.Trip.Add(time.Duration(secs) * time.Second)}
+}
+
+func TestSummarize(t *testing.T) {
+  if got := summarize([]Notification{testNote}); got != testNote {
+    t.Errorf("single notification summarized as %+v", got)
+  }
+
+  batch := []Notification{
+    note("e1", "door", "Front Door Ajar", 0),
+    note("e2", "foyer", "Foyer Motion", 2),
+    note("e3", "foyer", "Foyer Motion", 1),
+  }
+  batch[0].IsAjar = true
+  batch[2].IsAnomalous = true
+  got := summarize(batch)
+  if want := "3 events: Front Door Ajar, Foyer Motion x2"; got.Title != want {
+    t.Errorf("got title %q, want %q", got.Title, want)
+  }
+  if got.EventID != "e2" || got.SensorID != "foyer" || !got.Trip.Equal(batch[1].Trip) {
+    t.Errorf("summary points at %s/%s@%v, want the latest event", got.EventID, got.SensorID, got.Trip)
+  }
+  if !got.IsAjar || !got.IsAnomalous {
+    t.Errorf("summary lost flags: ajar %v, anomalous %v", got.IsAjar, got.IsAnomalous)
+  }
+}
+
+func TestCoalescerBatches(t *testing.T) {
+  c, r := newTestCoalescer(50*time.Millisecond, time.Hour, 0)
+  c.Notify(note("e1", "door", "Front Door Ajar", 0))
+  c.Notify(note("e2", "foyer", "Foyer Motion", 1))
+  // an update to a waiting event replaces it
+  update := note("e1", "door", "Front Door Closed", 2)
+  c.Notify(update)
+
+  got := r.expect(t)
+  if want := "2 events: Front Door Closed, Foyer Motion"; got.Title != want {
+    t.Errorf("got %q, want %q", got.Title, want)
+  }
+  r.expectNothing(t, 100*time.Millisecond)
+
+  // tampering doesn't wait for the window
+  tamper := note("e3", "door", "Front Door Tampered", 3)
+  tamper.IsTampered = true
+  c.Notify(tamper)
+  select {
+  case got := <-r.notes:
+    if got.Title != tamper.Title {
+      t.Errorf("got %q, want %q", got.Title, tamper.Title)
+    }
+  default:
+    t.Error("tampering wasn't passed straight through")
+  }
+}
+
+func TestCoalescerSuppresses(t *testing.T) {
+  c, r := newTestCoalescer(0, 200*time.Millisecond, 1)
+  c.Notify(note("e1", "door", "Front Door Ajar", 0))
+  if got := r.expect(t); got.EventID != "e1" {
+    t.Errorf("got %q, want the first event", got.Title)
+  }
+  c.Notify(note("e2", "door", "Front Door Ajar", 1))
+  c.Notify(note("e3", "door", "Front Door Ajar", 2))
+  c.Notify(note("e4", "foyer", "Foyer Motion", 3))
+  if got := r.expect(t); got.EventID != "e4" {
+    t.Errorf("got %q, want the other sensor's event", got.Title)
+  }
+  c.Notify(note("e5", "foyer", "Foyer Motion", 4))
+
+  got := r.expect(t)
+  if want := "Suppressed 3 notifications (door, foyer)"; got.Title != want {
+    t.Errorf("got follow-up %q, want %q", got.Title, want)
+  }
+
+  // the limits start over each period
+  c.Notify(note("e6", "door", "Front Door Ajar", 5))
+  if got := r.expect(t); got.EventID != "e6" {
+    t.Errorf("got %q after the period ended, want the new event", got.Title)
+  }
+}
@@ -0,0 +1,57 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package notify
+
+import (
+  "net"
+  "net/smtp"
+  "strconv"
+  "strings"
+  "time"
+
+  "providence/config"
+  "providence/log"
+)
+
+/* Sends a short plain-text email per notification via an SMTP relay. */
+type emailNotifier struct {
+  cfg config.EmailConfig
+}
+
+func (e *emailNotifier) Name() string {
+  return e.cfg.Name
+}
+
+func (e *emailNotifier) Notify(n Notification) error {
+  addr := net.JoinHostPort(e.cfg.Host, strconv.Itoa(e.cfg.Port))
+
+  var auth smtp.Auth
+  if e.cfg.Username != "" {
+    auth = smtp.PlainAuth("", e.cfg.Username, e.cfg.Password, e.cfg.Host)
+  }
+
+  headers := []string{
+    "From: " + e.cfg.From,
+    "To: " + strings.Join(e.cfg.To, ", "),
+    "Subject: [Providence] " + n.Title,
+    "Date: " + time.Now().Format(time.RFC1123Z),
+    "Content-Type: text/plain; charset=UTF-8",
+  }
+  msg := strings.Join(headers, "\r\n") + "\r\n\r\n" + n.Body() + "\r\n"
+
+  log.Debug("notify.email", "sending '"+n.Title+"' via "+addr)
+  return smtp.SendMail(addr, auth, e.cfg.From, e.cfg.To, []byte(msg))
+}
@@ -0,0 +1,192 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package notify
+
+import (
+  "bufio"
+  "encoding/base64"
+  "net"
+  "strings"
+  "sync"
+  "testing"
+
+  "providence/config"
+)
+
+/* Just enough of an SMTP server to accept or refuse mail, recording what it
+ * was given. Setting rejectRcpt refuses every recipient. */
+type fakeSMTP struct {
+  listener   net.Listener
+  rejectRcpt bool
+
+  mutex sync.Mutex
+  auth  string // decoded AUTH PLAIN response
+  from  string
+  rcpts []string
+  data  string
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  s := &fakeSMTP{listener: l}
+  t.Cleanup(func() { l.Close() })
+  go func() {
+    for {
+      conn, err := l.Accept()
+      if err != nil {
+        return
+      }
+      go s.serve(conn)
+    }
+  }()
+  return s
+}
+
+func (s *fakeSMTP) serve(conn net.Conn) {
+  defer conn.Close()
+  r := bufio.NewReader(conn)
+  reply := func(lines ...string) {
+    conn.Write([]byte(strings.Join(lines, "\r\n") + "\r\n"))
+  }
+  reply("220 fake ESMTP")
+  for {
+    line, err := r.ReadString('\n')
+    if err != nil {
+      return
+    }
+    line = strings.TrimRight(line, "\r\n")
+    verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+    s.mutex.Lock()
+    switch verb {
+    case "EHLO":
+      reply("250-fake", "250 AUTH PLAIN")
+    case "AUTH":
+      fields := strings.Fields(line)
+      raw, _ := base64.StdEncoding.DecodeString(fields[len(fields)-1])
+      s.auth = string(raw)
+      reply("235 ok")
+    case "MAIL":
+      s.from = strings.TrimPrefix(line, "MAIL FROM:")
+      reply("250 ok")
+    case "RCPT":
+      if s.rejectRcpt {
+        reply("550 no such user")
+      } else {
+        s.rcpts = append(s.rcpts, strings.TrimPrefix(line, "RCPT TO:"))
+        reply("250 ok")
+      }
+    case "DATA":
+      reply("354 go ahead")
+      var data strings.Builder
+      for {
+        l, err := r.ReadString('\n')
+        if err != nil {
+          s.mutex.Unlock()
+          return
+        }
+        if l == ".\r\n" {
+          break
+        }
+        data.WriteString(l)
+      }
+      s.data = data.String()
+      reply("250 ok")
+    case "QUIT":
+      reply("221 bye")
+      s.mutex.Unlock()
+      return
+    default:
+      reply("250 ok")
+    }
+    s.mutex.Unlock()
+  }
+}
+
+func (s *fakeSMTP) notifier(username string) *emailNotifier {
+  addr := s.listener.Addr().(*net.TCPAddr)
+  return &emailNotifier{config.EmailConfig{
+    Name:     "email",
+    Host:     "127.0.0.1", // net/smtp only sends passwords in the clear to localhost
+    Port:     addr.Port,
+    Username: username,
+    Password: "hunter2",
+    From:     "providence@example.com",
+    To:       []string{"alice@example.com", "bob@example.com"},
+  }}
+}
+
+func TestEmail(t *testing.T) {
+  s := newFakeSMTP(t)
+  if err := s.notifier("relay").Notify(testNote); err != nil {
+    t.Fatal(err)
+  }
+
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+  if s.auth != "\x00relay\x00hunter2" {
+    t.Errorf("got AUTH PLAIN %q", s.auth)
+  }
+  if s.from != "<providence@example.com>" {
+    t.Errorf("got MAIL FROM %q", s.from)
+  }
+  if strings.Join(s.rcpts, " ") != "<alice@example.com> <bob@example.com>" {
+    t.Errorf("got recipients %v", s.rcpts)
+  }
+  for _, want := range []string{
+    "From: providence@example.com\r\n",
+    "To: alice@example.com, bob@example.com\r\n",
+    "Subject: [Providence] Front Door Ajar\r\n",
+    "\r\n\r\n" + testNote.Body() + "\r\n",
+  } {
+    if !strings.Contains(s.data, want) {
+      t.Errorf("message lacks %q:\n%s", want, s.data)
+    }
+  }
+}
+
+func TestEmailWithoutAuth(t *testing.T) {
+  s := newFakeSMTP(t)
+  if err := s.notifier("").Notify(testNote); err != nil {
+    t.Fatal(err)
+  }
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+  if s.auth != "" {
+    t.Errorf("authenticated without a username: %q", s.auth)
+  }
+  if s.data == "" {
+    t.Error("no message sent")
+  }
+}
+
+func TestEmailFailure(t *testing.T) {
+  s := newFakeSMTP(t)
+  s.rejectRcpt = true
+  if err := s.notifier("").Notify(testNote); err == nil || !strings.Contains(err.Error(), "550") {
+    t.Errorf("got error %v for refused recipients", err)
+  }
+
+  // nobody listening
+  n := s.notifier("")
+  s.listener.Close()
+  if err := n.Notify(testNote); err == nil {
+    t.Error("no error from an unreachable relay")
+  }
+}
@@ -0,0 +1,151 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package notify
+
+/*
+ * Defines the Notifier interface through which escalated events reach humans,
+ * along with the non-GCM delivery backends. The GCM backend lives in the gcm
+ * package, since it also owns device registration.
+ */
+
+import (
+  "strconv"
+  "time"
+
+  "providence/config"
+  "providence/log"
+  "providence/types"
+)
+
+/* A backend-neutral message describing something a human should know about:
+ * either an escalated event, or a change to the system mode. */
+type Notification struct {
+  EventID        string
+  Title          string
+  Trip           time.Time
+  IsAjar         bool
+  IsAnomalous    bool
+  IsTampered     bool
+  SensorID       string
+  SensorName     string
+  SensorType     string
+  SensorTypeName string
+  Mode           string
+  ModeChangedBy  string
+  AckedBy        string
+}
+
+/* A delivery backend. Notify should return promptly-ish, but callers run it
+ * in its own goroutine so a slow SMTP server can't stall escalation. */
+type Notifier interface {
+  Name() string
+  Notify(n Notification) error
+}
+
+/* Builds a Notification for an escalated event. */
+func FromEvent(ev types.Event) Notification {
+  if ev.IsOffline && ev.SensorID == "" {
+    // a sensor hub; there's no sensor to describe
+    return Notification{EventID: ev.EventID, Title: ev.Description(), Trip: ev.Trip, AckedBy: ev.AckedBy}
+  }
+  sensor := ev.Sensor()
+  return Notification{
+    EventID:        ev.EventID,
+    Title:          ev.Description(),
+    Trip:           ev.Trip,
+    IsAjar:         ev.IsAjar,
+    IsAnomalous:    ev.IsAnomalous,
+    IsTampered:     ev.IsTampered,
+    SensorID:       ev.SensorID,
+    SensorName:     sensor.Name,
+    SensorType:     strconv.Itoa(int(sensor.Subject)),
+    SensorTypeName: sensor.SubjectName(),
+    AckedBy:        ev.AckedBy,
+  }
+}
+
+/* Builds a Notification announcing a change to the system mode. */
+func FromMode(state types.ModeState) Notification {
+  return Notification{
+    Title:         "System set to " + state.Mode.Name() + " by " + state.ChangedBy,
+    Trip:          state.Changed,
+    Mode:          state.Mode.Name(),
+    ModeChangedBy: state.ChangedBy,
+  }
+}
+
+/* Returns the body text used by backends that deliver plain text. */
+func (n Notification) Body() string {
+  if n.SensorTypeName == "" {
+    return n.Title + " at " + n.Trip.Format("Mon Jan 2 15:04:05 MST")
+  }
+  return n.Title + " (" + n.SensorTypeName + ") at " + n.Trip.Format("Mon Jan 2 15:04:05 MST")
+}
+
+/* Constructs a Notifier for every backend listed in config.Notify. */
+func Configured() []Notifier {
+  notifiers := make([]Notifier, 0)
+  for _, cfg := range config.Notify.Webhooks {
+    notifiers = append(notifiers, &webhookNotifier{cfg})
+  }
+  for _, cfg := range config.Notify.Email {
+    notifiers = append(notifiers, &emailNotifier{cfg})
+  }
+  for _, cfg := range config.Notify.Push {
+    switch cfg.Kind {
+    case "ntfy":
+      notifiers = append(notifiers, &ntfyNotifier{cfg})
+    case "gotify":
+      notifiers = append(notifiers, &gotifyNotifier{cfg})
+    default:
+      log.Error("notify.Configured", "unknown push server kind '"+cfg.Kind+"' for '"+cfg.Name+"'")
+    }
+  }
+  for _, n := range notifiers {
+    log.Status("notify.Configured", "notifier '"+n.Name()+"' enabled")
+  }
+  return notifiers
+}
+
+/* How many times Send tries each notifier before giving up. */
+const SEND_ATTEMPTS = 3
+
+/* How long Send waits before its first retry; it doubles after each. */
+var retryDelay = 5 * time.Second
+
+/* Delivers the notification via each of the indicated notifiers, each in its
+ * own goroutine, retrying a failed delivery a couple of times in case the
+ * failure was transient. Failures are logged, not returned. */
+func Send(notifiers []Notifier, n Notification) {
+  for _, notifier := range notifiers {
+    go func(notifier Notifier) {
+      delay := retryDelay
+      for attempt := 1; ; attempt++ {
+        err := notifier.Notify(n)
+        if err == nil {
+          return
+        }
+        if attempt == SEND_ATTEMPTS {
+          log.Error("notify.Send", "delivery via '"+notifier.Name()+"' failed; giving up ", err)
+          return
+        }
+        log.Warn("notify.Send", "delivery via '"+notifier.Name()+"' failed; retrying in "+delay.String()+" ", err)
+        time.Sleep(delay)
+        delay *= 2
+      }
+    }(notifier)
+  }
+}
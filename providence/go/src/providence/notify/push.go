@@ -0,0 +1,71 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package notify
+
+import (
+  "net/url"
+  "strconv"
+  "strings"
+
+  "providence/config"
+  "providence/log"
+)
+
+/* Publishes to a topic on an ntfy server; see https://ntfy.sh/. The body is
+ * the plain text message, and the title & priority go in headers. */
+type ntfyNotifier struct {
+  cfg config.PushConfig
+}
+
+func (p *ntfyNotifier) Name() string {
+  return p.cfg.Name
+}
+
+func (p *ntfyNotifier) Notify(n Notification) error {
+  headers := map[string]string{"Title": n.Title}
+  if p.cfg.Priority > 0 {
+    headers["Priority"] = strconv.Itoa(p.cfg.Priority)
+  }
+  if p.cfg.Token != "" {
+    headers["Authorization"] = "Bearer " + p.cfg.Token
+  }
+  if n.IsAnomalous {
+    headers["Tags"] = "rotating_light"
+  }
+  target := config.URLJoin(p.cfg.URL, url.PathEscape(p.cfg.Topic))
+  log.Debug("notify.ntfy", "publishing '"+n.Title+"' to "+target)
+  return post("notify.ntfy", target, "text/plain", headers, strings.NewReader(n.Body()))
+}
+
+/* Posts to a Gotify server's message API using an application token. */
+type gotifyNotifier struct {
+  cfg config.PushConfig
+}
+
+func (p *gotifyNotifier) Name() string {
+  return p.cfg.Name
+}
+
+func (p *gotifyNotifier) Notify(n Notification) error {
+  type gotifyMessage struct {
+    Title    string `json:"title"`
+    Message  string `json:"message"`
+    Priority int    `json:"priority"`
+  }
+  target := config.URLJoin(p.cfg.URL, "message") + "?token=" + url.QueryEscape(p.cfg.Token)
+  log.Debug("notify.gotify", "posting '"+n.Title+"' to "+p.cfg.URL)
+  return postJSON("notify.gotify", target, nil, gotifyMessage{n.Title, n.Body(), p.cfg.Priority})
+}
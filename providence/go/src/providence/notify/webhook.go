@@ -0,0 +1,84 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package notify
+
+import (
+  "bytes"
+  "encoding/json"
+  "errors"
+  "io"
+  "io/ioutil"
+  "net/http"
+  "strconv"
+  "time"
+
+  "providence/config"
+  "providence/log"
+)
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+/* Issues the indicated request and treats any non-2xx response as an error. */
+func doRequest(component string, req *http.Request) error {
+  res, err := httpClient.Do(req)
+  if err != nil {
+    return err
+  }
+  defer res.Body.Close()
+  body, _ := ioutil.ReadAll(res.Body)
+  if res.StatusCode < 200 || res.StatusCode > 299 {
+    log.Debug(component, "error response body: ", string(body))
+    return errors.New("HTTP status " + strconv.Itoa(res.StatusCode) + " from " + req.URL.Host)
+  }
+  return nil
+}
+
+/* POSTs the indicated object as JSON to the indicated URL. */
+func postJSON(component string, url string, headers map[string]string, obj interface{}) error {
+  j, err := json.Marshal(obj)
+  if err != nil {
+    log.Error(component, "JSON failure during encode", err)
+    return err
+  }
+  return post(component, url, "application/json", headers, bytes.NewReader(j))
+}
+
+func post(component string, url string, mimeType string, headers map[string]string, body io.Reader) error {
+  req, err := http.NewRequest("POST", url, body)
+  if err != nil {
+    log.Error(component, "failed to create HTTP request for "+url, err)
+    return err
+  }
+  req.Header.Add("Content-Type", mimeType)
+  for k, v := range headers {
+    req.Header.Add(k, v)
+  }
+  return doRequest(component, req)
+}
+
+/* Generic webhook: POSTs the Notification as a JSON object to a URL. */
+type webhookNotifier struct {
+  cfg config.WebhookConfig
+}
+
+func (w *webhookNotifier) Name() string {
+  return w.cfg.Name
+}
+
+func (w *webhookNotifier) Notify(n Notification) error {
+  log.Debug("notify.webhook", "posting '"+n.Title+"' to "+w.cfg.URL)
+  return postJSON("notify.webhook", w.cfg.URL, w.cfg.Headers, n)
+}
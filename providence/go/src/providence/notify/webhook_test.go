@@ -0,0 +1,182 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package notify
+
+import (
+  "encoding/json"
+  "errors"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "sync"
+  "testing"
+  "time"
+
+  "providence/config"
+)
+
+var testNote = Notification{
+  EventID:        "ev1",
+  Title:          "Front Door Ajar",
+  Trip:           time.Date(2013, 6, 1, 12, 0, 0, 0, time.UTC),
+  IsAjar:         true,
+  SensorID:       "door",
+  SensorName:     "Front Door",
+  SensorTypeName: "Door",
+}
+
+/* A webhook endpoint that answers with the given statuses in turn, then 200
+ * once they run out, and records what it was sent. */
+type fakeHook struct {
+  mutex    sync.Mutex
+  statuses []int
+  requests []*http.Request
+  notes    []Notification
+  server   *httptest.Server
+}
+
+func newFakeHook(t *testing.T, statuses ...int) *fakeHook {
+  h := &fakeHook{statuses: statuses}
+  h.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+    var n Notification
+    err := json.NewDecoder(req.Body).Decode(&n)
+
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+    h.requests = append(h.requests, req)
+    if err != nil {
+      w.WriteHeader(http.StatusBadRequest)
+      return
+    }
+    h.notes = append(h.notes, n)
+    status := http.StatusOK
+    if len(h.statuses) > 0 {
+      status, h.statuses = h.statuses[0], h.statuses[1:]
+    }
+    w.WriteHeader(status)
+  }))
+  t.Cleanup(h.server.Close)
+  return h
+}
+
+func (h *fakeHook) count() int {
+  h.mutex.Lock()
+  defer h.mutex.Unlock()
+  return len(h.requests)
+}
+
+func (h *fakeHook) received() ([]*http.Request, []Notification) {
+  h.mutex.Lock()
+  defer h.mutex.Unlock()
+  return h.requests, h.notes
+}
+
+func (h *fakeHook) notifier() *webhookNotifier {
+  return &webhookNotifier{config.WebhookConfig{Name: "hook", URL: h.server.URL + "/alert", Headers: map[string]string{"X-Secret": "s3kr1t"}}}
+}
+
+func TestWebhook(t *testing.T) {
+  h := newFakeHook(t)
+  if err := h.notifier().Notify(testNote); err != nil {
+    t.Fatal(err)
+  }
+  requests, notes := h.received()
+  if len(requests) != 1 {
+    t.Fatalf("got %d requests, want 1", len(requests))
+  }
+  req := requests[0]
+  if req.Method != "POST" || req.URL.Path != "/alert" {
+    t.Errorf("got %s %s", req.Method, req.URL.Path)
+  }
+  if ct := req.Header.Get("Content-Type"); ct != "application/json" {
+    t.Errorf("got Content-Type %q", ct)
+  }
+  if secret := req.Header.Get("X-Secret"); secret != "s3kr1t" {
+    t.Errorf("configured header missing; got %q", secret)
+  }
+  got := notes[0]
+  if got.EventID != testNote.EventID || got.Title != testNote.Title || !got.Trip.Equal(testNote.Trip) || !got.IsAjar {
+    t.Errorf("posted %+v, want %+v", got, testNote)
+  }
+}
+
+func TestWebhookFailure(t *testing.T) {
+  for _, status := range []int{http.StatusNotFound, http.StatusInternalServerError} {
+    h := newFakeHook(t, status)
+    err := h.notifier().Notify(testNote)
+    if err == nil || !strings.Contains(err.Error(), "HTTP status") {
+      t.Errorf("got error %v for HTTP %d", err, status)
+    }
+  }
+
+  // nobody listening
+  h := newFakeHook(t)
+  n := h.notifier()
+  h.server.Close()
+  if err := n.Notify(testNote); err == nil {
+    t.Error("no error from an unreachable webhook")
+  }
+}
+
+func withRetryDelay(t *testing.T, d time.Duration) {
+  saved := retryDelay
+  retryDelay = d
+  t.Cleanup(func() { retryDelay = saved })
+}
+
+/* Waits for the hook to have been called the indicated number of times, and
+ * then a little longer to make sure it isn't called again. */
+func expectCalls(t *testing.T, h *fakeHook, want int) {
+  t.Helper()
+  deadline := time.Now().Add(2 * time.Second)
+  for h.count() < want && time.Now().Before(deadline) {
+    time.Sleep(5 * time.Millisecond)
+  }
+  time.Sleep(50 * time.Millisecond)
+  if got := h.count(); got != want {
+    t.Errorf("got %d attempts, want %d", got, want)
+  }
+}
+
+func TestSendRetries(t *testing.T) {
+  withRetryDelay(t, time.Millisecond)
+  h := newFakeHook(t, http.StatusServiceUnavailable, http.StatusBadGateway)
+  Send([]Notifier{h.notifier()}, testNote)
+  expectCalls(t, h, 3)
+}
+
+func TestSendGivesUp(t *testing.T) {
+  withRetryDelay(t, time.Millisecond)
+  statuses := make([]int, 2*SEND_ATTEMPTS)
+  for i := range statuses {
+    statuses[i] = http.StatusInternalServerError
+  }
+  h := newFakeHook(t, statuses...)
+  Send([]Notifier{h.notifier()}, testNote)
+  expectCalls(t, h, SEND_ATTEMPTS)
+}
+
+type failingNotifier struct{}
+
+func (failingNotifier) Name() string                { return "broken" }
+func (failingNotifier) Notify(n Notification) error { return errors.New("broken") }
+
+func TestSendIsolatesNotifiers(t *testing.T) {
+  withRetryDelay(t, time.Millisecond)
+  h := newFakeHook(t)
+  Send([]Notifier{failingNotifier{}, h.notifier()}, testNote)
+  expectCalls(t, h, 1)
+}
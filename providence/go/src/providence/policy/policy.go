@@ -22,6 +22,7 @@ import (
 
   "providence/common"
   "providence/config"
+  "providence/db"
   "providence/log"
   "providence/types"
 )
@@ -34,9 +35,9 @@ type timeWindow struct {
 }
 
 /* Parse string times & durations from config into a struct. */
-func parseExclusionIntervals() []timeWindow {
+func parseExclusionIntervals(intervals []config.ExclusionIntervalConfig) []timeWindow {
   windows := []timeWindow{}
-  for _, w := range config.Sensor.ExclusionIntervals {
+  for _, w := range intervals {
     providedStart, err := time.Parse("3:04pm", w.Start)
     if err != nil {
       log.Warn("policy.exclusions", "exclusion interval time failed to parse ", w.Start)
@@ -56,13 +57,131 @@ func parseExclusionIntervals() []timeWindow {
   return windows
 }
 
+/* The policy settings in effect for a single sensor, resolved from the
+ * global, zone and sensor levels of the config. */
+type rule struct {
+  ajarThreshold   time.Duration
+  resendFrequency time.Duration
+  entryDelay      time.Duration
+  exitDelay       time.Duration
+  windows         []timeWindow
+}
+
+/* Resolves the most specific rule for every configured sensor: a value set
+ * on the sensor wins over one set on its zone, which wins over the global
+ * default. */
+func resolveRules() map[string]rule {
+  rules := make(map[string]rule)
+  for id, sensor := range types.Sensors {
+    levels := []config.PolicyRuleConfig{{
+      AjarThreshold:      config.Sensor.AjarThreshold,
+      ResendFrequency:    config.Sensor.ResendFrequency,
+      EntryDelay:         config.Sensor.EntryDelay,
+      ExitDelay:          config.Sensor.ExitDelay,
+      ExclusionIntervals: config.Sensor.ExclusionIntervals,
+    }}
+    if zone, ok := config.Zones[sensor.Zone]; ok && sensor.Zone != "" {
+      levels = append(levels, zone)
+    }
+    if r, ok := config.Rules[id]; ok {
+      levels = append(levels, r)
+    }
+
+    var merged config.PolicyRuleConfig
+    for _, level := range levels {
+      if level.AjarThreshold != 0 {
+        merged.AjarThreshold = level.AjarThreshold
+      }
+      if level.ResendFrequency != 0 {
+        merged.ResendFrequency = level.ResendFrequency
+      }
+      if level.EntryDelay != 0 {
+        merged.EntryDelay = level.EntryDelay
+      }
+      if level.ExitDelay != 0 {
+        merged.ExitDelay = level.ExitDelay
+      }
+      if level.ExclusionIntervals != nil {
+        merged.ExclusionIntervals = level.ExclusionIntervals
+      }
+    }
+    rules[id] = rule{
+      ajarThreshold:   merged.AjarThreshold * time.Second,
+      resendFrequency: merged.ResendFrequency * time.Second,
+      entryDelay:      merged.EntryDelay * time.Second,
+      exitDelay:       merged.ExitDelay * time.Second,
+      windows:         parseExclusionIntervals(merged.ExclusionIntervals),
+    }
+    log.Debug("policy.resolveRules", "rule for '"+id+"': ", rules[id])
+  }
+  return rules
+}
+
+/* Indicates whether the current time falls within any of the indicated
+ * exclusion windows. */
+func inExclusionWindow(windows []timeWindow, now time.Time) bool {
+  for _, w := range windows {
+    legit := false
+    for _, dow := range w.Weekdays {
+      if now.Weekday() == dow {
+        legit = true
+        break
+      }
+    }
+    if !legit {
+      continue
+    }
+    start := time.Date(now.Year(), now.Month(), now.Day(), w.Hour, w.Minute, 0, 0, time.Local)
+    end := start.Add(w.Duration)
+    if now.After(start) && now.Before(end) {
+      return true
+    }
+  }
+  return false
+}
+
+/* Indicates whether a trip of the indicated sensor is anomalous under the
+ * indicated system mode. Away arms everything; Home and Night arm only the
+ * sensors (or zones) configured for them; Disarmed falls back to the
+ * sensor's exclusion windows. */
+func isAnomalous(sensor types.Sensor, mode types.SystemMode, windows []timeWindow, now time.Time) bool {
+  var armed []string
+  switch mode {
+  case types.AWAY:
+    return true
+  case types.HOME:
+    armed = config.Mode.Home
+  case types.NIGHT:
+    armed = config.Mode.Night
+  default:
+    // skip windows and always send motion events, as they are more like
+    // state updates than events
+    if sensor.Subject == types.MOTION {
+      return true
+    }
+    return !inExclusionWindow(windows, now)
+  }
+  for _, id := range armed {
+    if id == sensor.SensorID || (sensor.Zone != "" && id == sensor.Zone) {
+      return true
+    }
+  }
+  return false
+}
+
 /* Looks for low-level events on the incoming channel and applies some
  * heuristics to determine whether they are noteworthy. Will inject
  * higher-level eventCodes (ajar, anomalous) to the outgoing channel as
  * appropriate.
  *
- * Currently the heuristics are exclusion intervals and 'door is ajar'
- * detection. Should only be registered for low-level events.
+ * Currently the heuristics are the system mode, exclusion intervals and 'door
+ * is ajar' detection, with thresholds taken from the most specific of the
+ * sensor, zone or global rules. Should only be registered for low-level
+ * events.
+ *
+ * When armed, trips within a sensor's exit delay of arming are ignored, and
+ * trips of a sensor with an entry delay are first sent out as pending; they
+ * only become anomalous if the system is still armed when the delay expires.
  */
 func SensorMonitor(incoming chan types.Event, outgoing chan string) {
   // local structs used in synthesizing human-meaningful events from raw events
@@ -70,74 +189,115 @@ func SensorMonitor(incoming chan types.Event, outgoing chan string) {
     event types.Event
     nextSend time.Time
   }
+  type entryDelayState struct {
+    event    types.Event
+    deadline time.Time
+  }
 
-  ajarThreshold := config.Sensor.AjarThreshold * time.Second
-  resendFrequency := 1 * time.Minute
   lastTrips := make(map[string]*ajarRuleState)
+  pending := make(map[string]*entryDelayState)
   ticker := time.Tick(1 * time.Second)
 
-  // pre-parse the exclusion windows and ajar rules so we don't perpetually
+  // pre-resolve the exclusion windows and ajar rules so we don't perpetually
   // re-parse in the ticker loop
-  windows := parseExclusionIntervals()
+  rules := resolveRules()
   for {
     select {
     case e := <-incoming:
       now := time.Now()
-
+      if e.IsOffline || e.IsTampered {
+        break // not a reading from the sensor; escalated regardless of policy
+      }
 
       // record trips for ajar-detection, and clear on resets
       last, ok := lastTrips[e.SensorID]
+      isNewTrip := false
       if e.Reset == nil {
         if ok {
           if last.event.EventID != e.EventID {
             log.Error("policy.SensorMonitor", "multiple extant events for same sensor '"+e.SensorID+"' ('"+e.EventID+"', '"+last.event.EventID+"'")
-            last.event = e
+            isNewTrip = true
           }
+          last.event = e // pick up updates, e.g. acknowledgement
         } else {
-          lastTrips[e.SensorID] = ajarRuleState{e, now.Add(ajarThreshold)}
+          lastTrips[e.SensorID] = &ajarRuleState{e, now.Add(rules[e.SensorID].ajarThreshold)}
+          isNewTrip = true
         }
       } else if ok {
         delete(lastTrips, e.SensorID)
       }
 
-      // check trips against exclusion intervals for anomalous events
-      if e.Reset == nil {
-        inWindow := false
-        if e.Which.Kind != types.MOTION {
-          // skip windows and always send motion events, as they are more
-          // like state updates than events
-          for _, w := range windows {
-            legit := false
-            for _, dow := range w.Weekdays {
-              if now.Weekday() == dow {
-                legit = true
-                break
-              }
-            }
-            if !legit {
-              continue
-            }
-            start := time.Date(now.Year(), now.Month(), now.Day(), w.Hour, w.Minute, 0, 0, time.Local)
-            end := start.Add(w.Duration)
-            if now.After(start) && now.Before(end) {
-              inWindow = true
-              break
-            }
-          }
+      // check new trips against the system mode & exclusion intervals for
+      // anomalous events; anything else is an update to a trip we've already
+      // judged, possibly our own output coming back around via the dispatcher
+      if !isNewTrip {
+        break
+      }
+      mode, err := db.GetMode()
+      if err != nil {
+        log.Error("policy.SensorMonitor", "failed to load system mode; assuming Disarmed", err)
+      }
+      if !isAnomalous(e.Sensor(), mode.Mode, rules[e.SensorID].windows, now) {
+        break
+      }
+      r := rules[e.SensorID]
+      armed := mode.Mode != types.DISARMED
+      switch {
+      case armed && now.Sub(mode.Changed) < r.exitDelay:
+        log.Status("policy.SensorMonitor", "ignoring trip of '"+e.SensorID+"' during exit delay")
+      case armed && r.entryDelay > 0:
+        log.Status("policy.SensorMonitor", "trip of '"+e.SensorID+"' pending for entry delay of ", r.entryDelay)
+        lock := common.LockEvent(e.EventID)
+        lock.event.IsPending = true
+        lock.Commit()
+        pending[e.EventID] = &entryDelayState{e, now.Add(r.entryDelay)}
+        outgoing <- lock.event.EventID
+      default:
+        lock := common.LockEvent(e.EventID)
+        lock.event.IsAnomalous = true
+        lock.Commit()
+        outgoing <- lock.event.EventID
+      }
+
+    case <-ticker:
+      now := time.Now()
+
+      // once per second, resolve pending trips: if the system was disarmed
+      // since the trip the alarm is called off, and if the entry delay ran
+      // out first it escalates
+      if len(pending) > 0 {
+        mode, err := db.GetMode()
+        if err != nil {
+          log.Error("policy.SensorMonitor", "failed to load system mode during entry delay", err)
         }
-        if !inWindow {
-          lock := common.LockEvent(e.EventID)
-          lock.event.IsAnomalous = true
+        for id, p := range pending {
+          disarmed := mode.Mode == types.DISARMED && mode.Changed.After(p.event.Trip)
+          if !disarmed && now.Before(p.deadline) {
+            continue
+          }
+          delete(pending, id)
+          lock := common.LockEvent(id)
+          lock.event.IsPending = false
+          if disarmed {
+            log.Status("policy.SensorMonitor", "'"+id+"' disarmed by "+mode.ChangedBy+" during entry delay")
+          } else {
+            log.Status("policy.SensorMonitor", "entry delay expired for '"+id+"'")
+            lock.event.IsAnomalous = true
+          }
           lock.Commit()
-          outgoing <- lock.event.EventID
+          outgoing <- id
         }
       }
 
-    case <-ticker:
-      // once per second, check whether anything is (still) Ajar & (re)transmit if it's time to
-      for _, last := range lastTrips {
-        if time.Since(last.event.Trip) > ajarThreshold && now.After(last.nextSend) {
-          last.nextSend.Add(resendFrequency)
+      // once per second, check whether anything is (still) Ajar & (re)transmit
+      // if it's time to; once someone has acknowledged it, stop nagging
+      for id, last := range lastTrips {
+        if last.event.AckedBy != "" {
+          continue
+        }
+        r := rules[id]
+        if now.Sub(last.event.Trip) > r.ajarThreshold && now.After(last.nextSend) {
+          last.nextSend = now.Add(r.resendFrequency)
           lock := common.LockEvent(last.event.EventID)
           lock.event.IsAjar = true
           lock.Commit()
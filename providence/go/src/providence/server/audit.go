@@ -0,0 +1,98 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+  "io"
+  "net"
+  "net/http"
+  "strconv"
+
+  "providence/db"
+  "providence/log"
+)
+
+/* Returns the address the request came from, without the port. */
+func sourceIP(req *http.Request) string {
+  host, _, err := net.SplitHostPort(req.RemoteAddr)
+  if err != nil {
+    return req.RemoteAddr
+  }
+  return host
+}
+
+/* Records an action taken on behalf of the request in the audit log. */
+func audit(req *http.Request, principal string, action string, target string, outcome string, detail string) {
+  db.Audit(db.AuditEntry{
+    Principal: principal,
+    Action:    action,
+    Target:    target,
+    SourceIP:  sourceIP(req),
+    Outcome:   outcome,
+    Detail:    detail,
+  })
+}
+
+/* Shortens a long opaque identifier like a registration ID, so the audit log
+ * can tell them apart without holding the whole secret. */
+func abbreviate(id string) string {
+  if len(id) <= 16 {
+    return id
+  }
+  return id[:16] + "..."
+}
+
+/* Returns audit log entries, newest first. Query parameters:
+ * - principal: exact email or username
+ * - action: action prefix, e.g. "mode." or "request"
+ * - since, until: RFC 3339 times
+ * - limit: maximum entries to return
+ */
+func handleAudit(writer http.ResponseWriter, req *http.Request) {
+  if _, ok := checkAuth(writer, req, PERM_ADMIN); !ok {
+    return
+  }
+  if req.Method != "GET" {
+    writer.WriteHeader(http.StatusMethodNotAllowed)
+    io.WriteString(writer, "NO\n")
+    return
+  }
+
+  query := req.URL.Query()
+  filter := db.AuditFilter{Principal: query.Get("principal"), Action: query.Get("action")}
+  var err error
+  if filter.Since, err = parseTimeParam(query, "since"); err == nil {
+    if filter.Until, err = parseTimeParam(query, "until"); err == nil {
+      if l := query.Get("limit"); l != "" {
+        filter.Limit, err = strconv.Atoi(l)
+      }
+    }
+  }
+  if err != nil {
+    log.Warn("server.audit", "bad query '"+req.URL.RawQuery+"'", err)
+    writer.WriteHeader(http.StatusBadRequest)
+    io.WriteString(writer, "BAD QUERY\n")
+    return
+  }
+
+  entries, err := db.QueryAudit(filter)
+  if err != nil {
+    writer.WriteHeader(http.StatusInternalServerError)
+    io.WriteString(writer, "FAIL")
+    return
+  }
+  writeJSON(writer, "server.audit", entries)
+}
@@ -0,0 +1,285 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+  "errors"
+  "io"
+  "net"
+  "net/http"
+  "strconv"
+  "strings"
+  "time"
+
+  "providence/config"
+  "providence/db"
+  "providence/log"
+)
+
+/* What handlers require of callers. Each role grants a fixed set of
+ * these; see rolePermissions. */
+const (
+  PERM_VIEW  = "view"  // sensor state, events, photos
+  PERM_ARM   = "arm"   // change the system mode, acknowledge alerts
+  PERM_ADMIN = "admin" // device registrations, notification queue
+)
+
+var rolePermissions = map[string][]string{
+  config.ROLE_VIEWER:   {PERM_VIEW},
+  config.ROLE_OPERATOR: {PERM_VIEW, PERM_ARM},
+  config.ROLE_ADMIN:    {PERM_VIEW, PERM_ARM, PERM_ADMIN},
+}
+
+/* Scopes from before roles existed, which older API tokens may carry. */
+var legacyScopes = map[string][]string{
+  "read":  {PERM_VIEW},
+  "write": {PERM_VIEW, PERM_ARM, PERM_ADMIN},
+}
+
+/* Indicates whether every permission named is one we know about; used to
+ * vet API token scopes. */
+func ValidPermissions(perms []string) bool {
+  for _, p := range perms {
+    if p != PERM_VIEW && p != PERM_ARM && p != PERM_ADMIN {
+      return false
+    }
+  }
+  return true
+}
+
+/* An authenticated user, their role, and what they're allowed to do, which
+ * is usually just what the role grants but may be less for an API token. */
+type principal struct {
+  Name        string
+  Role        string
+  Permissions []string
+}
+
+func newPrincipal(name string, role string) principal {
+  return principal{name, role, rolePermissions[role]}
+}
+
+func (p principal) has(perm string) bool {
+  for _, have := range p.Permissions {
+    if have == perm {
+      return true
+    }
+  }
+  return false
+}
+
+/* Restricts the principal to those of its permissions that are also in
+ * scopes. */
+func (p principal) limitTo(scopes []string) principal {
+  allowed := make(map[string]bool)
+  for _, s := range scopes {
+    if legacy, ok := legacyScopes[s]; ok {
+      for _, perm := range legacy {
+        allowed[perm] = true
+      }
+    } else {
+      allowed[s] = true
+    }
+  }
+  perms := make([]string, 0)
+  for _, perm := range p.Permissions {
+    if allowed[perm] {
+      perms = append(perms, perm)
+    }
+  }
+  p.Permissions = perms
+  return p
+}
+
+/* Returns a user's role: from the database if set there, else from config. */
+func lookupRole(username string) (string, error) {
+  role, err := storedRole(username)
+  if err != nil || role != "" {
+    return role, err
+  }
+  return configuredRole(username), nil
+}
+
+/* Returns the role set for a user in the database, or "" if none is. */
+func storedRole(username string) (string, error) {
+  role, err := db.GetRole(username)
+  if err != nil {
+    return "", err
+  }
+  if role != "" && !config.ValidRole(role) {
+    log.Warn("server.storedRole", "ignoring unknown role '"+role+"' for "+username)
+    role = ""
+  }
+  return role, nil
+}
+
+/* Returns the role config assigns a user, or DefaultRole. */
+func configuredRole(username string) string {
+  if role := config.UserAuth.Roles[username]; role != "" {
+    return role
+  }
+  return config.UserAuth.DefaultRole
+}
+
+/* Indicates whether a bearer credential looks like a JWT rather than one of
+ * our opaque API tokens. */
+func isJWT(token string) bool {
+  return strings.Count(token, ".") == 2
+}
+
+/* Works out who made the request, trying each kind of credential that the
+ * configured providers accept:
+ * - an OIDC ID token ("google", "oidc") in the X-OAuth-JWT header, or as
+ *   "Authorization: Bearer <token>"
+ * - a local API token, as "Authorization: Bearer <token>" ("local")
+ * - a local browser session cookie, as set by the login handler ("local")
+ */
+func authenticate(req *http.Request) (principal, error) {
+  oidc := len(verifiers) > 0
+  bearer := ""
+  if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+    bearer = strings.TrimPrefix(auth, "Bearer ")
+  }
+
+  if token := req.Header.Get("X-OAuth-JWT"); token != "" && oidc {
+    return verifyToken(token)
+  }
+  if bearer != "" && isJWT(bearer) && oidc {
+    return verifyToken(bearer)
+  }
+  if !config.AuthEnabled(config.AUTH_LOCAL) {
+    return principal{}, errors.New("auth token not present")
+  }
+
+  if bearer != "" {
+    username, scopes, err := db.CheckAPIToken(bearer)
+    if err != nil {
+      return principal{}, err
+    }
+    role, err := lookupRole(username)
+    if err != nil {
+      return principal{}, err
+    }
+    return newPrincipal(username, role).limitTo(scopes), nil
+  }
+
+  if cookie, err := req.Cookie(config.UserAuth.SessionCookie); err == nil {
+    username, err := db.GetSession(cookie.Value)
+    if err != nil {
+      return principal{}, err
+    }
+    role, err := lookupRole(username)
+    if err != nil {
+      return principal{}, err
+    }
+    return newPrincipal(username, role), nil
+  }
+  return principal{}, errors.New("no credentials present")
+}
+
+/* Failed local logins, by username and by client address. */
+var logins = newThrottle()
+
+/* Starts a browser session for a local user; expects a POSTed form with
+ * "username" and "password". Clients that keep failing are made to wait
+ * between attempts; see throttle. */
+func handleLogin(writer http.ResponseWriter, req *http.Request) {
+  if !config.AuthEnabled(config.AUTH_LOCAL) {
+    writer.WriteHeader(http.StatusNotFound)
+    io.WriteString(writer, "404")
+    return
+  }
+  if req.Method != "POST" {
+    writer.WriteHeader(http.StatusMethodNotAllowed)
+    io.WriteString(writer, "NO\n")
+    return
+  }
+
+  username := req.FormValue("username")
+  host, _, err := net.SplitHostPort(req.RemoteAddr)
+  if err != nil {
+    host = req.RemoteAddr
+  }
+  userKey, hostKey := "user:"+username, "host:"+host
+  if wait := logins.wait(userKey, hostKey); wait > 0 {
+    log.Warn("server.login", "throttled login for '"+username+"' from "+req.RemoteAddr)
+    audit(req, username, "session.login", "", db.AUDIT_DENIED, "throttled")
+    writer.Header().Set("Retry-After", strconv.Itoa(int(wait/time.Second)+1))
+    writer.WriteHeader(http.StatusTooManyRequests)
+    io.WriteString(writer, "NO\n")
+    return
+  }
+
+  err = db.CheckPassword(username, req.FormValue("password"))
+  if err == db.ErrBadCredentials {
+    log.Warn("server.login", "failed login for '"+username+"' from "+req.RemoteAddr)
+    audit(req, username, "session.login", "", db.AUDIT_DENIED, "bad credentials")
+    logins.fail(userKey, hostKey)
+    writer.WriteHeader(http.StatusForbidden)
+    io.WriteString(writer, "NO\n")
+    return
+  }
+  if err != nil {
+    writer.WriteHeader(http.StatusInternalServerError)
+    io.WriteString(writer, "FAIL")
+    return
+  }
+
+  lifetime := config.UserAuth.SessionLifetime * time.Second
+  session, err := db.CreateSession(username, lifetime)
+  if err != nil {
+    writer.WriteHeader(http.StatusInternalServerError)
+    io.WriteString(writer, "FAIL")
+    return
+  }
+  logins.forget(userKey)
+  log.Status("server.login", username+" logged in from "+req.RemoteAddr)
+  audit(req, username, "session.login", "", db.AUDIT_OK, "")
+  http.SetCookie(writer, &http.Cookie{
+    Name:     config.UserAuth.SessionCookie,
+    Value:    session,
+    Path:     "/",
+    Expires:  time.Now().Add(lifetime),
+    Secure:   req.TLS != nil,
+    HttpOnly: true,
+    SameSite: http.SameSiteStrictMode,
+  })
+  writer.WriteHeader(http.StatusOK)
+  io.WriteString(writer, "OK\n")
+}
+
+/* Ends the browser session named by the request's cookie, if any. */
+func handleLogout(writer http.ResponseWriter, req *http.Request) {
+  if req.Method != "POST" {
+    writer.WriteHeader(http.StatusMethodNotAllowed)
+    io.WriteString(writer, "NO\n")
+    return
+  }
+  if cookie, err := req.Cookie(config.UserAuth.SessionCookie); err == nil {
+    username, _ := db.GetSession(cookie.Value)
+    db.DeleteSession(cookie.Value)
+    audit(req, username, "session.logout", "", db.AUDIT_OK, "")
+  }
+  http.SetCookie(writer, &http.Cookie{
+    Name:     config.UserAuth.SessionCookie,
+    Value:    "",
+    Path:     "/",
+    MaxAge:   -1,
+    HttpOnly: true,
+  })
+  writer.WriteHeader(http.StatusOK)
+  io.WriteString(writer, "OK\n")
+}
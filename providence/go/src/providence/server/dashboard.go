@@ -0,0 +1,340 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+  "bytes"
+  "html/template"
+  "io"
+  "net/http"
+  "sort"
+  "strconv"
+
+  "providence/config"
+  "providence/db"
+  "providence/log"
+  "providence/types"
+)
+
+/* Current state of a single sensor, as shown on the dashboard. */
+type sensorState struct {
+  SensorID string
+  Name     string
+  Type     string
+  Zone     string
+  Latest   *types.Event // nil if the sensor has never tripped
+}
+
+/* Returns every configured sensor along with its most recent event. */
+func handleSensors(writer http.ResponseWriter, req *http.Request) {
+  if _, ok := checkAuth(writer, req, PERM_VIEW); !ok {
+    return
+  }
+  latest, err := db.GetLatestEvents()
+  if err != nil {
+    writer.WriteHeader(http.StatusInternalServerError)
+    io.WriteString(writer, "FAIL")
+    return
+  }
+
+  states := make([]sensorState, 0, len(types.Sensors))
+  for id, sensor := range types.Sensors {
+    state := sensorState{id, sensor.Name, sensor.SubjectName(), sensor.Zone, nil}
+    if event, ok := latest[id]; ok {
+      state.Latest = &event
+    }
+    states = append(states, state)
+  }
+  sort.Sort(byName(states))
+  writeJSON(writer, "server.sensors", states)
+}
+
+type byName []sensorState
+
+func (s byName) Len() int           { return len(s) }
+func (s byName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
+/* The dashboard page itself is a static shell and is served without auth;
+ * it holds no data of its own. Everything it displays comes from API requests
+ * that go through checkAuth like any other client: local users log in for a
+ * session cookie, and OIDC users paste an ID token, which the page keeps in
+ * localStorage and attaches to each request. */
+func handleDashboard(writer http.ResponseWriter, req *http.Request) {
+  paths := map[string]string{
+    "Mode":      config.URLPath.Mode,
+    "Sensors":   config.URLPath.Sensors,
+    "Events":    config.URLPath.Events,
+    "Stream":    config.URLPath.Stream,
+    "PhotoList": config.URLPath.PhotoList,
+    "Ack":       config.URLPath.Ack,
+    "Login":     config.URLPath.Login,
+    "Logout":    config.URLPath.Logout,
+
+    "StreamCookie": STREAM_TOKEN_COOKIE,
+  }
+  var buf bytes.Buffer
+  if err := dashboardTemplate.Execute(&buf, paths); err != nil {
+    log.Error("server.dashboard", "failed to render dashboard", err)
+    writer.WriteHeader(http.StatusInternalServerError)
+    io.WriteString(writer, "FAIL")
+    return
+  }
+  writer.Header().Add("Content-Type", "text/html; charset=utf-8")
+  writer.Header().Add("Content-Length", strconv.Itoa(buf.Len()))
+  writer.Header().Add("Cache-control", "no-cache")
+  writer.WriteHeader(http.StatusOK)
+  writer.Write(buf.Bytes())
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(dashboardHTML))
+
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Providence</title>
+<style>
+  body { font-family: sans-serif; margin: 0; background: #f4f4f4; color: #222; }
+  header { background: #263238; color: #fff; padding: 0.75em 1em; display: flex; flex-wrap: wrap; align-items: center; gap: 0.5em; }
+  header h1 { font-size: 1.2em; margin: 0 1em 0 0; }
+  main { padding: 1em; max-width: 60em; margin: auto; }
+  section { background: #fff; border-radius: 4px; padding: 0.5em 1em; margin-bottom: 1em; }
+  button { padding: 0.4em 0.8em; border: 1px solid #888; border-radius: 3px; background: #eee; cursor: pointer; }
+  button.active { background: #1565c0; color: #fff; border-color: #1565c0; }
+  table { width: 100%; border-collapse: collapse; }
+  td, th { text-align: left; padding: 0.3em; border-bottom: 1px solid #ddd; vertical-align: top; }
+  .tripped { color: #c62828; font-weight: bold; }
+  .anomalous { background: #ffebee; }
+  .thumbs img { height: 80px; margin: 2px; }
+  #login { display: none; }
+  #status { margin-left: auto; font-size: 0.9em; }
+</style>
+</head>
+<body>
+<header>
+  <h1>Providence</h1>
+  <span id="modes"></span>
+  <span id="status"></span>
+  <button id="logout">Sign out</button>
+</header>
+<main>
+  <section id="login">
+    <form id="local">
+      <p>Sign in to continue.</p>
+      <input id="username" placeholder="username" autocomplete="username">
+      <input id="password" type="password" placeholder="password" autocomplete="current-password">
+      <button>Sign in</button>
+    </form>
+    <p>Or paste an ID token:
+    <input id="token" type="password" size="40"> <button id="save">Save</button></p>
+  </section>
+  <section>
+    <h2>Sensors</h2>
+    <table><thead><tr><th>Sensor</th><th>Zone</th><th>State</th><th>Since</th></tr></thead>
+    <tbody id="sensors"></tbody></table>
+  </section>
+  <section>
+    <h2>Timeline</h2>
+    <table><tbody id="events"></tbody></table>
+    <p><button id="more">Older</button></p>
+  </section>
+</main>
+<script>
+(function() {
+  var paths = {{.}};
+  var modes = ["Disarmed", "Home", "Away", "Night"];
+  var cursor = "";
+
+  function $(id) { return document.getElementById(id); }
+  function token() { return localStorage.getItem("providence.token") || ""; }
+  function fmt(t) { return t ? new Date(t).toLocaleString() : ""; }
+  function text(s) { return document.createTextNode(s == null ? "" : s); }
+  function cell(row, content) {
+    var td = document.createElement("td");
+    td.appendChild(typeof content === "string" ? text(content) : content);
+    row.appendChild(td);
+    return td;
+  }
+
+  function api(method, path, body) {
+    var headers = token() ? {"X-OAuth-JWT": token()} : {};
+    return fetch(path, {method: method, body: body, headers: headers, credentials: "same-origin"}).then(function(res) {
+      if (res.status == 403) {
+        if (method == "GET") {
+          $("login").style.display = "block";
+        } else {
+          alert("You don't have permission to do that.");
+        }
+        throw new Error("not authorized");
+      }
+      if (!res.ok) {
+        throw new Error(method + " " + path + ": " + res.status);
+      }
+      return res;
+    });
+  }
+
+  function describe(ev) {
+    if (ev.IsOffline) { return ev.Reset ? "Back online" : "Offline"; }
+    if (ev.IsTampered) { return ev.Reset ? "Tamper cleared" : "Tampered (" + ev.Tamper + ")"; }
+    if (ev.IsPending) { return "Tripped (alarm pending)"; }
+    if (ev.IsAjar) { return "Ajar"; }
+    if (ev.Reset) { return "Reset"; }
+    return "Tripped";
+  }
+
+  function loadMode() {
+    api("GET", paths.Mode).then(function(res) { return res.json(); }).then(function(state) {
+      var span = $("modes");
+      span.innerHTML = "";
+      modes.forEach(function(m) {
+        var b = document.createElement("button");
+        b.textContent = m;
+        if (m == state.Mode) { b.className = "active"; }
+        b.onclick = function() {
+          if (m != state.Mode && confirm("Set mode to " + m + "?")) {
+            api("POST", paths.Mode, m).then(loadMode);
+          }
+        };
+        span.appendChild(b);
+      });
+      $("status").textContent = state.ChangedBy ? "set by " + state.ChangedBy + " " + fmt(state.Changed) : "";
+    }).catch(console.log);
+  }
+
+  function loadSensors() {
+    api("GET", paths.Sensors).then(function(res) { return res.json(); }).then(function(sensors) {
+      var body = $("sensors");
+      body.innerHTML = "";
+      sensors.forEach(function(s) {
+        var row = document.createElement("tr");
+        var ev = s.Latest;
+        cell(row, s.Name + " (" + s.Type + ")");
+        cell(row, s.Zone || "");
+        var state = cell(row, !ev ? "Never tripped" : ev.Reset && !ev.IsOffline && !ev.IsTampered ? "Closed" : describe(ev));
+        if (ev && !ev.Reset) { state.className = "tripped"; }
+        cell(row, ev ? fmt(ev.Reset || ev.Trip) : "");
+        body.appendChild(row);
+      });
+    }).catch(console.log);
+  }
+
+  function showPhotos(ev, td) {
+    api("GET", paths.PhotoList + ev.EventID).then(function(res) { return res.json(); }).then(function(urls) {
+      td.innerHTML = "";
+      (urls[ev.EventID] || []).forEach(function(url) {
+        api("GET", url).then(function(res) { return res.blob(); }).then(function(blob) {
+          var img = document.createElement("img");
+          img.src = URL.createObjectURL(blob);
+          img.onclick = function() { window.open(img.src); };
+          td.appendChild(img);
+        });
+      });
+      if (!td.firstChild) { td.appendChild(text("No photos")); }
+    }).catch(console.log);
+  }
+
+  function eventRow(ev) {
+    var row = document.createElement("tr");
+    row.id = "ev-" + ev.EventID;
+    if (ev.IsAnomalous) { row.className = "anomalous"; }
+    cell(row, fmt(ev.Trip));
+    cell(row, ev.SensorID);
+    cell(row, describe(ev) + (ev.Reset ? " at " + fmt(ev.Reset) : ""));
+    var extra = cell(row, "");
+    extra.className = "thumbs";
+    var photos = document.createElement("button");
+    photos.textContent = "Photos";
+    photos.onclick = function() { showPhotos(ev, extra); };
+    extra.appendChild(photos);
+    if (ev.IsAnomalous && !ev.AckedBy) {
+      var ack = document.createElement("button");
+      ack.textContent = "Acknowledge";
+      ack.onclick = function() { api("POST", paths.Ack + ev.EventID).then(loadSensors).catch(console.log); };
+      extra.appendChild(ack);
+    } else if (ev.AckedBy) {
+      extra.appendChild(text(" acknowledged by " + ev.AckedBy));
+    }
+    return row;
+  }
+
+  function loadEvents() {
+    var q = "?limit=25" + (cursor ? "&cursor=" + encodeURIComponent(cursor) : "");
+    api("GET", paths.Events + q).then(function(res) { return res.json(); }).then(function(page) {
+      page.Events.forEach(function(ev) { $("events").appendChild(eventRow(ev)); });
+      cursor = page.NextCursor;
+      $("more").style.display = cursor ? "inline" : "none";
+    }).catch(console.log);
+  }
+
+  // EventSource can't send headers, so the stream gets the token as a cookie
+  function streamCookie(value) {
+    var attrs = "; path=" + paths.Stream + "; samesite=strict" + (location.protocol == "https:" ? "; secure" : "");
+    document.cookie = paths.StreamCookie + "=" + value + attrs + (value ? "" : "; max-age=0");
+  }
+
+  function stream() {
+    streamCookie(token());
+    var src = new EventSource(paths.Stream);
+    src.onmessage = function(msg) {
+      var ev = JSON.parse(msg.data);
+      var row = eventRow(ev);
+      var old = $("ev-" + ev.EventID);
+      if (old) {
+        old.parentNode.replaceChild(row, old);
+      } else {
+        $("events").insertBefore(row, $("events").firstChild);
+      }
+      loadSensors();
+    };
+  }
+
+  $("save").onclick = function() {
+    localStorage.setItem("providence.token", $("token").value);
+    location.reload();
+  };
+  $("local").onsubmit = function(e) {
+    e.preventDefault();
+    var form = new URLSearchParams();
+    form.append("username", $("username").value);
+    form.append("password", $("password").value);
+    fetch(paths.Login, {method: "POST", body: form, credentials: "same-origin"}).then(function(res) {
+      if (res.ok) {
+        localStorage.removeItem("providence.token");
+        location.reload();
+      } else {
+        alert("Sign in failed.");
+      }
+    });
+  };
+  $("logout").onclick = function() {
+    localStorage.removeItem("providence.token");
+    streamCookie("");
+    fetch(paths.Logout, {method: "POST", credentials: "same-origin"}).then(function() { location.reload(); });
+  };
+  $("more").onclick = loadEvents;
+
+  loadMode();
+  loadSensors();
+  loadEvents();
+  stream();
+})();
+</script>
+</body>
+</html>
+`
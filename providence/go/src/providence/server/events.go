@@ -0,0 +1,187 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+  "encoding/json"
+  "io"
+  "net/http"
+  "net/url"
+  "strconv"
+  "strings"
+  "time"
+
+  "providence/db"
+  "providence/export"
+  "providence/log"
+  "providence/types"
+)
+
+/* Marshals the indicated object and writes it as a 200 JSON response, or
+ * writes a 500 if it can't be marshaled. */
+func writeJSON(writer http.ResponseWriter, component string, obj interface{}) {
+  bodyStr, err := json.Marshal(obj)
+  if err != nil {
+    log.Error(component, "could not marshal to JSON", err)
+    writer.WriteHeader(http.StatusInternalServerError)
+    io.WriteString(writer, "FAIL")
+    return
+  }
+  writer.Header().Add("Content-Type", "application/json")
+  writer.Header().Add("Content-Length", strconv.Itoa(len(bodyStr)))
+  writer.WriteHeader(http.StatusOK)
+  writer.Write(bodyStr)
+}
+
+/* Parses an optional "true"/"false" query parameter. */
+func parseBoolParam(query url.Values, name string) (*bool, error) {
+  s := query.Get(name)
+  if s == "" {
+    return nil, nil
+  }
+  b, err := strconv.ParseBool(s)
+  if err != nil {
+    return nil, err
+  }
+  return &b, nil
+}
+
+/* Parses an optional RFC 3339 time query parameter. */
+func parseTimeParam(query url.Values, name string) (time.Time, error) {
+  s := query.Get(name)
+  if s == "" {
+    return time.Time{}, nil
+  }
+  return time.Parse(time.RFC3339, s)
+}
+
+/* Builds a db.EventFilter from query parameters:
+ * - sensor: sensor ID; may be repeated, or comma-separated
+ * - zone: zone name
+ * - since, until: RFC 3339 times bounding the trip time
+ * - anomalous, ajar: "true" or "false"
+ * - cursor: NextCursor from a previous page
+ * - limit: page size
+ */
+func parseEventFilter(query url.Values) (db.EventFilter, error) {
+  var filter db.EventFilter
+  var err error
+
+  for _, s := range query["sensor"] {
+    for _, id := range strings.Split(s, ",") {
+      if id != "" {
+        filter.SensorIDs = append(filter.SensorIDs, id)
+      }
+    }
+  }
+  filter.Zone = query.Get("zone")
+  if filter.Since, err = parseTimeParam(query, "since"); err != nil {
+    return filter, err
+  }
+  if filter.Until, err = parseTimeParam(query, "until"); err != nil {
+    return filter, err
+  }
+  if filter.Anomalous, err = parseBoolParam(query, "anomalous"); err != nil {
+    return filter, err
+  }
+  if filter.Ajar, err = parseBoolParam(query, "ajar"); err != nil {
+    return filter, err
+  }
+  filter.Cursor = query.Get("cursor")
+  if l := query.Get("limit"); l != "" {
+    if filter.Limit, err = strconv.Atoi(l); err != nil {
+      return filter, err
+    }
+  }
+  return filter, nil
+}
+
+/* One page of results from the events resource. */
+type eventsResponse struct {
+  Events     []types.Event
+  NextCursor string
+}
+
+/* The events resource: GET returns a page of events matching the query
+ * parameters described at parseEventFilter, newest first. */
+func handleEvents(writer http.ResponseWriter, req *http.Request) {
+  if _, ok := checkAuth(writer, req, PERM_VIEW); !ok {
+    return
+  }
+  if req.Method != "GET" {
+    writer.WriteHeader(http.StatusMethodNotAllowed)
+    io.WriteString(writer, "NO\n")
+    return
+  }
+
+  filter, err := parseEventFilter(req.URL.Query())
+  if err != nil {
+    log.Warn("server.events", "bad query '"+req.URL.RawQuery+"'", err)
+    writer.WriteHeader(http.StatusBadRequest)
+    io.WriteString(writer, "BAD QUERY\n")
+    return
+  }
+  events, next, err := db.QueryEvents(filter)
+  if err == db.ErrBadCursor {
+    writer.WriteHeader(http.StatusBadRequest)
+    io.WriteString(writer, "BAD QUERY\n")
+    return
+  }
+  if err != nil {
+    writer.WriteHeader(http.StatusInternalServerError)
+    io.WriteString(writer, "FAIL")
+    return
+  }
+  writeJSON(writer, "server.events", eventsResponse{events, next})
+}
+
+/* Downloads the event history as a file: "format" is csv, jsonl or ical,
+ * "photos=true" includes photo references, and the other parameters filter
+ * as for the events resource, except that everything matching is returned. */
+func handleExport(writer http.ResponseWriter, req *http.Request) {
+  if _, ok := checkAuth(writer, req, PERM_VIEW); !ok {
+    return
+  }
+  if req.Method != "GET" {
+    writer.WriteHeader(http.StatusMethodNotAllowed)
+    io.WriteString(writer, "NO\n")
+    return
+  }
+  query := req.URL.Query()
+  format := query.Get("format")
+  if format == "" {
+    format = export.FORMAT_CSV
+  }
+  mimeType, ext, err := export.ContentType(format)
+  filter, ferr := parseEventFilter(query)
+  photos, perr := parseBoolParam(query, "photos")
+  if err != nil || ferr != nil || perr != nil {
+    log.Warn("server.export", "bad query '"+req.URL.RawQuery+"'")
+    writer.WriteHeader(http.StatusBadRequest)
+    io.WriteString(writer, "BAD QUERY\n")
+    return
+  }
+
+  writer.Header().Add("Content-Type", mimeType)
+  writer.Header().Add("Content-Disposition", "attachment; filename=\"providence-events."+ext+"\"")
+  writer.WriteHeader(http.StatusOK)
+  // too late for an error status once we've started streaming; a truncated
+  // file plus the log will have to do
+  n, err := export.Write(writer, format, filter, photos != nil && *photos)
+  if err != nil {
+    log.Error("server.export", "export failed after "+strconv.Itoa(n)+" events", err)
+  }
+}
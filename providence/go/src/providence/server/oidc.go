@@ -0,0 +1,395 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+/*
+ * Verifies ID tokens from OpenID Connect providers. Each provider's signing
+ * keys are located via its discovery document and fetched as a JWKS key set,
+ * refreshed periodically and also on demand when a token names a key ID we
+ * haven't seen, since that's what key rotation looks like from here.
+ */
+
+import (
+  "crypto"
+  "crypto/rsa"
+  "crypto/sha256"
+  "encoding/base64"
+  "encoding/json"
+  "errors"
+  "math/big"
+  "net/http"
+  "strings"
+  "sync"
+  "time"
+
+  "providence/config"
+  "providence/log"
+)
+
+const (
+  CLOCK_SKEW      = 60 * time.Second
+  MIN_KEY_REFRESH = 60 * time.Second
+  DISCOVERY_PATH  = "/.well-known/openid-configuration"
+)
+
+type jwk struct {
+  Kty string `json:"kty"`
+  Kid string `json:"kid"`
+  Use string `json:"use"`
+  N   string `json:"n"`
+  E   string `json:"e"`
+}
+
+type oidcVerifier struct {
+  conf    config.OIDCConfig
+  lock    sync.Mutex
+  jwksURL string
+  keys    map[string]*rsa.PublicKey
+  fetched time.Time
+}
+
+var verifiers []*oidcVerifier
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+/* Returned by principal() for tokens naming users by an email address the
+ * provider hasn't verified. */
+var errEmailUnverified = errors.New("token's email is not verified")
+
+/* Sets up a verifier for each configured OIDC provider, and refreshes their
+ * keys in the background. */
+func startVerifiers() {
+  for _, conf := range config.OIDCProviders() {
+    v := &oidcVerifier{conf: conf, keys: make(map[string]*rsa.PublicKey)}
+    verifiers = append(verifiers, v)
+    go func() {
+      ticker := time.Tick(config.UserAuth.KeyRefreshInterval * time.Second)
+      for {
+        if err := v.refresh(); err != nil {
+          log.Warn("server.oidc", "failed refreshing keys for "+v.conf.Issuer, err)
+        }
+        <-ticker
+      }
+    }()
+  }
+}
+
+func getJSON(url string, obj interface{}) error {
+  res, err := httpClient.Get(url)
+  if err != nil {
+    return err
+  }
+  defer res.Body.Close()
+  if res.StatusCode != http.StatusOK {
+    return errors.New("fetching " + url + ": " + res.Status)
+  }
+  return json.NewDecoder(res.Body).Decode(obj)
+}
+
+/* Re-reads the provider's key set, locating it first if necessary. The
+ * lock isn't held while fetching, so a slow provider can't hold up
+ * verifying tokens with the keys we already have. */
+func (v *oidcVerifier) refresh() error {
+  // note the attempt up front, so key() doesn't pile on more while this one
+  // is in flight
+  v.lock.Lock()
+  jwksURL := v.jwksURL
+  v.fetched = time.Now()
+  v.lock.Unlock()
+
+  if jwksURL == "" {
+    jwksURL = v.conf.JWKSURL
+  }
+  if jwksURL == "" {
+    discoveryURL := v.conf.DiscoveryURL
+    if discoveryURL == "" {
+      discoveryURL = strings.TrimRight(v.conf.Issuer, "/") + DISCOVERY_PATH
+    }
+    var discovery struct {
+      Issuer  string `json:"issuer"`
+      JWKSURI string `json:"jwks_uri"`
+    }
+    if err := getJSON(discoveryURL, &discovery); err != nil {
+      return err
+    }
+    if discovery.Issuer != v.conf.Issuer {
+      return errors.New("discovery document is for issuer " + discovery.Issuer)
+    }
+    jwksURL = discovery.JWKSURI
+  }
+
+  var set struct {
+    Keys []jwk `json:"keys"`
+  }
+  if err := getJSON(jwksURL, &set); err != nil {
+    return err
+  }
+  keys := make(map[string]*rsa.PublicKey)
+  for _, k := range set.Keys {
+    if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+      continue
+    }
+    n, err := base64.RawURLEncoding.DecodeString(k.N)
+    if err != nil {
+      log.Warn("server.oidc", "bogus modulus for kid "+k.Kid, err)
+      continue
+    }
+    e, err := base64.RawURLEncoding.DecodeString(k.E)
+    if err != nil {
+      log.Warn("server.oidc", "bogus exponent for kid "+k.Kid, err)
+      continue
+    }
+    keys[k.Kid] = &rsa.PublicKey{
+      N: new(big.Int).SetBytes(n),
+      E: int(new(big.Int).SetBytes(e).Int64()),
+    }
+  }
+  if len(keys) == 0 {
+    return errors.New("no usable keys at " + jwksURL)
+  }
+  v.lock.Lock()
+  v.jwksURL = jwksURL
+  v.keys = keys
+  v.fetched = time.Now()
+  v.lock.Unlock()
+  log.Debug("server.oidc", "loaded ", len(keys), " keys for "+v.conf.Issuer)
+  return nil
+}
+
+/* Returns the key with the indicated ID, re-fetching the key set if it's
+ * unknown -- but not more than once a minute, so garbage tokens can't make
+ * us hammer the provider. */
+func (v *oidcVerifier) key(kid string) (*rsa.PublicKey, error) {
+  v.lock.Lock()
+  key, ok := v.keys[kid]
+  stale := time.Since(v.fetched) > MIN_KEY_REFRESH
+  v.lock.Unlock()
+  if ok {
+    return key, nil
+  }
+  if stale {
+    if err := v.refresh(); err != nil {
+      return nil, err
+    }
+    v.lock.Lock()
+    key, ok = v.keys[kid]
+    v.lock.Unlock()
+    if ok {
+      return key, nil
+    }
+  }
+  return nil, errors.New("unknown kid " + kid)
+}
+
+/* Whether iss names this provider. */
+func (v *oidcVerifier) issuedBy(iss string) bool {
+  if iss == v.conf.Issuer {
+    return true
+  }
+  for _, alias := range v.conf.IssuerAliases {
+    if iss == alias {
+      return true
+    }
+  }
+  return false
+}
+
+/* Decodes a JWT's claims without verifying anything, so we can tell which
+ * provider it claims to be from. */
+func peekIssuer(rawToken string) string {
+  chunks := strings.Split(rawToken, ".")
+  if len(chunks) != 3 {
+    return ""
+  }
+  body, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(chunks[1], "="))
+  if err != nil {
+    return ""
+  }
+  var claims struct {
+    Iss string `json:"iss"`
+  }
+  json.Unmarshal(body, &claims)
+  return claims.Iss
+}
+
+/* Checks a token's signature and standard claims, returning its claims. */
+func (v *oidcVerifier) verify(rawToken string) (map[string]interface{}, error) {
+  chunks := strings.Split(rawToken, ".")
+  if len(chunks) != 3 {
+    return nil, errors.New("malformed token")
+  }
+  enc := base64.RawURLEncoding
+  headerBytes, err := enc.DecodeString(strings.TrimRight(chunks[0], "="))
+  if err != nil {
+    return nil, err
+  }
+  var header struct {
+    Alg string `json:"alg"`
+    Kid string `json:"kid"`
+  }
+  if err = json.Unmarshal(headerBytes, &header); err != nil {
+    return nil, err
+  }
+  if header.Alg != "RS256" {
+    return nil, errors.New("unsupported alg " + header.Alg)
+  }
+  key, err := v.key(header.Kid)
+  if err != nil {
+    return nil, err
+  }
+  sig, err := enc.DecodeString(strings.TrimRight(chunks[2], "="))
+  if err != nil {
+    return nil, err
+  }
+  sum := sha256.Sum256([]byte(chunks[0] + "." + chunks[1]))
+  if err = rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig); err != nil {
+    return nil, errors.New("invalid signature")
+  }
+
+  body, err := enc.DecodeString(strings.TrimRight(chunks[1], "="))
+  if err != nil {
+    return nil, err
+  }
+  claims := make(map[string]interface{})
+  dec := json.NewDecoder(strings.NewReader(string(body)))
+  dec.UseNumber()
+  if err = dec.Decode(&claims); err != nil {
+    return nil, err
+  }
+
+  if iss, _ := claims["iss"].(string); !v.issuedBy(iss) {
+    return nil, errors.New("token is from unexpected issuer")
+  }
+  if !hasAudience(claims["aud"], v.conf.Audience) {
+    return nil, errors.New("token is for unrecognized aud")
+  }
+  now := time.Now()
+  exp, ok := numericDate(claims["exp"])
+  if !ok || now.After(exp.Add(CLOCK_SKEW)) {
+    return nil, errors.New("token is expired")
+  }
+  if nbf, ok := numericDate(claims["nbf"]); ok && now.Add(CLOCK_SKEW).Before(nbf) {
+    return nil, errors.New("token is not yet valid")
+  }
+  for claim, want := range v.conf.RequiredClaims {
+    if got, _ := claims[claim].(string); got != want {
+      return nil, errors.New("token has wrong " + claim + " '" + got + "'")
+    }
+  }
+  return claims, nil
+}
+
+func hasAudience(aud interface{}, want string) bool {
+  switch aud := aud.(type) {
+  case string:
+    return aud == want
+  case []interface{}:
+    for _, a := range aud {
+      if a == want {
+        return true
+      }
+    }
+  }
+  return false
+}
+
+func numericDate(v interface{}) (time.Time, bool) {
+  n, ok := v.(json.Number)
+  if !ok {
+    return time.Time{}, false
+  }
+  secs, err := n.Float64()
+  if err != nil {
+    return time.Time{}, false
+  }
+  return time.Unix(int64(secs), 0), true
+}
+
+/* Works out who a verified token is for, and what role they have. Users
+ * get in by being allowed outright or by belonging to a group with a role;
+ * a role set in the database overrides whatever their groups grant. */
+func (v *oidcVerifier) principal(claims map[string]interface{}) (principal, error) {
+  user, _ := claims[v.conf.UserClaim].(string)
+  if user == "" {
+    return principal{}, errors.New("token has no " + v.conf.UserClaim + " claim")
+  }
+  // many providers let users set whatever address they like, so an
+  // unverified one could impersonate anyone in AllowedUsers or the database
+  if v.conf.UserClaim == "email" && !emailVerified(claims) {
+    return principal{}, errEmailUnverified
+  }
+
+  groupRole := ""
+  if v.conf.GroupsClaim != "" {
+    groups, _ := claims[v.conf.GroupsClaim].([]interface{})
+    for _, g := range groups {
+      name, _ := g.(string)
+      if r, ok := v.conf.GroupRoles[name]; ok {
+        groupRole = config.HigherRole(groupRole, r)
+      }
+    }
+  }
+  allowed := false
+  for _, u := range v.conf.AllowedUsers {
+    if user == u {
+      allowed = true
+    }
+  }
+  if groupRole == "" && !allowed {
+    return principal{}, errors.New("token is for unauthorized " + user)
+  }
+
+  role, err := storedRole(user)
+  if err != nil {
+    return principal{}, err
+  }
+  switch {
+  case role != "":
+  case groupRole != "":
+    role = groupRole
+  default:
+    role = configuredRole(user)
+  }
+  return newPrincipal(user, role), nil
+}
+
+/* Indicates whether claims assert that the token's email is verified. Some
+ * providers send the claim as a string rather than a boolean. */
+func emailVerified(claims map[string]interface{}) bool {
+  switch v := claims["email_verified"].(type) {
+  case bool:
+    return v
+  case string:
+    return v == "true"
+  }
+  return false
+}
+
+/* Verifies an ID token against whichever configured provider issued it. */
+func verifyToken(rawToken string) (principal, error) {
+  iss := peekIssuer(rawToken)
+  for _, v := range verifiers {
+    if !v.issuedBy(iss) {
+      continue
+    }
+    claims, err := v.verify(rawToken)
+    if err != nil {
+      return principal{}, err
+    }
+    return v.principal(claims)
+  }
+  return principal{}, errors.New("token is from unknown issuer '" + iss + "'")
+}
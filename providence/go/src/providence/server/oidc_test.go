@@ -0,0 +1,348 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+  "crypto"
+  "crypto/rand"
+  "crypto/rsa"
+  "crypto/sha256"
+  "encoding/base64"
+  "encoding/json"
+  "math/big"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "sync"
+  "testing"
+  "time"
+
+  "providence/config"
+)
+
+const testAudience = "providence-test"
+
+/* A stand-in OIDC provider, serving a discovery document and a key set
+ * holding the public half of key. */
+type fakeProvider struct {
+  server *httptest.Server
+  lock   sync.Mutex
+  key    *rsa.PrivateKey
+  kid    string
+  hits   int // key set fetches
+}
+
+/* Replaces the provider's key, as if it had rotated it. */
+func (p *fakeProvider) rotate(key *rsa.PrivateKey, kid string) {
+  p.lock.Lock()
+  defer p.lock.Unlock()
+  p.key, p.kid = key, kid
+}
+
+func (p *fakeProvider) fetches() int {
+  p.lock.Lock()
+  defer p.lock.Unlock()
+  return p.hits
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+  key, err := rsa.GenerateKey(rand.Reader, 2048)
+  if err != nil {
+    t.Fatal(err)
+  }
+  p := &fakeProvider{key: key, kid: "key-1"}
+  mux := http.NewServeMux()
+  mux.HandleFunc(DISCOVERY_PATH, func(w http.ResponseWriter, req *http.Request) {
+    json.NewEncoder(w).Encode(map[string]string{
+      "issuer":   p.server.URL,
+      "jwks_uri": p.server.URL + "/jwks",
+    })
+  })
+  mux.HandleFunc("/jwks", func(w http.ResponseWriter, req *http.Request) {
+    p.lock.Lock()
+    defer p.lock.Unlock()
+    p.hits++
+    enc := base64.RawURLEncoding
+    json.NewEncoder(w).Encode(map[string][]jwk{"keys": {{
+      Kty: "RSA",
+      Kid: p.kid,
+      Use: "sig",
+      N:   enc.EncodeToString(p.key.N.Bytes()),
+      E:   enc.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+    }}})
+  })
+  p.server = httptest.NewServer(mux)
+  t.Cleanup(p.server.Close)
+  return p
+}
+
+func (p *fakeProvider) verifier() *oidcVerifier {
+  return &oidcVerifier{
+    conf: config.OIDCConfig{Issuer: p.server.URL, Audience: testAudience, UserClaim: "email"},
+    keys: make(map[string]*rsa.PublicKey),
+  }
+}
+
+/* Claims for a token from p that verify() should accept. */
+func (p *fakeProvider) claims() map[string]interface{} {
+  now := time.Now()
+  return map[string]interface{}{
+    "iss":            p.server.URL,
+    "aud":            testAudience,
+    "email":          "alice@example.com",
+    "email_verified": true,
+    "iat":            now.Unix(),
+    "exp":            now.Add(time.Hour).Unix(),
+  }
+}
+
+/* Builds an RS256 JWT with the indicated claims, signed by key. */
+func sign(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+  enc := base64.RawURLEncoding
+  header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid})
+  body, err := json.Marshal(claims)
+  if err != nil {
+    t.Fatal(err)
+  }
+  signed := enc.EncodeToString(header) + "." + enc.EncodeToString(body)
+  sum := sha256.Sum256([]byte(signed))
+  sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+  if err != nil {
+    t.Fatal(err)
+  }
+  return signed + "." + enc.EncodeToString(sig)
+}
+
+func TestRefreshUsesDiscovery(t *testing.T) {
+  p := newFakeProvider(t)
+  v := p.verifier()
+  if err := v.refresh(); err != nil {
+    t.Fatal(err)
+  }
+  if v.jwksURL != p.server.URL+"/jwks" {
+    t.Errorf("jwksURL = %q, want the discovery document's jwks_uri", v.jwksURL)
+  }
+  if _, ok := v.keys[p.kid]; !ok {
+    t.Errorf("key %q not loaded", p.kid)
+  }
+}
+
+func TestRefreshRejectsForeignDiscovery(t *testing.T) {
+  p := newFakeProvider(t)
+  v := p.verifier()
+  v.conf.Issuer = "https://issuer.example.com"
+  v.conf.DiscoveryURL = p.server.URL + DISCOVERY_PATH
+  if err := v.refresh(); err == nil {
+    t.Error("refresh accepted a discovery document for another issuer")
+  }
+}
+
+func TestVerifySignature(t *testing.T) {
+  p := newFakeProvider(t)
+  v := p.verifier()
+
+  if _, err := v.verify(sign(t, p.key, p.kid, p.claims())); err != nil {
+    t.Errorf("valid token rejected: %v", err)
+  }
+
+  other, err := rsa.GenerateKey(rand.Reader, 2048)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if _, err := v.verify(sign(t, other, p.kid, p.claims())); err == nil {
+    t.Error("token signed by the wrong key accepted")
+  }
+
+  // tamper with the claims after signing
+  token := sign(t, p.key, p.kid, p.claims())
+  chunks := strings.Split(token, ".")
+  forged := p.claims()
+  forged["email"] = "mallory@example.com"
+  body, _ := json.Marshal(forged)
+  chunks[1] = base64.RawURLEncoding.EncodeToString(body)
+  if _, err := v.verify(strings.Join(chunks, ".")); err == nil {
+    t.Error("token with altered claims accepted")
+  }
+
+  if _, err := v.verify(sign(t, p.key, "no-such-key", p.claims())); err == nil {
+    t.Error("token naming an unknown key accepted")
+  }
+  if _, err := v.verify("not.a-token"); err == nil {
+    t.Error("malformed token accepted")
+  }
+}
+
+func TestVerifyIssuer(t *testing.T) {
+  p := newFakeProvider(t)
+  v := p.verifier()
+
+  claims := p.claims()
+  claims["iss"] = "https://evil.example.com"
+  if _, err := v.verify(sign(t, p.key, p.kid, claims)); err == nil {
+    t.Error("token from another issuer accepted")
+  }
+
+  claims["iss"] = strings.TrimPrefix(p.server.URL, "http://")
+  if _, err := v.verify(sign(t, p.key, p.kid, claims)); err == nil {
+    t.Error("scheme-less issuer accepted without an alias")
+  }
+  v.conf.IssuerAliases = []string{claims["iss"].(string)}
+  if _, err := v.verify(sign(t, p.key, p.kid, claims)); err != nil {
+    t.Errorf("token from issuer alias rejected: %v", err)
+  }
+}
+
+func TestGoogleIssuerAliases(t *testing.T) {
+  saved := config.UserAuth
+  defer func() { config.UserAuth = saved }()
+  config.UserAuth.Providers = []string{config.AUTH_GOOGLE}
+
+  providers := config.OIDCProviders()
+  if len(providers) != 1 {
+    t.Fatalf("got %d providers, want 1", len(providers))
+  }
+  v := &oidcVerifier{conf: providers[0]}
+  for _, iss := range []string{"https://accounts.google.com", "accounts.google.com"} {
+    if !v.issuedBy(iss) {
+      t.Errorf("google provider doesn't accept iss %q", iss)
+    }
+  }
+  if v.issuedBy("https://accounts.example.com") {
+    t.Error("google provider accepts another issuer")
+  }
+}
+
+func TestVerifyAudience(t *testing.T) {
+  p := newFakeProvider(t)
+  v := p.verifier()
+
+  for _, tc := range []struct {
+    aud  interface{}
+    want bool
+  }{
+    {testAudience, true},
+    {[]string{"someone-else", testAudience}, true},
+    {"someone-else", false},
+    {[]string{"someone-else"}, false},
+    {nil, false},
+  } {
+    claims := p.claims()
+    claims["aud"] = tc.aud
+    _, err := v.verify(sign(t, p.key, p.kid, claims))
+    if (err == nil) != tc.want {
+      t.Errorf("aud %v: got err %v, want accepted=%v", tc.aud, err, tc.want)
+    }
+  }
+}
+
+func TestVerifyExpiry(t *testing.T) {
+  p := newFakeProvider(t)
+  v := p.verifier()
+  now := time.Now()
+
+  for _, tc := range []struct {
+    name string
+    exp  interface{}
+    nbf  interface{}
+    want bool
+  }{
+    {"current", now.Add(time.Hour).Unix(), nil, true},
+    {"expired within skew", now.Add(-CLOCK_SKEW / 2).Unix(), nil, true},
+    {"expired", now.Add(-2 * CLOCK_SKEW).Unix(), nil, false},
+    {"no exp", nil, nil, false},
+    {"not yet valid", now.Add(time.Hour).Unix(), now.Add(2 * CLOCK_SKEW).Unix(), false},
+    {"nbf within skew", now.Add(time.Hour).Unix(), now.Add(CLOCK_SKEW / 2).Unix(), true},
+  } {
+    claims := p.claims()
+    delete(claims, "exp")
+    if tc.exp != nil {
+      claims["exp"] = tc.exp
+    }
+    if tc.nbf != nil {
+      claims["nbf"] = tc.nbf
+    }
+    _, err := v.verify(sign(t, p.key, p.kid, claims))
+    if (err == nil) != tc.want {
+      t.Errorf("%s: got err %v, want accepted=%v", tc.name, err, tc.want)
+    }
+  }
+}
+
+func TestKeyRotation(t *testing.T) {
+  p := newFakeProvider(t)
+  v := p.verifier()
+  if err := v.refresh(); err != nil {
+    t.Fatal(err)
+  }
+
+  // the provider rotates to a new key
+  key, err := rsa.GenerateKey(rand.Reader, 2048)
+  if err != nil {
+    t.Fatal(err)
+  }
+  p.rotate(key, "key-2")
+  token := sign(t, key, "key-2", p.claims())
+
+  // a refresh just happened, so the unknown key isn't fetched yet
+  hits := p.fetches()
+  if _, err := v.verify(token); err == nil {
+    t.Error("token with a not-yet-fetched key accepted")
+  }
+  if p.fetches() != hits {
+    t.Error("key set re-fetched within MIN_KEY_REFRESH")
+  }
+
+  v.fetched = time.Now().Add(-2 * MIN_KEY_REFRESH)
+  if _, err := v.verify(token); err != nil {
+    t.Errorf("token with rotated key rejected: %v", err)
+  }
+}
+
+func TestPrincipalRequiresVerifiedEmail(t *testing.T) {
+  p := newFakeProvider(t)
+  v := p.verifier()
+  v.conf.AllowedUsers = []string{"alice@example.com"}
+
+  for _, verified := range []interface{}{nil, false, "false", 1} {
+    claims := p.claims()
+    delete(claims, "email_verified")
+    if verified != nil {
+      claims["email_verified"] = verified
+    }
+    if _, err := v.principal(claims); err != errEmailUnverified {
+      t.Errorf("email_verified %v: got %v, want %v", verified, err, errEmailUnverified)
+    }
+  }
+
+  // past the check, the user must still be allowed in
+  v.conf.AllowedUsers = nil
+  for _, verified := range []interface{}{true, "true"} {
+    claims := p.claims()
+    claims["email_verified"] = verified
+    if _, err := v.principal(claims); err == nil || err == errEmailUnverified {
+      t.Errorf("email_verified %v: got %v, want unauthorized", verified, err)
+    }
+  }
+
+  // the check only applies when users are named by email
+  v.conf.UserClaim = "sub"
+  claims := p.claims()
+  delete(claims, "email_verified")
+  claims["sub"] = "alice"
+  if _, err := v.principal(claims); err == nil || err == errEmailUnverified {
+    t.Errorf("sub user: got %v, want unauthorized", err)
+  }
+}
@@ -16,7 +16,6 @@ package server
 
 import (
   "encoding/json"
-  "errors"
   "fmt"
   "io"
   "io/ioutil"
@@ -28,135 +27,55 @@ import (
   "strings"
   "time"
 
-  jwt "github.com/morrildl/jwt-go"
-
   "providence/config"
   "providence/db"
   "providence/log"
+  "providence/types"
 )
 
-var validCerts map[string]string
-
-/* Updates an in-memory copy of the currently-published Google OAuth2 certs on
- * an hourly basis. This is used by verifyToken to determine whether a token
- * is signed by a currently active cert. Google rotates these certs fairly
- * aggressively; this makes sure we keep up. */
-func startCertFetcher() {
-  ticker := time.Tick(1 * time.Hour)
-  go func() {
-    for {
-      log.Debug("server.certFetcher", "Updating validCerts map")
-
-      res, err := http.Get(config.UserAuth.GoogleOAuthCertsURL)
-      if err == nil {
-        dec := json.NewDecoder(res.Body)
-        err = dec.Decode(&validCerts)
-        log.Debug("server.certFetcher", validCerts)
-
-        res.Body.Close()
-      } else {
-        log.Warn("server.certFetcher", "failure fetching GoogleOAuthCertsURL", err)
-      }
-
-      <-ticker
-    }
-  }()
-}
-
-/* Inspects the indicated JWT token string to see if it is correctly constructed 
- * for Google's OAuth relying party system for Android apps. That is:
- * - the token must be properly formed
- * - it must be signed by Google, using one of the current published certs (see startCertFetcher)
- * - its 'email' claim must identify it as for a Google account whitelisted in config.Server.UserAuth
- * - its 'azp' claim must match the client ID generated by the Google API console for this app
- * - its 'aud' claim must match the audience (i.e. OAuth scope) generated by the Google API console for this app
- * Returns the email address from the claim on success; returns "" and an error on failure.
- */
-func verifyToken(rawToken string) (string, error) {
-  if l := len(rawToken) % 4; l > 0 {
-    rawToken += string([]byte{'=', '=', '='}[3-l:])
-  }
-  parsedToken, err := jwt.Parse(rawToken, func(token *jwt.Token) ([]byte, error) {
-    kid := token.Header["kid"].(string)
-    cert, ok := validCerts[kid]
-    if ok {
-      return []byte(cert), nil
-    } else {
-      return nil, errors.New("unknown kid " + kid)
-    }
-    return nil, errors.New("wtf")
-  })
-
+/* Checks for legit credentials from one of the configured auth providers
+ * (see authenticate), for a user whose role grants the indicated permission.
+ * If present and legit, user is authenticated and this method returns the
+ * user's email or local username, and true. If the credentials are missing,
+ * corrupt, or for an unauthorized user, returns false AND writes a 403
+ * response to the request. IOW callers should return early if this method
+ * returns false. */
+func checkAuth(writer http.ResponseWriter, req *http.Request, perm string) (string, bool) {
+  target := req.Method + " " + req.URL.Path
+  user, err := authenticate(req)
   if err != nil {
-    return "", err
-  }
-  if !parsedToken.Valid {
-    // in the jwt-go impl, .Valid := err != nil, so technically this is redundant; but check 
-    // anyway for future proofing since the API doesn't actually guarantee this
-    return "", errors.New("invalid signature")
-  }
-
-  log.Debug("server.verifyToken", "validated signature for token")
-
-  authorized := false
-  for _, email := range config.UserAuth.GoogleAccountWhitelist {
-    if email == parsedToken.Claims["email"] {
-      authorized = true
-      break
-    }
+    log.Warn("server.checkAuth", "request from "+req.RemoteAddr+" not authenticated", err)
+    audit(req, "", "request", target, db.AUDIT_DENIED, err.Error())
+    writer.WriteHeader(http.StatusForbidden)
+    io.WriteString(writer, "NO\n")
+    return "", false
   }
-  log.Debug("server.verifyToken", "token: ", parsedToken)
-  log.Debug("server.verifyToken", "claims: ", parsedToken.Claims)
-  email := parsedToken.Claims["email"].(string)
-  aud := parsedToken.Claims["aud"].(string)
-  azp := parsedToken.Claims["azp"].(string)
-  if !authorized {
-    log.Warn("server.verifyToken", "received token from unauthorized GAIA "+email)
-    return "", errors.New("token is for unauthorized " + email)
+  if !user.has(perm) {
+    log.Warn("server.checkAuth", user.Name+" ("+user.Role+") lacks '"+perm+"' for "+target)
+    audit(req, user.Name, "request", target, db.AUDIT_DENIED, "role "+user.Role+" lacks "+perm)
+    writer.WriteHeader(http.StatusForbidden)
+    io.WriteString(writer, "NO\n")
+    return "", false
   }
 
-  log.Debug("server.verifyToken", "aud as received = "+aud)
-  log.Debug("server.verifyToken", "aud as expected = "+config.UserAuth.OAuthAudience)
-  log.Debug("server.verifyToken", "azp as received = "+azp)
-  log.Debug("server.verifyToken", "azp as expected = "+config.UserAuth.OAuthClientID)
-
-  if parsedToken.Claims["aud"] != config.UserAuth.OAuthAudience {
-    log.Warn("server.verifyToken", "received token for wrong aud "+aud)
-    return "", errors.New("token is for unrecognized aud " + aud)
-  }
-  if parsedToken.Claims["azp"] != config.UserAuth.OAuthClientID {
-    log.Warn("server.verifyToken", "received token for wrong azp "+azp)
-    return "", errors.New("token is for unrecognized azp " + azp)
+  log.Debug("server.checkAuth", "authenticated HTTP request from "+user.Name)
+  if !isPoll(req) {
+    audit(req, user.Name, "request", target, db.AUDIT_ALLOWED, "")
   }
-
-  return email, nil
+  return user.Name, true
 }
 
-/* Checks for a legit JWT signed by Google. If the token is present and legit,
- * user is authenticated and this method returns true. If the token is
- * missing, corrupt, or for an unauthorized user (i.e. if verifyToken()
- * fails), returns false AND writes a 403 response to the request. IOW callers
- * should return early if this method returns false. */
-func checkAuth(writer http.ResponseWriter, req *http.Request) bool {
-  token := req.Header.Get("X-OAuth-JWT")
-  if token == "" {
-    log.Warn("server.checkAuth", "auth token not present")
-    writer.WriteHeader(http.StatusForbidden)
-    io.WriteString(writer, "NO\n")
-    return false
-  }
-  email, err := verifyToken(token)
-  if err != nil {
-    log.Warn("server.checkAuth", "auth token is invalid")
-    log.Warn("server.checkAuth", err)
-    log.Debug("server.checkAuth", token)
-    writer.WriteHeader(http.StatusForbidden)
-    io.WriteString(writer, "NO\n")
+/* Indicates whether a request is one of the dashboard's periodic refreshes of
+ * sensor state and recent events. These are the only allowed requests not
+ * audited: the dashboard issues them every few seconds for as long as it is
+ * open, so recording them would bury the entries that matter. Everything
+ * else, including reads of photos, exports, the audit log and stream
+ * connects, is audited so the log shows who looked at what. */
+func isPoll(req *http.Request) bool {
+  if req.Method != "GET" {
     return false
   }
-
-  log.Debug("server.checkAuth", "authenticated HTTP request from "+email)
-  return true
+  return req.URL.Path == config.URLPath.Sensors || req.URL.Path == config.URLPath.Events
 }
 
 type ShareUrlRequest struct {
@@ -164,15 +83,32 @@ type ShareUrlRequest struct {
   Skip []string
 }
 
+/* Sent when a user acknowledges an alert, to stop its escalation. */
+type AckRequest struct {
+  EventID string
+  By      string
+}
+
+/* JSON representation of types.ModeState sent to clients. */
+type modeResponse struct {
+  Mode      string
+  Changed   time.Time
+  ChangedBy string
+}
+
 /* Spins up an HTTP server in a goroutine to which user devices make requests
  * to add & delete registration IDs, per the GCM spec. Server also implements
  * a trivial heartbeat URL that devices can use to detect if the monitor goes
- * offline, and notify locally.
+ * offline, and notify locally, and a URL for arming & disarming the system.
+ * Mode changes are sent on the third returned channel, for broadcast, and
+ * alert acknowledgements on the fourth.
  */
-func Start() (chan db.RegIdUpdate, chan ShareUrlRequest) {
-  startCertFetcher()
+func Start() (chan db.RegIdUpdate, chan ShareUrlRequest, chan types.ModeState, chan AckRequest) {
+  startVerifiers()
   regIdRequestChan := make(chan db.RegIdUpdate, 5)
   gcmSendUrlChan := make(chan ShareUrlRequest, 5)
+  modeChangeChan := make(chan types.ModeState, 5)
+  ackChan := make(chan AckRequest, 5)
   go func() {
     // registration ID handler; RESTful:
     // - POST = add reg ID(s) listed in body
@@ -180,7 +116,8 @@ func Start() (chan db.RegIdUpdate, chan ShareUrlRequest) {
     http.HandleFunc(config.URLPath.RegID, func(writer http.ResponseWriter, req *http.Request) {
       log.Debug("server", "incoming request to /regid")
 
-      if !checkAuth(writer, req) {
+      email, ok := checkAuth(writer, req, PERM_ADMIN)
+      if !ok {
         return
       }
 
@@ -190,8 +127,15 @@ func Start() (chan db.RegIdUpdate, chan ShareUrlRequest) {
       } else {
         log.Status("server.RegID", "/regid: ", req.Method)
         remove := req.Method == "DELETE"
+        action := "regid.add"
+        if remove {
+          action = "regid.remove"
+        }
         for _, s := range strings.Split(string(body), "\n") {
           regIdRequestChan <- db.RegIdUpdate{s, "", remove}
+          if s != "" {
+            audit(req, email, action, abbreviate(s), db.AUDIT_OK, "")
+          }
         }
       }
       writer.WriteHeader(http.StatusOK)
@@ -205,6 +149,130 @@ func Start() (chan db.RegIdUpdate, chan ShareUrlRequest) {
       io.WriteString(writer, "HI\n")
     })
 
+    // system mode URL; RESTful:
+    // - GET = return the current mode, and who set it when
+    // - POST/PUT = set the mode named in the body, e.g. "Away"
+    http.HandleFunc(config.URLPath.Mode, func(writer http.ResponseWriter, req *http.Request) {
+      perm := PERM_ARM
+      if req.Method == "GET" {
+        perm = PERM_VIEW
+      }
+      email, ok := checkAuth(writer, req, perm)
+      if !ok {
+        return
+      }
+
+      doerr := func(code int, msg string) {
+        writer.WriteHeader(code)
+        io.WriteString(writer, msg)
+      }
+
+      var state types.ModeState
+      var err error
+      switch req.Method {
+      case "GET":
+        state, err = db.GetMode()
+        if err != nil {
+          doerr(http.StatusInternalServerError, "FAIL")
+          return
+        }
+      case "POST", "PUT":
+        body, err := ioutil.ReadAll(req.Body)
+        if err != nil {
+          log.Warn("server.mode", "HTTP request read failure", err)
+          doerr(http.StatusInternalServerError, "FAIL")
+          return
+        }
+        mode, err := types.ParseSystemMode(string(body))
+        if err != nil {
+          log.Warn("server.mode", "bogus mode requested by "+email, err)
+          audit(req, email, "mode.set", string(body), db.AUDIT_FAILED, err.Error())
+          doerr(http.StatusBadRequest, "BAD MODE\n")
+          return
+        }
+        state, err = db.SetMode(mode, email)
+        if err != nil {
+          audit(req, email, "mode.set", mode.Name(), db.AUDIT_FAILED, err.Error())
+          doerr(http.StatusInternalServerError, "FAIL")
+          return
+        }
+        log.Status("server.mode", email+" set mode to "+mode.Name())
+        audit(req, email, "mode.set", mode.Name(), db.AUDIT_OK, "")
+        modeChangeChan <- state
+      default:
+        doerr(http.StatusMethodNotAllowed, "NO\n")
+        return
+      }
+
+      writeJSON(writer, "server.mode", modeResponse{state.Mode.Name(), state.Changed, state.ChangedBy})
+    })
+
+    // acknowledges an alert, i.e. POST /ack/<EventID>; stops resends and
+    // escalation, and records who has it in hand
+    http.HandleFunc(config.URLPath.Ack, func(writer http.ResponseWriter, req *http.Request) {
+      email, ok := checkAuth(writer, req, PERM_ARM)
+      if !ok {
+        return
+      }
+      if req.Method != "POST" {
+        writer.WriteHeader(http.StatusMethodNotAllowed)
+        io.WriteString(writer, "NO\n")
+        return
+      }
+
+      chunks := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+      if len(chunks) != 2 {
+        log.Warn("server.ack", "bogus ack URL "+req.URL.Path+" from "+email)
+        writer.WriteHeader(http.StatusNotFound)
+        io.WriteString(writer, "404")
+        return
+      }
+      eventID := chunks[1]
+      event, err := db.GetEvent(eventID)
+      if err == db.ErrEventNotFound {
+        log.Warn("server.ack", "ack for unknown event '"+eventID+"' from "+email)
+        writer.WriteHeader(http.StatusNotFound)
+        io.WriteString(writer, "404")
+        return
+      }
+      if err != nil {
+        log.Error("server.ack", "failed to load '"+eventID+"'", err)
+        writer.WriteHeader(http.StatusInternalServerError)
+        io.WriteString(writer, "FAIL")
+        return
+      }
+      if event.AckedBy != "" {
+        log.Debug("server.ack", "'"+eventID+"' already acknowledged by "+event.AckedBy)
+        audit(req, email, "alert.ack", eventID, db.AUDIT_FAILED, "already acknowledged by "+event.AckedBy)
+      } else {
+        log.Status("server.ack", email+" acknowledged '"+eventID+"'")
+        audit(req, email, "alert.ack", eventID, db.AUDIT_OK, "")
+        ackChan <- AckRequest{eventID, email}
+      }
+      writer.WriteHeader(http.StatusOK)
+      io.WriteString(writer, "OK\n")
+    })
+
+    // returns the most recent notifications that could not be delivered, and
+    // why; "?limit=N" overrides the default of 100
+    http.HandleFunc(config.URLPath.DeadLetters, func(writer http.ResponseWriter, req *http.Request) {
+      if _, ok := checkAuth(writer, req, PERM_ADMIN); !ok {
+        return
+      }
+
+      limit := 100
+      if l, err := strconv.Atoi(req.URL.Query().Get("limit")); err == nil && l > 0 {
+        limit = l
+      }
+      letters, err := db.GetDeadLetters(limit)
+      if err != nil {
+        writer.WriteHeader(http.StatusInternalServerError)
+        io.WriteString(writer, "FAIL")
+        return
+      }
+      writeJSON(writer, "server.deadletters", letters)
+    })
+
     // setup URL: displays a QR code that stores config info; client can scan it to set up
     http.HandleFunc(config.URLPath.QRConfig, func(writer http.ResponseWriter, req *http.Request) {
       // unauthenticated; no call to checkAuth() -- this is our bootstrap
@@ -228,20 +296,43 @@ func Start() (chan db.RegIdUpdate, chan ShareUrlRequest) {
     // return a list of the most recent 10 entries; intended for
     // new clients to get initial state
     http.HandleFunc(config.URLPath.Recent, func(writer http.ResponseWriter, req *http.Request) {
-      if !checkAuth(writer, req) {
+      if _, ok := checkAuth(writer, req, PERM_VIEW); !ok {
         return
       }
 
-      writer.WriteHeader(http.StatusOK)
-      io.WriteString(writer, "HI\n")
+      events, err := db.GetRecentEvents()
+      if err != nil {
+        writer.WriteHeader(http.StatusInternalServerError)
+        io.WriteString(writer, "FAIL")
+        return
+      }
+      writeJSON(writer, "server.recent", events)
     })
 
+    // full, filterable & pageable event history; see parseEventFilter
+    http.HandleFunc(config.URLPath.Events, handleEvents)
+    http.HandleFunc(config.URLPath.Export, handleExport)
+
+    // live stream of events as they're dispatched; see handleStream
+    http.HandleFunc(config.URLPath.Stream, handleStream)
+
+    // current state of every sensor, plus the web dashboard that shows it
+    http.HandleFunc(config.URLPath.Sensors, handleSensors)
+    http.HandleFunc(config.URLPath.Dashboard, handleDashboard)
+
+    // local account browser sessions
+    http.HandleFunc(config.URLPath.Login, handleLogin)
+    http.HandleFunc(config.URLPath.Logout, handleLogout)
+
+    // who did what; see handleAudit
+    http.HandleFunc(config.URLPath.Audit, handleAudit)
+
     // a way for an app to query a list of photo URLs for a given ID
     // The ID will have been sent to the app via GCM; this is how it pulls
     // photos, if any. This returns only the list, it does NOT return JPEG
     // data.
     http.HandleFunc(config.URLPath.PhotoList, func(writer http.ResponseWriter, req *http.Request) {
-      if !checkAuth(writer, req) {
+      if _, ok := checkAuth(writer, req, PERM_VIEW); !ok {
         return
       }
 
@@ -298,8 +389,25 @@ func Start() (chan db.RegIdUpdate, chan ShareUrlRequest) {
         imagesById[split[0]] = append(images, finfo.Name())
       }
 
+      // the store also knows about photos taken by other monitors sharing
+      // the photo directory, which may not have shown up here yet
+      ids := strings.Split(photoIDs, "\n")
+      if known, err := db.GetPhotos(ids); err == nil {
+        for id, photos := range known {
+          seen := make(map[string]bool)
+          for _, name := range imagesById[id] {
+            seen[name] = true
+          }
+          for _, photo := range photos {
+            if !seen[photo.Name] {
+              imagesById[id] = append(imagesById[id], photo.Name)
+            }
+          }
+        }
+      }
+
       urlsById := make(map[string][]string)
-      for _, id := range strings.Split(photoIDs, "\n") {
+      for _, id := range ids {
         if len(id) == 0 {
           continue
         }
@@ -368,7 +476,7 @@ func Start() (chan db.RegIdUpdate, chan ShareUrlRequest) {
 
     // fetch and return an indicated photo
     http.HandleFunc(config.URLPath.PhotoFetch, func(writer http.ResponseWriter, req *http.Request) {
-      if !checkAuth(writer, req) {
+      if _, ok := checkAuth(writer, req, PERM_VIEW); !ok {
         return
       }
       log.Debug("server.photo", "request method: "+req.Method)
@@ -399,5 +507,5 @@ func Start() (chan db.RegIdUpdate, chan ShareUrlRequest) {
       log.Error("server.http", "shut down unexpectedly", http.ListenAndServe(":"+port, nil))
     }
   }()
-  return regIdRequestChan, gcmSendUrlChan
+  return regIdRequestChan, gcmSendUrlChan, modeChangeChan, ackChan
 }
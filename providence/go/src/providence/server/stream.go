@@ -0,0 +1,342 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+  "bufio"
+  "crypto/sha1"
+  "encoding/base64"
+  "encoding/binary"
+  "encoding/json"
+  "errors"
+  "io"
+  "net/http"
+  "net/url"
+  "strings"
+  "sync"
+  "time"
+
+  "providence/common"
+  "providence/config"
+  "providence/log"
+  "providence/types"
+)
+
+const (
+  STREAM_BUFFER     = 32
+  STREAM_KEEPALIVE  = 30 * time.Second
+  WEBSOCKET_GUID    = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+  WS_OP_TEXT        = 0x1
+  WS_OP_CLOSE       = 0x8
+  WS_OP_PING        = 0x9
+  WS_OP_PONG        = 0xA
+  WS_MAX_CLIENT_LEN = 4096
+
+  // set by the dashboard for the stream's path only
+  STREAM_TOKEN_COOKIE = "providence-stream-token"
+)
+
+/* Streaming clients currently connected. Each gets a buffered channel of
+ * JSON-encoded events; a client that falls behind far enough to fill its
+ * buffer is disconnected rather than allowed to stall the dispatcher. */
+var subscribers = struct {
+  sync.Mutex
+  chans map[chan []byte]bool
+}{chans: make(map[chan []byte]bool)}
+
+func subscribe() chan []byte {
+  c := make(chan []byte, STREAM_BUFFER)
+  subscribers.Lock()
+  subscribers.chans[c] = true
+  subscribers.Unlock()
+  return c
+}
+
+func unsubscribe(c chan []byte) {
+  subscribers.Lock()
+  if subscribers.chans[c] {
+    delete(subscribers.chans, c)
+    close(c)
+  }
+  subscribers.Unlock()
+}
+
+/* Relays every event passing through the dispatcher to connected streaming
+ * clients. */
+func Broadcaster(incoming chan types.Event, outgoing chan types.Event) {
+  for {
+    event := <-incoming
+    body, err := json.Marshal(event)
+    if err != nil {
+      log.Error("server.Broadcaster", "could not marshal event "+event.EventID, err)
+      continue
+    }
+    subscribers.Lock()
+    for c := range subscribers.chans {
+      select {
+      case c <- body:
+      default:
+        log.Warn("server.Broadcaster", "dropping stalled stream client")
+        delete(subscribers.chans, c)
+        close(c)
+      }
+    }
+    subscribers.Unlock()
+  }
+}
+
+var Handler common.Handler = Broadcaster
+
+/* The live event stream. Clients asking to upgrade to a WebSocket get one;
+ * everyone else gets Server-Sent Events. Since browsers can't set headers on
+ * EventSource or WebSocket requests, an ID token or local API token may also
+ * be passed in the STREAM_TOKEN_COOKIE cookie; unlike a query parameter,
+ * that doesn't end up in access logs and browser history. */
+func handleStream(writer http.ResponseWriter, req *http.Request) {
+  if cookie, err := req.Cookie(STREAM_TOKEN_COOKIE); err == nil && req.Header.Get("Authorization") == "" {
+    req.Header.Set("Authorization", "Bearer "+cookie.Value)
+  }
+  email, ok := checkAuth(writer, req, PERM_VIEW)
+  if !ok {
+    return
+  }
+  if strings.ToLower(req.Header.Get("Upgrade")) == "websocket" {
+    serveWebSocket(writer, req, email)
+  } else {
+    serveSSE(writer, req, email)
+  }
+}
+
+func serveSSE(writer http.ResponseWriter, req *http.Request, email string) {
+  flusher, ok := writer.(http.Flusher)
+  if !ok {
+    log.Error("server.stream", "response writer can't flush; SSE unavailable")
+    writer.WriteHeader(http.StatusInternalServerError)
+    io.WriteString(writer, "FAIL")
+    return
+  }
+  writer.Header().Set("Content-Type", "text/event-stream")
+  writer.Header().Set("Cache-Control", "no-cache")
+  writer.WriteHeader(http.StatusOK)
+  flusher.Flush()
+
+  log.Status("server.stream", "SSE client connected for "+email)
+  c := subscribe()
+  defer unsubscribe(c)
+  keepalive := time.NewTicker(STREAM_KEEPALIVE)
+  defer keepalive.Stop()
+  for {
+    select {
+    case body, ok := <-c:
+      if !ok {
+        return
+      }
+      if _, err := io.WriteString(writer, "data: "+string(body)+"\n\n"); err != nil {
+        return
+      }
+    case <-keepalive.C:
+      if _, err := io.WriteString(writer, ": keepalive\n\n"); err != nil {
+        return
+      }
+    case <-req.Context().Done():
+      log.Status("server.stream", "SSE client disconnected for "+email)
+      return
+    }
+    flusher.Flush()
+  }
+}
+
+/* Indicates whether a browser making the request is on a page served from
+ * the configured URLRoot. Browsers don't apply the same-origin policy to
+ * WebSockets, so otherwise any site a user visits could open one with their
+ * cookies. Clients that aren't browsers don't send an Origin at all. */
+func sameOrigin(req *http.Request) bool {
+  origin := req.Header.Get("Origin")
+  if origin == "" {
+    return true
+  }
+  o, err := url.Parse(origin)
+  if err != nil {
+    return false
+  }
+  root, err := url.Parse(config.Server.URLRoot)
+  if err != nil {
+    return false
+  }
+  return strings.EqualFold(o.Scheme, root.Scheme) && strings.EqualFold(o.Host, root.Host)
+}
+
+/* Implements just enough of RFC 6455 to push text frames to a client, and to
+ * answer its pings and close handshake. */
+func serveWebSocket(writer http.ResponseWriter, req *http.Request, email string) {
+  if !sameOrigin(req) {
+    log.Warn("server.stream", "refusing WebSocket for "+email+" from foreign origin "+req.Header.Get("Origin"))
+    writer.WriteHeader(http.StatusForbidden)
+    io.WriteString(writer, "NO\n")
+    return
+  }
+  key := req.Header.Get("Sec-WebSocket-Key")
+  if key == "" || req.Header.Get("Sec-WebSocket-Version") != "13" {
+    writer.Header().Set("Sec-WebSocket-Version", "13")
+    writer.WriteHeader(http.StatusBadRequest)
+    io.WriteString(writer, "NO\n")
+    return
+  }
+  hijacker, ok := writer.(http.Hijacker)
+  if !ok {
+    log.Error("server.stream", "response writer can't hijack; WebSocket unavailable")
+    writer.WriteHeader(http.StatusInternalServerError)
+    io.WriteString(writer, "FAIL")
+    return
+  }
+  conn, rw, err := hijacker.Hijack()
+  if err != nil {
+    log.Error("server.stream", "failed to hijack connection", err)
+    return
+  }
+  defer conn.Close()
+
+  sum := sha1.Sum([]byte(key + WEBSOCKET_GUID))
+  rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+  rw.WriteString("Upgrade: websocket\r\nConnection: Upgrade\r\n")
+  rw.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+  if err = rw.Flush(); err != nil {
+    return
+  }
+  log.Status("server.stream", "WebSocket client connected for "+email)
+
+  // writes happen from both the event loop and the reader (for pongs &
+  // close), so serialize them
+  var writeLock sync.Mutex
+  send := func(opcode byte, payload []byte) error {
+    writeLock.Lock()
+    defer writeLock.Unlock()
+    if err := writeFrame(rw.Writer, opcode, payload); err != nil {
+      return err
+    }
+    return rw.Flush()
+  }
+
+  done := make(chan bool)
+  go func() {
+    defer close(done)
+    for {
+      opcode, payload, err := readFrame(rw.Reader)
+      if err != nil {
+        if err != io.EOF {
+          log.Debug("server.stream", "WebSocket read failed", err)
+        }
+        return
+      }
+      switch opcode {
+      case WS_OP_PING:
+        send(WS_OP_PONG, payload)
+      case WS_OP_CLOSE:
+        send(WS_OP_CLOSE, payload)
+        return
+      }
+    }
+  }()
+
+  c := subscribe()
+  defer unsubscribe(c)
+  keepalive := time.NewTicker(STREAM_KEEPALIVE)
+  defer keepalive.Stop()
+  for {
+    select {
+    case body, ok := <-c:
+      if !ok {
+        send(WS_OP_CLOSE, nil)
+        return
+      }
+      err = send(WS_OP_TEXT, body)
+    case <-keepalive.C:
+      err = send(WS_OP_PING, nil)
+    case <-done:
+      log.Status("server.stream", "WebSocket client disconnected for "+email)
+      return
+    }
+    if err != nil {
+      log.Debug("server.stream", "WebSocket write failed", err)
+      return
+    }
+  }
+}
+
+/* Writes a single unmasked, unfragmented frame, as servers must. */
+func writeFrame(w *bufio.Writer, opcode byte, payload []byte) error {
+  header := []byte{0x80 | opcode}
+  l := len(payload)
+  switch {
+  case l < 126:
+    header = append(header, byte(l))
+  case l <= 0xFFFF:
+    header = append(header, 126, 0, 0)
+    binary.BigEndian.PutUint16(header[2:], uint16(l))
+  default:
+    header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+    binary.BigEndian.PutUint64(header[2:], uint64(l))
+  }
+  if _, err := w.Write(header); err != nil {
+    return err
+  }
+  _, err := w.Write(payload)
+  return err
+}
+
+/* Reads a single frame from a client, which must be masked. We never expect
+ * clients to send us anything but control frames, so large frames are
+ * treated as errors. */
+func readFrame(r *bufio.Reader) (byte, []byte, error) {
+  var header [2]byte
+  if _, err := io.ReadFull(r, header[:]); err != nil {
+    return 0, nil, err
+  }
+  opcode := header[0] & 0x0F
+  if header[1]&0x80 == 0 {
+    return 0, nil, errors.New("client frame not masked")
+  }
+  l := uint64(header[1] & 0x7F)
+  switch l {
+  case 126:
+    var ext [2]byte
+    if _, err := io.ReadFull(r, ext[:]); err != nil {
+      return 0, nil, err
+    }
+    l = uint64(binary.BigEndian.Uint16(ext[:]))
+  case 127:
+    var ext [8]byte
+    if _, err := io.ReadFull(r, ext[:]); err != nil {
+      return 0, nil, err
+    }
+    l = binary.BigEndian.Uint64(ext[:])
+  }
+  if l > WS_MAX_CLIENT_LEN {
+    return 0, nil, errors.New("client frame too large")
+  }
+  var mask [4]byte
+  if _, err := io.ReadFull(r, mask[:]); err != nil {
+    return 0, nil, err
+  }
+  payload := make([]byte, l)
+  if _, err := io.ReadFull(r, payload); err != nil {
+    return 0, nil, err
+  }
+  for i := range payload {
+    payload[i] ^= mask[i%4]
+  }
+  return opcode, payload, nil
+}
@@ -0,0 +1,105 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+  "sync"
+  "time"
+)
+
+const (
+  // failures allowed before a client has to start waiting between attempts
+  LOGIN_FREE_FAILURES = 3
+  // the wait after the first failure past those; it doubles with each one
+  LOGIN_BACKOFF_BASE = 2 * time.Second
+  LOGIN_BACKOFF_MAX  = 15 * time.Minute
+  // how long failures count against a client that stops trying
+  LOGIN_FAILURE_MEMORY = 1 * time.Hour
+)
+
+type failures struct {
+  count int
+  last  time.Time
+  until time.Time // no attempts before this
+}
+
+/* Slows down password guessing by making clients wait longer and longer
+ * between failed logins. Failures are counted both per username and per
+ * client address, so neither spreading guesses across accounts nor across
+ * addresses gets around it. */
+type throttle struct {
+  mutex    sync.Mutex
+  failures map[string]*failures
+  now      func() time.Time
+}
+
+func newThrottle() *throttle {
+  return &throttle{failures: make(map[string]*failures), now: time.Now}
+}
+
+/* Returns how much longer a login involving any of the keys must wait, or
+ * 0 if it may go ahead. */
+func (t *throttle) wait(keys ...string) time.Duration {
+  t.mutex.Lock()
+  defer t.mutex.Unlock()
+  now := t.now()
+  longest := time.Duration(0)
+  for _, key := range keys {
+    if f, ok := t.failures[key]; ok && f.until.Sub(now) > longest {
+      longest = f.until.Sub(now)
+    }
+  }
+  return longest
+}
+
+/* Records a failed login against each of the keys. */
+func (t *throttle) fail(keys ...string) {
+  t.mutex.Lock()
+  defer t.mutex.Unlock()
+  now := t.now()
+  for key, f := range t.failures {
+    if now.Sub(f.last) > LOGIN_FAILURE_MEMORY && now.After(f.until) {
+      delete(t.failures, key)
+    }
+  }
+  for _, key := range keys {
+    f, ok := t.failures[key]
+    if !ok {
+      f = &failures{}
+      t.failures[key] = f
+    }
+    f.count++
+    f.last = now
+    if f.count > LOGIN_FREE_FAILURES {
+      delay := LOGIN_BACKOFF_BASE
+      for i := LOGIN_FREE_FAILURES + 1; i < f.count && delay < LOGIN_BACKOFF_MAX; i++ {
+        delay *= 2
+      }
+      if delay > LOGIN_BACKOFF_MAX {
+        delay = LOGIN_BACKOFF_MAX
+      }
+      f.until = now.Add(delay)
+    }
+  }
+}
+
+/* Forgets the failures recorded against a key, e.g. a username once its
+ * owner has logged in. */
+func (t *throttle) forget(key string) {
+  t.mutex.Lock()
+  defer t.mutex.Unlock()
+  delete(t.failures, key)
+}
@@ -0,0 +1,101 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+  "strconv"
+  "testing"
+  "time"
+)
+
+func fakeClock(t *throttle) *time.Time {
+  now := time.Date(2013, 6, 1, 12, 0, 0, 0, time.UTC)
+  t.now = func() time.Time { return now }
+  return &now
+}
+
+func TestThrottleBackoff(t *testing.T) {
+  th := newThrottle()
+  now := fakeClock(th)
+
+  for i := 0; i < LOGIN_FREE_FAILURES; i++ {
+    th.fail("user:alice", "host:10.0.0.1")
+    if wait := th.wait("user:alice", "host:10.0.0.1"); wait != 0 {
+      t.Fatalf("made to wait %v after %d failures", wait, i+1)
+    }
+  }
+
+  want := LOGIN_BACKOFF_BASE
+  for i := 0; i < 20; i++ {
+    th.fail("user:alice", "host:10.0.0.1")
+    if wait := th.wait("user:alice", "host:10.0.0.1"); wait != want {
+      t.Fatalf("waiting %v after %d failures, want %v", wait, LOGIN_FREE_FAILURES+i+1, want)
+    }
+    *now = now.Add(want)
+    if wait := th.wait("user:alice"); wait != 0 {
+      t.Fatalf("still waiting %v once the backoff elapsed", wait)
+    }
+    if want *= 2; want > LOGIN_BACKOFF_MAX {
+      want = LOGIN_BACKOFF_MAX
+    }
+  }
+}
+
+func TestThrottleKeys(t *testing.T) {
+  th := newThrottle()
+  fakeClock(th)
+
+  // guessing at several accounts from one address
+  for _, user := range []string{"alice", "bob", "carol", "dave"} {
+    th.fail("user:"+user, "host:10.0.0.1")
+  }
+  if th.wait("user:erin", "host:10.0.0.1") == 0 {
+    t.Error("address not throttled")
+  }
+  if th.wait("user:erin", "host:10.0.0.2") != 0 {
+    t.Error("unrelated login throttled")
+  }
+
+  // guessing at one account from several addresses
+  for i := 0; i < LOGIN_FREE_FAILURES+1; i++ {
+    th.fail("user:frank", "host:192.168.0."+strconv.Itoa(i))
+  }
+  if th.wait("user:frank", "host:10.0.0.9") == 0 {
+    t.Error("username not throttled")
+  }
+
+  th.forget("user:frank")
+  if th.wait("user:frank", "host:10.0.0.9") != 0 {
+    t.Error("failures not forgotten")
+  }
+}
+
+func TestThrottleForgetsOldFailures(t *testing.T) {
+  th := newThrottle()
+  now := fakeClock(th)
+  for i := 0; i < LOGIN_FREE_FAILURES; i++ {
+    th.fail("user:alice")
+  }
+  *now = now.Add(LOGIN_FAILURE_MEMORY + time.Minute)
+  th.fail("user:bob") // prunes
+  th.fail("user:alice")
+  if wait := th.wait("user:alice"); wait != 0 {
+    t.Errorf("old failures still counted; waiting %v", wait)
+  }
+  if len(th.failures) != 2 {
+    t.Errorf("tracking %d keys, want 2", len(th.failures))
+  }
+}
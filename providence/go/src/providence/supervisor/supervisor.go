@@ -0,0 +1,160 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package supervisor
+
+/*
+ * Notices when a sensor hub, or a sensor behind one, goes quiet: a hung
+ * Arduino or a pulled USB cable otherwise just looks like a very uneventful
+ * house. Sources that can be supervised register with Watch, then report
+ * each heartbeat from their hub (listing the sensors it can see) and each
+ * reading from a sensor. If the hub misses heartbeats for its timeout, or a
+ * sensor stops being listed while the hub is otherwise fine, an offline
+ * event goes out through the dispatcher like any other; it is reset once
+ * the hub or sensor is heard from again.
+ */
+
+import (
+  "sync"
+  "time"
+
+  "providence/common"
+  "providence/db"
+  "providence/log"
+  "providence/types"
+)
+
+type sensorState struct {
+  lastSeen time.Time
+  offline  *types.Event
+}
+
+type sourceState struct {
+  timeout  time.Duration
+  lastSeen time.Time
+  offline  *types.Event
+  sensors  map[string]*sensorState
+}
+
+var (
+  mutex   sync.Mutex
+  sources = make(map[string]*sourceState)
+)
+
+/* Starts supervising a source and its sensors. Everything gets a full
+ * timeout's grace before it can be reported offline. */
+func Watch(source string, sensorIDs []string, timeout time.Duration) {
+  mutex.Lock()
+  defer mutex.Unlock()
+  now := time.Now()
+  state := &sourceState{timeout: timeout, lastSeen: now, sensors: make(map[string]*sensorState)}
+  for _, id := range sensorIDs {
+    state.sensors[id] = &sensorState{lastSeen: now}
+  }
+  sources[source] = state
+}
+
+/* Records a heartbeat from a source's hub, which vouches for the listed
+ * sensors. */
+func Heartbeat(source string, sensorIDs []string) {
+  mutex.Lock()
+  defer mutex.Unlock()
+  state, ok := sources[source]
+  if !ok {
+    return
+  }
+  now := time.Now()
+  state.lastSeen = now
+  for _, id := range sensorIDs {
+    if sensor, ok := state.sensors[id]; ok {
+      sensor.lastSeen = now
+    }
+  }
+}
+
+/* Records a reading from one of a source's sensors, which shows that both it
+ * and its hub are alive. */
+func Seen(source string, sensorID string) {
+  Heartbeat(source, []string{sensorID})
+}
+
+/* Works out which sources and sensors have gone offline or come back, and
+ * returns the events announcing that. Events for ones that have come back
+ * are our own copies of the offline events, with Reset set. */
+func check(now time.Time) []types.Event {
+  mutex.Lock()
+  defer mutex.Unlock()
+  events := make([]types.Event, 0)
+
+  for name, src := range sources {
+    hubAlive := now.Sub(src.lastSeen) < src.timeout
+    switch {
+    case !hubAlive && src.offline == nil:
+      log.Error("supervisor.check", "sensor hub '"+name+"' not heard from since "+src.lastSeen.Format(time.RFC3339))
+      event := types.NewOfflineEvent(name, "")
+      src.offline = &event
+      events = append(events, event)
+    case hubAlive && src.offline != nil:
+      log.Status("supervisor.check", "sensor hub '"+name+"' is back")
+      src.offline.Reset = &now
+      events = append(events, *src.offline)
+      src.offline = nil
+    }
+    if !hubAlive {
+      continue // no point also reporting every sensor behind it
+    }
+
+    for id, sensor := range src.sensors {
+      sensorAlive := now.Sub(sensor.lastSeen) < src.timeout
+      switch {
+      case !sensorAlive && sensor.offline == nil:
+        log.Error("supervisor.check", "sensor '"+id+"' not reported by '"+name+"' since "+sensor.lastSeen.Format(time.RFC3339))
+        event := types.NewOfflineEvent(name, id)
+        sensor.offline = &event
+        events = append(events, event)
+      case sensorAlive && sensor.offline != nil:
+        log.Status("supervisor.check", "sensor '"+id+"' is back")
+        sensor.offline.Reset = &now
+        events = append(events, *sensor.offline)
+        sensor.offline = nil
+      }
+    }
+  }
+  return events
+}
+
+/* Checks on the supervised sources once a second, and injects offline and
+ * back-online events into the outgoing channel. Ignores everything on
+ * 'incoming'. */
+func Supervisor(incoming chan types.Event, outgoing chan types.Event) {
+  ticker := time.Tick(1 * time.Second)
+  for {
+    select {
+    case <-incoming:
+    case now := <-ticker:
+      for _, event := range check(now) {
+        if event.Reset != nil {
+          // the offline event may have been acknowledged since we sent it
+          reset := event.Reset
+          event = db.Refresh(event)
+          event.Reset = reset
+        }
+        outgoing <- event
+      }
+    }
+  }
+}
+
+var Handler common.Handler = Supervisor
@@ -0,0 +1,149 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tty
+
+/*
+ * The Arduino frames each message as
+ *
+ *   $<seq>,<JSON>*<CRC>\r\n
+ *
+ * where seq counts messages from 0 to 255 and wraps, and CRC is the CRC-32
+ * (IEEE) of everything between '$' and '*', as 8 hex digits. A '$' always
+ * starts a new frame, so after line noise, a partial frame from a reset
+ * Arduino or any other garbage, the reader picks up again at the next frame
+ * rather than trying to make sense of what came before.
+ *
+ * Firmware from before framing sent each message as a bare line of JSON.
+ * That is a breaking change: unless the source is configured as Unframed,
+ * such lines are discarded as garbage, so old firmware must be reflashed.
+ */
+
+import (
+  "bufio"
+  "bytes"
+  "errors"
+  "hash/crc32"
+  "io"
+  "strconv"
+)
+
+/* Longer than any frame the Arduino sends; anything longer is garbage. */
+const MAX_FRAME_LENGTH = 256
+
+type frame struct {
+  seq     uint8
+  payload []byte
+  legacy  bool // a bare line from unframed firmware, without seq
+}
+
+/* Splits a byte stream into valid frames, discarding anything else. */
+type frameReader struct {
+  r        *bufio.Reader
+  buf      []byte
+  unframed bool // whether to accept bare lines of JSON too
+
+  // counts of garbage bytes skipped between frames, of frames dropped for
+  // being malformed, truncated or corrupt, and of jumps in the sequence
+  // numbers, i.e. lost frames or a reset Arduino
+  skipped int
+  dropped int
+  gaps    int
+
+  started bool // whether lastSeq is set
+  lastSeq uint8
+}
+
+func newFrameReader(r io.Reader, unframed bool) *frameReader {
+  return &frameReader{r: bufio.NewReader(r), buf: make([]byte, 0, MAX_FRAME_LENGTH), unframed: unframed}
+}
+
+/* Returns the next valid frame; errors only come from the underlying
+ * reader. */
+func (f *frameReader) next() (frame, error) {
+  inFrame, legacy := false, false
+  for {
+    b, err := f.r.ReadByte()
+    if err != nil {
+      return frame{}, err
+    }
+    switch {
+    case b == '$':
+      if inFrame {
+        f.dropped++ // truncated by the start of another
+      }
+      inFrame, legacy = true, false
+      f.buf = f.buf[:0]
+    case !inFrame && b == '{' && f.unframed:
+      inFrame, legacy = true, true
+      f.buf = append(f.buf[:0], b)
+    case !inFrame:
+      if b != '\r' && b != '\n' {
+        f.skipped++
+      }
+    case b == '\n' && legacy:
+      inFrame = false
+      payload := bytes.TrimSuffix(f.buf, []byte{'\r'})
+      return frame{payload: append([]byte(nil), payload...), legacy: true}, nil
+    case b == '\n':
+      inFrame = false
+      fr, err := parseFrame(f.buf)
+      if err != nil {
+        f.dropped++
+        continue
+      }
+      if f.started && fr.seq != f.lastSeq+1 {
+        f.gaps++
+      }
+      f.started, f.lastSeq = true, fr.seq
+      return fr, nil
+    case len(f.buf) == MAX_FRAME_LENGTH:
+      inFrame = false
+      f.dropped++
+    default:
+      f.buf = append(f.buf, b)
+    }
+  }
+}
+
+/* Checks and decodes the contents of a frame, i.e. what's between '$' and
+ * the end of the line. */
+func parseFrame(b []byte) (frame, error) {
+  b = bytes.TrimSuffix(b, []byte{'\r'})
+  star := bytes.LastIndexByte(b, '*')
+  if star < 0 || len(b)-star-1 != 8 {
+    return frame{}, errors.New("missing checksum")
+  }
+  body := b[:star]
+  sum, err := strconv.ParseUint(string(b[star+1:]), 16, 32)
+  if err != nil {
+    return frame{}, err
+  }
+  if uint32(sum) != crc32.ChecksumIEEE(body) {
+    return frame{}, errors.New("checksum mismatch")
+  }
+
+  comma := bytes.IndexByte(body, ',')
+  if comma < 0 {
+    return frame{}, errors.New("missing sequence number")
+  }
+  seq, err := strconv.ParseUint(string(body[:comma]), 10, 8)
+  if err != nil {
+    return frame{}, err
+  }
+  // copy, since buf is reused for the next frame
+  payload := append([]byte(nil), body[comma+1:]...)
+  return frame{seq: uint8(seq), payload: payload}, nil
+}
@@ -0,0 +1,182 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tty
+
+import (
+  "bytes"
+  "fmt"
+  "hash/crc32"
+  "io"
+  "strings"
+  "testing"
+)
+
+/* Frames a payload the way the Arduino does. */
+func framed(seq uint8, payload string) string {
+  body := fmt.Sprintf("%d,%s", seq, payload)
+  return fmt.Sprintf("$%s*%08X\r\n", body, crc32.ChecksumIEEE([]byte(body)))
+}
+
+/* Reads frames until the input runs out. */
+func readAll(t *testing.T, f *frameReader) []frame {
+  t.Helper()
+  frames := make([]frame, 0)
+  for {
+    fr, err := f.next()
+    if err == io.EOF {
+      return frames
+    }
+    if err != nil {
+      t.Fatal(err)
+    }
+    frames = append(frames, fr)
+  }
+}
+
+func TestParseFrame(t *testing.T) {
+  good := strings.TrimSuffix(strings.TrimPrefix(framed(42, `{"Which":"door"}`), "$"), "\n")
+  fr, err := parseFrame([]byte(good))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if fr.seq != 42 || string(fr.payload) != `{"Which":"door"}` || fr.legacy {
+    t.Errorf("got %+v", fr)
+  }
+  // lowercase hex is fine too
+  if fr, err := parseFrame([]byte(bodyWithSum("7,{}"))); err != nil || fr.seq != 7 {
+    t.Errorf("got %+v, %v with a lowercase checksum", fr, err)
+  }
+
+  // change the checksum's last digit
+  badSum := []byte(good)
+  if badSum[len(badSum)-2] == '0' {
+    badSum[len(badSum)-2] = '1'
+  } else {
+    badSum[len(badSum)-2] = '0'
+  }
+
+  for name, b := range map[string]string{
+    "empty":            "",
+    "no checksum":      `0,{}`,
+    "short checksum":   `0,{}*1234`,
+    "bad hex":          `0,{}*XXXXXXXX`,
+    "corrupt payload":  strings.Replace(good, "door", "dour", 1),
+    "corrupt checksum": string(badSum),
+    "no sequence":      bodyWithSum("{}"),
+    "sequence too big": bodyWithSum("256,{}"),
+    "bad sequence":     bodyWithSum("x,{}"),
+  } {
+    if fr, err := parseFrame([]byte(b)); err == nil {
+      t.Errorf("%s: parsed %q as %+v", name, b, fr)
+    }
+  }
+}
+
+/* A frame's contents with a valid checksum, whatever the body. */
+func bodyWithSum(body string) string {
+  return fmt.Sprintf("%s*%08x", body, crc32.ChecksumIEEE([]byte(body)))
+}
+
+func TestFrameReader(t *testing.T) {
+  input := strings.Join([]string{
+    framed(0, `{"Which":"a"}`),
+    "line noise\r\n",
+    framed(1, `{"Which":"b"}`),
+    "$1,{\"Which\":\"tr", // truncated by a reset Arduino
+    framed(0, `{"Which":"c"}`),
+    "$5,{\"Which\":\"d\"}*00000000\r\n", // bad CRC
+    "#!" + framed(7, `{"Which":"e"}`),   // garbage right before a frame
+    framed(8, `{"Which":"f"}`),
+  }, "")
+  f := newFrameReader(strings.NewReader(input), false)
+  frames := readAll(t, f)
+
+  want := []struct {
+    seq   uint8
+    which string
+  }{{0, "a"}, {1, "b"}, {0, "c"}, {7, "e"}, {8, "f"}}
+  if len(frames) != len(want) {
+    t.Fatalf("got %d frames, want %d", len(frames), len(want))
+  }
+  for i, w := range want {
+    if frames[i].seq != w.seq || !bytes.Contains(frames[i].payload, []byte(`"`+w.which+`"`)) {
+      t.Errorf("frame %d: got %d %q, want %d for %s", i, frames[i].seq, frames[i].payload, w.seq, w.which)
+    }
+  }
+  if f.skipped != len("line noise")+len("#!") {
+    t.Errorf("skipped %d bytes of garbage", f.skipped)
+  }
+  if f.dropped != 2 {
+    t.Errorf("dropped %d bad frames, want 2", f.dropped)
+  }
+}
+
+func TestFrameReaderOverlong(t *testing.T) {
+  input := "$" + strings.Repeat("x", 2*MAX_FRAME_LENGTH) + "\r\n" + framed(3, "{}")
+  f := newFrameReader(strings.NewReader(input), false)
+  frames := readAll(t, f)
+  if len(frames) != 1 || frames[0].seq != 3 {
+    t.Errorf("got %+v after an overlong frame", frames)
+  }
+  if f.dropped != 1 {
+    t.Errorf("dropped %d frames, want 1", f.dropped)
+  }
+}
+
+func TestFrameReaderPayloadsAreCopies(t *testing.T) {
+  f := newFrameReader(strings.NewReader(framed(0, `{"Which":"a"}`)+framed(1, `{"Which":"b"}`)), false)
+  frames := readAll(t, f)
+  if len(frames) != 2 || string(frames[0].payload) != `{"Which":"a"}` {
+    t.Errorf("first frame's payload clobbered: %+v", frames)
+  }
+}
+
+func TestFrameReaderUnframed(t *testing.T) {
+  legacy := "{\"Which\":\"a\",\"Action\":0}\r\n"
+  input := legacy + framed(4, `{"Which":"b"}`) + legacy
+
+  // ignored unless asked for
+  f := newFrameReader(strings.NewReader(input), false)
+  if frames := readAll(t, f); len(frames) != 1 || frames[0].seq != 4 {
+    t.Errorf("got %+v from framed-only reader", frames)
+  }
+
+  f = newFrameReader(strings.NewReader(input), true)
+  frames := readAll(t, f)
+  if len(frames) != 3 {
+    t.Fatalf("got %d frames, want 3", len(frames))
+  }
+  if !frames[0].legacy || string(frames[0].payload) != strings.TrimSpace(legacy) {
+    t.Errorf("got %+v for a bare line", frames[0])
+  }
+  if frames[1].legacy || frames[1].seq != 4 {
+    t.Errorf("got %+v for a framed message", frames[1])
+  }
+}
+
+func TestFrameReaderGaps(t *testing.T) {
+  input := framed(254, "{}") + framed(255, "{}") + framed(0, "{}") + // wraps
+    framed(2, "{}") + // lost 1
+    "$3,{}*00000000\r\n" + framed(4, "{}") + // corrupt 3
+    framed(0, "{}") // reset
+  f := newFrameReader(strings.NewReader(input), false)
+  if frames := readAll(t, f); len(frames) != 6 {
+    t.Fatalf("got %d frames, want 6", len(frames))
+  }
+  if f.gaps != 3 {
+    t.Errorf("counted %d gaps, want 3", f.gaps)
+  }
+}
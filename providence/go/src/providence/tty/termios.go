@@ -0,0 +1,69 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tty
+
+import (
+  "os"
+  "syscall"
+  "unsafe"
+)
+
+// not in package syscall; the same on every Linux architecture we run on
+const cbaud = 0x100f
+
+var baudRates = map[int]uint32{
+  1200:   syscall.B1200,
+  2400:   syscall.B2400,
+  4800:   syscall.B4800,
+  9600:   syscall.B9600,
+  19200:  syscall.B19200,
+  38400:  syscall.B38400,
+  57600:  syscall.B57600,
+  115200: syscall.B115200,
+}
+
+/* Puts the serial device into raw mode at the given speed, 8N1 without flow
+ * control, so that the line discipline neither echoes, translates nor
+ * buffers what the Arduino sends. Works on a pty too. */
+func configure(file *os.File, baud int) error {
+  var t syscall.Termios
+  fd := file.Fd()
+  if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCGETS, uintptr(unsafe.Pointer(&t))); errno != 0 {
+    return errno
+  }
+
+  // the equivalent of cfmakeraw()
+  t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+    syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON | syscall.IXOFF
+  t.Oflag &^= syscall.OPOST
+  t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+  t.Cflag &^= syscall.CSIZE | syscall.PARENB | syscall.CSTOPB
+  t.Cflag |= syscall.CS8 | syscall.CREAD | syscall.CLOCAL
+
+  // block until at least one byte arrives, however long that takes
+  t.Cc[syscall.VMIN] = 1
+  t.Cc[syscall.VTIME] = 0
+
+  speed := baudRates[baud] // validated by config
+  t.Cflag = t.Cflag&^cbaud | speed
+  t.Ispeed = speed
+  t.Ospeed = speed
+
+  if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCSETS, uintptr(unsafe.Pointer(&t))); errno != 0 {
+    return errno
+  }
+  return nil
+}
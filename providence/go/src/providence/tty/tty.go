@@ -12,48 +12,223 @@
  * See the License for the specific language governing permissions and
  * limitations under the License.
  */
+
 package tty
 
 import (
-  "bufio"
   "encoding/json"
   "os"
+  "strconv"
+  "syscall"
   "time"
 
   "providence/common"
   "providence/config"
+  "providence/db"
   "providence/log"
+  "providence/supervisor"
   "providence/types"
 )
 
-/* Reads a USB TTY looking for JSON messages from a hardware monitor and
- * injects low-level (trip and reset) eventCodes into the outgoing channel.
- * Never reads from 'incoming'; accordingly, should never be registered for
- * any message types or it will eventually deadlock when the channel buffer
- * fills.
- */
-func Reader(incoming chan types.Event, outgoing chan types.Event) {
-  file, err := os.Open(config.Sensor.TTYPath)
-  if err != nil {
-    log.Error("tty.reader", "error opening ", config.Sensor.TTYPath, ", aborting ", err)
+const (
+  MIN_REOPEN_DELAY = 1 * time.Second
+  MAX_REOPEN_DELAY = 1 * time.Minute
+)
+
+/* What the Arduino reports, in each frame's JSON: either a sensor by ID,
+ * and whether it went to TRIP or RESET, or was tampered with (one of the
+ * types.TAMPER_ kinds, or TAMPER_NONE once it's back to normal); or,
+ * periodically, a heartbeat listing the supervised sensors responding. */
+type message struct {
+  Which     string
+  Action    int
+  Tamper    string
+  Heartbeat []string
+}
+
+const (
+  ACTION_TRIP  = 0
+  ACTION_RESET = 1
+
+  TAMPER_NONE = "none"
+)
+
+type reader struct {
+  src      config.SensorSourceConfig
+  outgoing chan types.Event
+  owned    map[string]bool
+  current  map[string]*types.Event // by sensor ID, while tripped
+  tampered map[string]*types.Event // by sensor ID, while tampered with
+}
+
+/* Loads the latest stored copy of an event; see db.Refresh. */
+var refresh = db.Refresh
+
+/* Sends the reset of an event we've been holding on to. It starts from the
+ * stored copy, since ours predates anything done to it since it was sent,
+ * like an acknowledgement, and resending ours would undo that. */
+func (r *reader) reset(event *types.Event, when time.Time) {
+  latest := refresh(*event)
+  latest.Reset = &when
+  r.outgoing <- latest
+}
+
+/* Raises or clears a tamper event for a sensor. */
+func (r *reader) tamper(id string, kind string) {
+  current := r.tampered[id]
+  now := time.Now()
+  switch kind {
+  case TAMPER_NONE:
+    if current == nil {
+      return
+    }
+    log.Status("tty.reader", "sensor '"+id+"' no longer tampered with")
+    r.reset(current, now)
+    delete(r.tampered, id)
+  case types.TAMPER_CUT, types.TAMPER_SHORTED, types.TAMPER_SWITCH:
+    if current != nil && current.Tamper == kind {
+      return
+    }
+    if current != nil {
+      // e.g. a cut wire that's now shorted; close out the old one
+      r.reset(current, now)
+    }
+    log.Error("tty.reader", "sensor '"+id+"' tampered with: "+kind)
+    event := types.NewTamperEvent(id, kind)
+    r.tampered[id] = &event
+    r.outgoing <- event
+  default:
+    log.Warn("tty.reader", "unknown tamper kind '"+kind+"' for sensor '"+id+"'")
+  }
+}
+
+/* Turns a message into a trip or reset event. */
+func (r *reader) dispatch(msg message) {
+  if msg.Heartbeat != nil {
+    supervisor.Heartbeat(r.src.Name, msg.Heartbeat)
+    return
+  }
+  if !r.owned[msg.Which] {
+    log.Warn("tty.reader", "ignoring sensor '"+msg.Which+"', which isn't claimed by source '"+r.src.Name+"'")
+    return
+  }
+  supervisor.Seen(r.src.Name, msg.Which)
+  if msg.Tamper != "" {
+    r.tamper(msg.Which, msg.Tamper)
     return
   }
+  current := r.current[msg.Which]
+  switch msg.Action {
+  case ACTION_TRIP:
+    if current != nil {
+      return
+    }
+    event := types.NewEvent(msg.Which)
+    r.current[msg.Which] = &event
+    r.outgoing <- event
+  case ACTION_RESET:
+    if current == nil {
+      return
+    }
+    r.reset(current, time.Now())
+    delete(r.current, msg.Which)
+  default:
+    log.Warn("tty.reader", "unknown action "+strconv.Itoa(msg.Action)+" for sensor '"+msg.Which+"'")
+  }
+}
+
+/* Opens and configures the TTY, then reports what it reads until reading
+ * fails. Also returns whether any valid frame was read, i.e. whether the
+ * device was working at all. */
+func (r *reader) session() (bool, error) {
+  // O_NOCTTY so the Arduino can't become our controlling terminal
+  file, err := os.OpenFile(r.src.TTYPath, os.O_RDONLY|syscall.O_NOCTTY, 0)
+  if err != nil {
+    return false, err
+  }
+  defer file.Close()
+  if err = configure(file, r.src.Baud); err != nil {
+    return false, err
+  }
+  log.Status("tty.reader", "reading "+r.src.TTYPath+" at "+strconv.Itoa(r.src.Baud)+" baud")
+
+  frames := newFrameReader(file, r.src.Unframed)
+  got := false
+  for {
+    fr, err := frames.next()
+    if err != nil {
+      return got, err
+    }
+    if frames.skipped > 0 || frames.dropped > 0 {
+      log.Warn("tty.reader", "skipped "+strconv.Itoa(frames.skipped)+" bytes of garbage and "+
+        strconv.Itoa(frames.dropped)+" bad frames from "+r.src.TTYPath)
+      frames.skipped, frames.dropped = 0, 0
+    }
+    if frames.gaps > 0 {
+      log.Warn("tty.reader", "sequence jumped to "+strconv.Itoa(int(fr.seq))+
+        "; messages were lost, or the Arduino reset")
+      frames.gaps = 0
+    }
+    got = true
+
+    var msg message
+    if err := json.Unmarshal(fr.payload, &msg); err != nil {
+      log.Warn("tty.reader", "bad message '"+string(fr.payload)+"'", err)
+      continue
+    }
+    r.dispatch(msg)
+  }
+}
 
-  type rawEvent struct {
-    Which  string
-    Action int
+/* Reads framed messages from an Arduino on a USB TTY and injects low-level
+ * (trip and reset) events into the outgoing channel, for the source's own
+ * sensors only. When the device goes away, e.g. because the Arduino reset
+ * or the USB device re-enumerated, it is reopened, backing off while it
+ * keeps failing; meanwhile the supervisor notices the missing heartbeats. */
+func readTTY(src config.SensorSourceConfig, outgoing chan types.Event) {
+  r := &reader{
+    src:      src,
+    outgoing: outgoing,
+    owned:    make(map[string]bool),
+    current:  make(map[string]*types.Event),
+    tampered: make(map[string]*types.Event),
+  }
+  for _, id := range src.Sensors {
+    r.owned[id] = true
   }
-  reader := bufio.NewReader(file)
-  dec := json.NewDecoder(reader)
-  var e rawEvent
+  // the hub can only vouch for its supervised loops; a plain switch that
+  // stopped working looks just like one nobody has opened, so for those
+  // only the hub itself is watched
+  watched := make([]string, 0)
+  for _, id := range src.Sensors {
+    if types.Sensors[id].Modality == types.SUPERVISED {
+      watched = append(watched, id)
+    }
+  }
+  supervisor.Watch(src.Name, watched, src.HeartbeatTimeout*time.Second)
+
+  delay := MIN_REOPEN_DELAY
   for {
-    err := dec.Decode(&e)
-    if err == nil {
-      outgoing <- types.Event{Which: common.SensorState[e.Which], Action: types.EventCode(e.Action), When: time.Now()}
-    } else {
-      log.Warn("tty.reader", "JSON parse error from tty")
+    got, err := r.session()
+    if got {
+      delay = MIN_REOPEN_DELAY
+    }
+    log.Error("tty.reader", "lost "+src.TTYPath+"; reopening in "+delay.String(), err)
+    time.Sleep(delay)
+    if !got && delay < MAX_REOPEN_DELAY {
+      delay *= 2
+      if delay > MAX_REOPEN_DELAY {
+        delay = MAX_REOPEN_DELAY
+      }
     }
   }
 }
 
-var Handler = Reader
+/* Returns a handler reading the source's TTY. Never reads from 'incoming';
+ * accordingly, should never be registered for any message types or it will
+ * eventually deadlock when the channel buffer fills. */
+func NewHandler(src config.SensorSourceConfig) common.Handler {
+  return func(incoming chan types.Event, outgoing chan types.Event) {
+    readTTY(src, outgoing)
+  }
+}
@@ -0,0 +1,167 @@
+/* Copyright © 2013 Dan Morrill
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tty
+
+import (
+  "os"
+  "path/filepath"
+  "strconv"
+  "syscall"
+  "testing"
+  "time"
+  "unsafe"
+
+  "providence/config"
+  "providence/types"
+)
+
+func ioctl(file *os.File, req uintptr, arg unsafe.Pointer) error {
+  if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), req, uintptr(arg)); errno != 0 {
+    return errno
+  }
+  return nil
+}
+
+/* Stands in for an Arduino: a pty whose master end we write to, and whose
+ * slave end is the TTY being read. The slave is held open and put in raw
+ * mode up front, so that what we write before the reader opens it isn't
+ * cooked or echoed. */
+type fakeArduino struct {
+  master *os.File
+  slave  *os.File
+  path   string
+}
+
+func newFakeArduino(t *testing.T) *fakeArduino {
+  master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+  if err != nil {
+    t.Skip("no ptys: ", err)
+  }
+  var unlock int32
+  if err = ioctl(master, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err != nil {
+    t.Fatal(err)
+  }
+  var n uint32
+  if err = ioctl(master, syscall.TIOCGPTN, unsafe.Pointer(&n)); err != nil {
+    t.Fatal(err)
+  }
+  a := &fakeArduino{master: master, path: "/dev/pts/" + strconv.Itoa(int(n))}
+  if a.slave, err = os.OpenFile(a.path, os.O_RDWR|syscall.O_NOCTTY, 0); err != nil {
+    t.Fatal(err)
+  }
+  if err = configure(a.slave, 9600); err != nil {
+    t.Fatal(err)
+  }
+  t.Cleanup(a.unplug)
+  return a
+}
+
+func (a *fakeArduino) send(t *testing.T, s string) {
+  if _, err := a.master.WriteString(s); err != nil {
+    t.Fatal(err)
+  }
+}
+
+func (a *fakeArduino) unplug() {
+  a.master.Close()
+  a.slave.Close()
+}
+
+func TestConfigure(t *testing.T) {
+  a := newFakeArduino(t)
+  if err := configure(a.slave, 115200); err != nil {
+    t.Fatal(err)
+  }
+  var tio syscall.Termios
+  if err := ioctl(a.slave, syscall.TCGETS, unsafe.Pointer(&tio)); err != nil {
+    t.Fatal(err)
+  }
+  if tio.Lflag&(syscall.ICANON|syscall.ECHO|syscall.ISIG) != 0 {
+    t.Errorf("still canonical or echoing: lflag %#o", tio.Lflag)
+  }
+  if tio.Iflag&(syscall.ICRNL|syscall.IXON) != 0 || tio.Oflag&syscall.OPOST != 0 {
+    t.Errorf("still translating: iflag %#o oflag %#o", tio.Iflag, tio.Oflag)
+  }
+  if tio.Cflag&syscall.CSIZE != syscall.CS8 || tio.Cflag&(syscall.PARENB|syscall.CSTOPB) != 0 {
+    t.Errorf("not 8N1: cflag %#o", tio.Cflag)
+  }
+  if tio.Cflag&cbaud != syscall.B115200 {
+    t.Errorf("got speed %#o, want %#o", tio.Cflag&cbaud, syscall.B115200)
+  }
+  if tio.Cc[syscall.VMIN] != 1 || tio.Cc[syscall.VTIME] != 0 {
+    t.Errorf("got VMIN %d VTIME %d, want a blocking read", tio.Cc[syscall.VMIN], tio.Cc[syscall.VTIME])
+  }
+
+  // data arrives untouched
+  a.send(t, "a\r\nb\x03")
+  buf := make([]byte, 5)
+  if n, err := a.slave.Read(buf); err != nil || string(buf[:n]) != "a\r\nb\x03" {
+    t.Errorf("read %q, %v", buf[:n], err)
+  }
+}
+
+func nextEvent(t *testing.T, events chan types.Event) types.Event {
+  t.Helper()
+  select {
+  case ev := <-events:
+    return ev
+  case <-time.After(5 * time.Second):
+    t.Fatal("timed out waiting for an event")
+  }
+  return types.Event{}
+}
+
+func TestReopen(t *testing.T) {
+  types.Sensors["door"] = types.Sensor{SensorID: "door"}
+  defer delete(types.Sensors, "door")
+  saved := refresh
+  refresh = func(event types.Event) types.Event { return event }
+  defer func() { refresh = saved }()
+
+  // like a udev symlink, which follows the Arduino when it re-enumerates
+  link := filepath.Join(t.TempDir(), "arduino")
+  first := newFakeArduino(t)
+  if err := os.Symlink(first.path, link); err != nil {
+    t.Fatal(err)
+  }
+  first.send(t, "noise"+framed(0, `{"Which":"door","Action":0}`))
+
+  src := config.SensorSourceConfig{Name: "hub", Mode: config.SOURCE_TTY, Sensors: []string{"door"},
+    TTYPath: link, Baud: 9600, HeartbeatTimeout: 30}
+  events := make(chan types.Event, 10)
+  go readTTY(src, events)
+
+  trip := nextEvent(t, events)
+  if trip.SensorID != "door" || trip.Reset != nil {
+    t.Fatalf("got %+v, want door tripping", trip)
+  }
+
+  second := newFakeArduino(t)
+  second.send(t, framed(0, `{"Which":"door","Action":1}`))
+  tmp := link + ".new"
+  if err := os.Symlink(second.path, tmp); err != nil {
+    t.Fatal(err)
+  }
+  if err := os.Rename(tmp, link); err != nil {
+    t.Fatal(err)
+  }
+  first.unplug()
+
+  reset := nextEvent(t, events)
+  if reset.EventID != trip.EventID || reset.Reset == nil {
+    t.Errorf("got %+v after reopening, want the reset of %s", reset, trip.EventID)
+  }
+}
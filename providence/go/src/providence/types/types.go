@@ -17,6 +17,8 @@ package types
 
 import (
   "crypto/rand"
+  "errors"
+  "strings"
   "time"
 )
 
@@ -25,6 +27,16 @@ const (
   NORMALLY_OPEN SensorModality = iota
   NORMALLY_CLOSED
   RINGING
+  // a loop with end-of-line resistors, read by an analog input on the hub,
+  // which can tell open and closed from a cut or shorted wire
+  SUPERVISED
+)
+
+/* Kinds of tampering, as recorded in Event.Tamper. */
+const (
+  TAMPER_CUT = "cut" // supervised loop open-circuited
+  TAMPER_SHORTED = "shorted" // supervised loop short-circuited
+  TAMPER_SWITCH = "switch" // a separate tamper switch, e.g. on an enclosure, tripped
 )
 
 type SensorSubject int
@@ -41,6 +53,13 @@ type Event struct {
   Reset *time.Time
   IsAjar bool
   IsAnomalous bool
+  IsPending bool // tripped while armed; entry delay countdown in progress
+  AckedBy string // who acknowledged the alert, if anyone
+  AckedAt *time.Time
+  IsOffline bool // SensorID, or if that's "", the whole Source went quiet; Reset is when it came back
+  Source string // the sensor source, for offline events
+  IsTampered bool // SensorID's wiring or enclosure was tampered with; Reset is when that cleared
+  Tamper string // one of the TAMPER_ kinds
 }
 
 type Sensor struct {
@@ -48,6 +67,7 @@ type Sensor struct {
   Name string
   Modality SensorModality
   Subject SensorSubject
+  Zone string // optional; e.g. "perimeter", "interior", "garage"
 }
 
 func (s Sensor) SubjectName() string {
@@ -63,22 +83,119 @@ func (s Sensor) SubjectName() string {
 
 var Sensors = make(map[string]Sensor)
 
-func NewEvent(which string) Event {
-  s, ok := Sensors[which]
+/* The arming state of the whole system. DISARMED defers entirely to the
+ * configured exclusion intervals, i.e. the behavior from before modes
+ * existed; the others override those intervals for some or all sensors. */
+type SystemMode int
+const (
+  DISARMED SystemMode = iota
+  HOME
+  AWAY
+  NIGHT
+)
+
+var modeNames = map[SystemMode]string{
+  DISARMED: "Disarmed",
+  HOME:     "Home",
+  AWAY:     "Away",
+  NIGHT:    "Night",
+}
+
+func (m SystemMode) Name() string {
+  name, ok := modeNames[m]
   if !ok {
-    return Event{}
+    return "Unknown"
   }
+  return name
+}
+
+/* Looks up a SystemMode by its (case-insensitive) name, as sent by clients. */
+func ParseSystemMode(name string) (SystemMode, error) {
+  name = strings.TrimSpace(name)
+  for mode, modeName := range modeNames {
+    if strings.EqualFold(name, modeName) {
+      return mode, nil
+    }
+  }
+  return DISARMED, errors.New("unknown system mode '" + name + "'")
+}
+
+/* The current system mode, plus who set it and when. */
+type ModeState struct {
+  Mode      SystemMode
+  Changed   time.Time
+  ChangedBy string
+}
+
+func newEventID() string {
   // TODO: do something to guarantee uniqueness?
   buf := make([]byte, 16)
   io.ReadFull(rand.Reader, buf)
+  return fmt.Sprintf("%x", buf)
+}
+
+func NewEvent(which string) Event {
+  s, ok := Sensors[which]
+  if !ok {
+    return Event{}
+  }
   return Event{
-    EventID: fmt.Sprintf("%x", buf),
+    EventID: newEventID(),
     Trip: time.Now(),
     SensorID: which,
   }
 }
 
+/* Creates an event recording that a sensor source stopped reporting, or
+ * just one of its sensors if sensorID is set. */
+func NewOfflineEvent(source string, sensorID string) Event {
+  return Event{
+    EventID: newEventID(),
+    Trip: time.Now(),
+    SensorID: sensorID,
+    IsOffline: true,
+    Source: source,
+  }
+}
+
+/* Creates an event recording that a sensor was tampered with, in the way
+ * indicated by one of the TAMPER_ kinds. */
+func NewTamperEvent(sensorID string, kind string) Event {
+  return Event{
+    EventID: newEventID(),
+    Trip: time.Now(),
+    SensorID: sensorID,
+    IsTampered: true,
+    Tamper: kind,
+  }
+}
+
+var tamperNames = map[string]string{
+  TAMPER_CUT: "Wire Cut",
+  TAMPER_SHORTED: "Wire Shorted",
+  TAMPER_SWITCH: "Tamper Switch",
+}
+
 func (ev Event) Description() string {
+  if ev.IsTampered {
+    name := Sensors[ev.SensorID].Name
+    if ev.Reset != nil {
+      return name + " Tamper Cleared"
+    }
+    return name + " Tampered (" + tamperNames[ev.Tamper] + ")"
+  }
+
+  if ev.IsOffline {
+    name := "Sensor hub " + ev.Source
+    if ev.SensorID != "" {
+      name = Sensors[ev.SensorID].Name
+    }
+    if ev.Reset != nil {
+      return name + " Back Online"
+    }
+    return name + " Offline"
+  }
+
   sensor, ok := Sensors[ev.SensorID]
   if !ok {
     log.Error("types.Event.Description", "called on event with bogus sensor '" + ev.SensorID +"'")
@@ -93,6 +210,8 @@ func (ev Event) Description() string {
     } else {
       desc = "Closed"
     }
+  case ev.IsPending:
+    desc = "Tripped (Alarm Pending)"
   case ev.IsAjar:
     if sensor.Subject == types.MOTION {
       desc = "Motion"